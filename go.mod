@@ -1,3 +1,15 @@
 module github.com/646222472/zinx
 
-go 1.15
+go 1.18
+
+require (
+	github.com/golang/snappy v1.0.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.9.0
+	google.golang.org/protobuf v1.28.1
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+)
@@ -3,6 +3,7 @@ package utils
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
 
 	"github.com/646222472/zinx/ziface"
 )
@@ -20,8 +21,87 @@ type GlobalOjb struct {
 	Version          string //当前Zinx的版本号
 	MaxConn          int    //当前服务器主机允许的最大链接数
 	MaxPackageSize   uint32 //当前Zinx框架数据包的最大值
-	WorkerPoolSize   uint32 // 当前业务工作 Worker 池 Goroutine 的数量
+	WorkerPoolSize   uint32 // 当前业务工作 Worker 池 Goroutine 的数量（弹性伸缩时为最小数量）
 	MaxWorkerTaskLen uint32 // 框架允许用户最多开辟多少个 Worker（限定条件）
+
+	// Worker 工作池弹性伸缩及背压
+	MaxWorkerPoolSize  uint32 // Worker 数量的上限，不大于 WorkerPoolSize 时不进行伸缩
+	WorkerIdleTimeout  int    // 空闲 Worker 的回收时间（秒），0 表示不回收
+	TaskQueueHighWater uint32 // Worker 积压任务达到该值时暂停读取 socket，0 表示 MaxWorkerTaskLen 的 3/4
+	TaskQueueLowWater  uint32 // Worker 积压任务回落到该值时恢复读取 socket，0 表示 MaxWorkerTaskLen 的 1/4，必须小于 TaskQueueHighWater
+	RejectPolicy       string // 任务队列已满时的拒绝策略：block（阻塞等待）、drop（丢弃请求）、close（丢弃请求并关闭链接）
+
+	// 业务处理
+	HandlerTimeout int    // 业务处理的默认超时时间（毫秒），0 表示不限制，可以在 AddRouter 时针对 MsgID 单独设置
+	Serializer     string // 消息内容默认的序列化器：json、protobuf、msgpack
+
+	// 消息压缩
+	Compression       string // 发送消息时使用的压缩算法：gzip、snappy，为空时不压缩（接收时总是支持解压）
+	CompressThreshold uint32 // 消息内容达到该长度（字节）才进行压缩
+
+	// 消息加密
+	Encryption       string // 加密模式：为空时不加密，optional（客户端发起握手时加密），required（必须完成握手），不为空时集群、网关等内部链接同样先完成握手
+	Cipher           string // 握手后使用的对称加密算法：aes-gcm、chacha20-poly1305
+	HandshakeTimeout int    // 等待客户端握手的时间（秒），optional 模式下没有发送任何消息的明文客户端要等待这段时间之后才会收到服务端的消息
+
+	// 消息完整性校验
+	Checksum           bool   // 是否在包头之后附带 CRC32 校验字段，收发两端必须一致
+	ChecksumFailAction string // 消息内容校验失败时的处理：drop（丢弃该消息）、close（关闭链接），包头校验失败或者加密的链接总是关闭链接
+
+	// 大消息分片
+	MaxMessageSize  uint32 // 分片重组后消息的最大长度，超过 MaxPackageSize 的消息拆分为多个分片发送，0 表示不分片，开启时 MaxPackageSize 必须大于分片头和加密的开销
+	FragmentTimeout int    // 一个分片消息接收完毕的最长时间（秒）
+
+	// 消息限流
+	ConnRateLimit RateLimit            // 每个链接的消息速率限制
+	IPRateLimit   RateLimit            // 每个远程 IP 所有链接合计的消息速率限制
+	MsgRateLimits map[uint32]RateLimit // 每个链接上各个 MsgID 的消息速率限制
+	// 每个链接的心跳速率限制，心跳不计入上面的限制，超出时丢弃不回复，Action 不生效
+	HeartbeatRateLimit RateLimit
+
+	// 接入控制，在创建链接之前检查
+	AllowCIDRs          []string // 允许接入的网段或 IP，为空时允许所有
+	DenyCIDRs           []string // 拒绝接入的网段或 IP，优先于 AllowCIDRs
+	MaxConnPerIP        int      // 每个 IP 的最大链接数，包括等待队列中的链接，0 表示不限制
+	MaxNewConnPerSecond float64  // 每秒允许新建的链接数，0 表示不限制
+
+	// 链接数超出 MaxConn 时的处理
+	ServerFullReason string // 拒绝链接时通过 MsgIDServerFull 回复给客户端的原因
+	ConnQueueSize    int    // 等待队列的长度，超出 MaxConn 的链接在队列中等待空闲的位置，0 表示直接拒绝
+	ConnQueueTimeout int    // 在等待队列中等待的最长时间（秒），0 表示不限制
+
+	// 链接认证
+	AuthTimeout int // 开启认证时，链接需要在该时间（秒）内通过认证，否则被关闭
+
+	// 会话
+	SessionTimeout   int    // 链接断开后会话保留的时间（秒），在此期间新的链接可以恢复会话，0 表示不开启会话
+	SessionStoreFile string // 保存等待恢复的会话的日志文件，进程重启后仍然可以恢复会话，为空时只保存在内存中
+
+	// 集群
+	ClusterNodeID string            // 当前节点的 ID，为空时不开启集群
+	ClusterNodes  map[string]string // 集群中所有节点的 ID 和地址（host:port），可以包括当前节点
+	ClusterSecret string            // 节点之间链接时校验的密钥，开启集群时必须设置
+
+	// 服务发现
+	RegistryFile  string // 基于文件的服务发现使用的文件，设置后 Server 启动时注册、停止时注销
+	AdvertiseAddr string // 注册到服务发现中的地址 host:port，为空时使用 Host 和 TCPPort，Host 为 0.0.0.0 等监听所有地址时必须设置
+
+	// 网关
+	GatewaySecret   string // 网关与后端之间链接时校验的密钥，后端未设置时不接受网关的链接
+	GatewayPoolSize int    // 网关到每个后端的链接数
+
+	// 可靠消息
+	ReliableBufferSize int // 每个链接（或会话）最多保留的未确认可靠消息数
+
+	// 客户端
+	ClientHeartbeatInterval int // 客户端链接池发送心跳的间隔（秒），超过 3 倍间隔没有回复时重新链接
+}
+
+// RateLimit 令牌桶限流的参数
+type RateLimit struct {
+	Rate   float64 // 每秒补充的令牌数，即平均每秒允许的消息数，0 表示不限制
+	Burst  int     // 令牌桶的容量，即允许的突发消息数，0 表示与 Rate 相同
+	Action string  // 超出限制时的处理：drop（丢弃，默认）、delay（暂停读取直到有令牌）、error（丢弃并回复错误消息）、close（关闭链接）
 }
 
 // GlobalObject 定义一个全局的对外GlobalObj
@@ -29,6 +109,11 @@ var GlobalObject *GlobalOjb
 
 // Reload 从 zinx.json 中加载用户自定义的参数
 func (g *GlobalOjb) Reload() {
+	// 配置文件不存在时，直接使用默认值
+	if _, err := os.Stat("conf/zinx.json"); os.IsNotExist(err) {
+		return
+	}
+
 	data, err := ioutil.ReadFile("conf/zinx.json")
 	if err != nil {
 		panic(err)
@@ -53,6 +138,24 @@ func init() {
 		MaxPackageSize:   4096,
 		WorkerPoolSize:   10,   // 框架中 WorkerPool 中 Worker 的数量
 		MaxWorkerTaskLen: 1024, // 每个 Worker 对应的消息队列中 task 数量的最大值
+
+		MaxWorkerPoolSize: 10,      // 默认与 WorkerPoolSize 相同，即不伸缩
+		WorkerIdleTimeout: 60,      // 空闲 60 秒的 Worker 被回收
+		RejectPolicy:      "block", // 默认阻塞 Reader，由 TCP 流控向客户端施加背压
+		Serializer:        "json",
+		CompressThreshold: 1024,
+		Cipher:            "aes-gcm",
+		HandshakeTimeout:  5,
+
+		ChecksumFailAction: "close",
+		FragmentTimeout:    30,
+		ServerFullReason:   "server is full",
+		AuthTimeout:        10,
+		ReliableBufferSize: 256,
+		GatewayPoolSize:    4,
+
+		HeartbeatRateLimit:      RateLimit{Rate: 1, Burst: 5},
+		ClientHeartbeatInterval: 5,
 	}
 
 	// 应该尝试从 conf/zinx.json 中加载一些用户自定义的参数
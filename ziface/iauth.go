@@ -0,0 +1,14 @@
+package ziface
+
+// Identity 链接认证通过后的身份，所有路由都可以通过 IConnection.GetIdentity 获取
+type Identity struct {
+	// 用户的唯一标识
+	UserID string
+	// 用户拥有的角色
+	Roles []string
+	// 业务自定义的其它信息
+	Extra map[string]interface{}
+}
+
+// Authenticator 认证回调，token 为客户端认证消息的内容，返回 error 表示认证失败
+type Authenticator func(conn IConnection, token []byte) (*Identity, error)
@@ -0,0 +1,48 @@
+package ziface
+
+import "time"
+
+// ClientHandler 客户端处理服务端消息的方法，在客户端的 Reader 中按顺序调用
+type ClientHandler func(client IClient, msg IMessage)
+
+// IClient 定义客户端的抽象层，用于服务之间的内部链接
+type IClient interface {
+	// 链接服务端并开始读取消息
+	Start() error
+
+	// 关闭链接，中止重新链接，可以在处理方法和回调中调用
+	Stop()
+
+	// 发送消息给服务端
+	SendMsg(msgID uint32, data []byte) error
+
+	// 注册处理某个 MsgID 的方法，没有注册的消息被丢弃
+	AddHandler(msgID uint32, handler ClientHandler)
+
+	// 注册链接建立之后的回调，重新链接成功时同样调用
+	SetOnConnect(func(client IClient))
+
+	// 注册链接断开之后的回调，err 为断开的原因，调用 Stop 时为 nil
+	SetOnDisconnect(func(client IClient, err error))
+
+	// 开启断开后的自动重新链接，maxAttempts 为 0 时关闭，小于 0 时不限次数，等待时间按指数退避并加入随机抖动
+	SetReconnect(maxAttempts int, baseDelay, maxDelay time.Duration)
+
+	// 设置重新链接期间最多缓存的消息数，链接成功后按顺序发送
+	SetSendBuffer(size int)
+
+	// 注册每次重新链接之前的回调，delay 为这次等待的时间
+	SetOnReconnecting(func(client IClient, attempt int, delay time.Duration))
+
+	// 注册重新链接成功之后的回调
+	SetOnReconnected(func(client IClient, attempts int))
+
+	// 注册达到最大次数仍未重新链接成功时的回调
+	SetOnGiveUp(func(client IClient, err error))
+
+	// 获取服务端的地址
+	GetAddr() string
+
+	// 是否已经链接
+	IsConnected() bool
+}
@@ -0,0 +1,22 @@
+package ziface
+
+// IClientPool 定义客户端链接池的抽象层，链接多个服务端并进行负载均衡
+type IClientPool interface {
+	// 链接所有服务端并开始健康检查，部分服务端链接失败时在健康检查中重新链接
+	Start() error
+
+	// 关闭所有链接
+	Stop()
+
+	// 替换服务端的地址，新的地址被链接，不再存在的地址的链接被关闭
+	SetAddrs(addrs []string)
+
+	// 选择一个健康的客户端，key 用于一致性哈希，使用完毕后调用 done
+	Pick(key string) (client IClient, done func(), err error)
+
+	// 选择一个健康的客户端发送消息
+	SendMsg(key string, msgID uint32, data []byte) error
+
+	// 获取所有健康的客户端
+	Healthy() []IClient
+}
@@ -0,0 +1,16 @@
+package ziface
+
+// ICompressor 消息内容的压缩算法抽象层
+type ICompressor interface {
+	// 压缩算法的编号，写在压缩后数据的第一个字节，接收端据此选择解压算法
+	ID() uint8
+
+	// 压缩算法的名称，如 gzip
+	Name() string
+
+	// 压缩数据
+	Compress(data []byte) ([]byte, error)
+
+	// 解压数据，解压后的长度超过 maxSize 时返回 error，用于防止解压炸弹
+	Decompress(data []byte, maxSize uint32) ([]byte, error)
+}
@@ -1,6 +1,9 @@
 package ziface
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 // IConnection 定义链接模块的抽象层
 type IConnection interface {
@@ -16,12 +19,30 @@ type IConnection interface {
 	// 获取当前链接模块的链接ID
 	GetConnID() uint32
 
+	// 获取当前链接隶属的 Server
+	GetTCPServer() IServer
+
 	// 获取远程客户端的 TCP状态 IP Port
 	RemoteAddr() net.Addr
 
+	// 获取链接的 Context，链接关闭时被取消
+	Context() context.Context
+
 	// 发送数据，将我们给客户端的消息先进行封包，再进行发送
 	SendMsg(uint32, []byte) error
 
+	// 发送对象，使用该 MsgID 对应的序列化器将对象编码后再发送
+	SendObj(uint32, interface{}) error
+
+	// 发送需要客户端确认的消息，返回消息的序列号，确认或投递失败时调用 callback
+	SendMsgReliable(msgID uint32, data []byte, callback DeliveryCallback) (uint64, error)
+
+	// 获取链接认证通过后的身份，未开启认证或未通过认证时为 nil
+	GetIdentity() *Identity
+
+	// 获取链接的会话，未开启会话时为 nil
+	GetSession() ISession
+
 	// 设置链接属性
 	SetProPerty(string, interface{})
 
@@ -30,8 +51,27 @@ type IConnection interface {
 
 	// 移除链接属性
 	RemoveProPerty(string)
+
+	// 属性存在时返回已有的值，否则设置为新的值，loaded 表示属性是否已经存在
+	GetOrSetProPerty(key string, value interface{}) (actual interface{}, loaded bool)
+
+	// 属性的当前值等于 old 时替换为新的值
+	CompareAndSwapProPerty(key string, old, value interface{}) bool
+
+	// 获取所有链接属性的快照
+	Properties() map[string]interface{}
+
+	// 注册属性变化的观察者，在修改属性的 Goroutine 中、释放属性锁之后调用
+	// 多个 Goroutine 同时修改同一个属性时，观察者被调用的顺序不保证与修改的顺序一致，需要最新的值时在观察者中调用 GetProPerty
+	ObserveProPerty(key string, observer PropertyObserver)
 }
 
+// DeliveryCallback 可靠消息的投递结果，err 为 nil 表示客户端已经确认
+type DeliveryCallback func(seq uint64, err error)
+
+// PropertyObserver 链接属性变化的观察者，属性被移除时 newValue 为 nil
+type PropertyObserver func(conn IConnection, key string, oldValue, newValue interface{})
+
 // HandleFunc 定义一个处理链接业务的抽象方法
 // *net.TCPConn 客户端链接， []byte发送给客户端的数据，int发送的数据长度
 type HandleFunc func(*net.TCPConn, []byte, int) error
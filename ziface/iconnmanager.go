@@ -14,6 +14,15 @@ type IConnManager interface {
 	// 获取链接总数
 	Len() int
 
+	// 获取来自某个远程 IP 的链接数
+	LenByIP(ip string) int
+
+	// 将链接绑定到用户 ID，链接移除时自动解绑
+	BindUser(userID string, conn IConnection)
+
+	// 获取用户 ID 绑定的所有链接
+	GetByUser(userID string) []IConnection
+
 	// 清除所有的链接
 	ClearConn()
 }
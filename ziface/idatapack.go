@@ -11,4 +11,7 @@ type IDataPack interface {
 
 	// 拆包方法
 	UnPack([]byte) (IMessage, error)
+
+	// 读取消息内容之后进行完整性校验
+	Verify(IMessage) error
 }
@@ -8,6 +8,10 @@ type IMessage interface {
 	GetDataLen() uint32
 	// 获取消息的内容
 	GetData() []byte
+	// 获取消息的标志位，如是否压缩
+	GetFlags() uint8
+	// 获取包头中消息内容的校验值
+	GetChecksum() uint32
 
 	// 设置消息的 ID
 	SetMsgID(uint32)
@@ -15,4 +19,8 @@ type IMessage interface {
 	SetDataLen(uint32)
 	// 设置消息的内容
 	SetData([]byte)
+	// 设置消息的标志位
+	SetFlags(uint8)
+	// 设置消息内容的校验值
+	SetChecksum(uint32)
 }
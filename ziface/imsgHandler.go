@@ -1,16 +1,42 @@
 package ziface
 
+import "time"
+
 // IMsgHandler 消息管理抽象层
 type IMsgHandler interface {
 	// 调度/执行对应的 Router 消息处理方法
 	DoMsgHandler(IRequest)
 
-	// 为消息添加具体的处理逻辑
-	AddRouter(uint32, IRouter)
+	// 为消息添加具体的处理逻辑，可以通过 RouteOption 指定该消息的优先级等配置
+	AddRouter(uint32, IRouter, ...RouteOption)
+
+	// 为分片消息添加流式处理的逻辑
+	AddStreamRouter(uint32, IStreamRouter, ...RouteOption)
+
+	// 判断 MsgID 是否注册为流式处理
+	IsStream(uint32) bool
+
+	// 创建（或获取同名的）路由分组
+	Group(name string, start, end uint32, middlewares ...Middleware) IRouterGroup
+
+	// 获取所有已注册的路由，按 MsgID 排序
+	Routes() []RouteInfo
+
+	// 校验路由配置，如分组的 MsgID 范围是否重叠，以及积压任务的暂停、恢复值
+	Validate() error
 
 	// 启动 Worker 工作池
 	StartWorkerPool()
 
-	// 发送消息到任务队列 TaskQueue 中，由 Worker 进行处理
-	SendMsgToTaskQueue(IRequest)
+	// 发送消息到任务队列 TaskQueue 中，由 Worker 进行处理，队列已满且请求被拒绝时返回 error
+	SendMsgToTaskQueue(IRequest) error
+
+	// 背压控制：链接所在 Worker 积压的任务超过高水位时阻塞，直到回落到低水位
+	Throttle(IConnection)
+
+	// 注册请求被拒绝（丢弃）时的回调
+	SetOnReject(func(request IRequest, reason error))
+
+	// 注册业务处理超出超时时间时的回调
+	SetOnHandlerTimeout(func(request IRequest, timeout time.Duration))
 }
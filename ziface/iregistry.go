@@ -0,0 +1,26 @@
+package ziface
+
+// ServiceInstance 注册到服务发现中的一个服务实例
+type ServiceInstance struct {
+	// 服务的名称，同名的实例提供相同的服务
+	Name string
+	// 实例的地址 host:port
+	Addr string
+	// 实例的元数据，如版本、权重、所在的区域
+	Metadata map[string]string
+}
+
+// IRegistry 服务发现的抽象层，etcd、consul 等可以通过实现该接口接入，测试中可以替换为本地的实现
+type IRegistry interface {
+	// 注册服务实例，同名同地址的实例被覆盖
+	Register(instance ServiceInstance) error
+
+	// 注销服务实例
+	Deregister(instance ServiceInstance) error
+
+	// 获取服务的所有实例
+	Lookup(name string) ([]ServiceInstance, error)
+
+	// 监听服务实例的变化，开始监听时和每次变化后以全部实例调用 callback，返回取消监听的方法
+	Watch(name string, callback func(instances []ServiceInstance)) (cancel func(), err error)
+}
@@ -1,5 +1,7 @@
 package ziface
 
+import "context"
+
 // IRequest 接口：实际上是把客户端请求的链接信息，和请求的数据包装到一个Request中
 type IRequest interface {
 	// 得到当前链接
@@ -10,4 +12,14 @@ type IRequest interface {
 
 	// GetMsgID 得到请求的消息 ID
 	GetMsgID() uint32
+
+	// Bind 使用该 MsgID 对应的序列化器将请求的消息数据解码到 v 中
+	Bind(v interface{}) error
+
+	// Context 得到请求的 Context，派生自链接的 Context，带有该 MsgID 的处理超时时间
+	Context() context.Context
+
+	// Release 将消息数据所在的缓冲交还给缓冲池，之后不可再使用 GetData 得到的数据
+	// 不调用时缓冲由 GC 回收，业务处理完消息数据后主动调用可以减少内存分配
+	Release()
 }
@@ -1,5 +1,7 @@
 package ziface
 
+import "time"
+
 // IRouter 路由的抽象接口，路由中的数据都是IRequest
 type IRouter interface {
 	// 在处理conn业务之前的钩子方法Hook
@@ -9,3 +11,36 @@ type IRouter interface {
 	// 在处理conn业务之后的钩子方法Hook
 	PostHandle(request IRequest)
 }
+
+// HandlerFunc 函数形式的业务处理方法，无需实现整个 IRouter
+type HandlerFunc func(request IRequest)
+
+// Middleware 中间件，包装业务处理方法，在其前后执行公共逻辑，不调用 next 即可中断处理
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// RouteConfig 注册路由时针对该 MsgID 的配置
+type RouteConfig struct {
+	// 消息的优先级，Worker 优先处理优先级高的消息
+	Priority uint8
+	// 处理该消息的超时时间，0 表示不限制
+	Timeout time.Duration
+	// 该消息所属的路由分组，不属于任何分组时为 nil
+	Group IRouterGroup
+	// 该消息单独使用的中间件，在分组的中间件之后执行
+	Middlewares []Middleware
+	// 处理该消息要求链接的身份拥有其中任意一个角色，为空时不限制
+	Roles []string
+}
+
+// RouteInfo 已注册路由的描述信息，用于调试
+type RouteInfo struct {
+	MsgID    uint32
+	Group    string
+	Router   string
+	Priority uint8
+	Timeout  time.Duration
+	Roles    []string
+}
+
+// RouteOption 注册路由时的可选配置项
+type RouteOption func(*RouteConfig)
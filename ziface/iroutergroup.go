@@ -0,0 +1,32 @@
+package ziface
+
+// IRouterGroup 路由分组的抽象层
+// 一个分组占用一段连续的 MsgID，分组内的路由共享分组的中间件
+type IRouterGroup interface {
+	// 获取分组的名称
+	Name() string
+
+	// 获取分组占用的 MsgID 范围 [start, end]
+	Range() (start, end uint32)
+
+	// 为分组添加中间件
+	Use(...Middleware)
+
+	// 获取分组的中间件
+	Middlewares() []Middleware
+
+	// 要求链接的身份拥有其中任意一个角色才能处理分组内的消息
+	RequireRoles(...string)
+
+	// 获取分组要求的角色
+	Roles() []string
+
+	// 在分组内添加路由，MsgID 必须在分组的范围内
+	AddRouter(uint32, IRouter, ...RouteOption)
+
+	// 在分组内以函数的形式添加路由
+	AddHandlerFunc(uint32, HandlerFunc, ...RouteOption)
+
+	// 在分组内添加流式处理分片消息的路由
+	AddStreamRouter(uint32, IStreamRouter, ...RouteOption)
+}
@@ -0,0 +1,13 @@
+package ziface
+
+// ISerializer 消息内容的序列化抽象层，负责业务结构体与 Message Data 之间的转换
+type ISerializer interface {
+	// 序列化器的名称，如 json
+	Name() string
+
+	// 将业务结构体编码为消息内容
+	Marshal(v interface{}) ([]byte, error)
+
+	// 将消息内容解码到业务结构体中
+	Unmarshal(data []byte, v interface{}) error
+}
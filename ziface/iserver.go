@@ -1,5 +1,10 @@
 package ziface
 
+import (
+	"net"
+	"time"
+)
+
 // IServer 定义一个服务器接口
 type IServer interface {
 	// 启动服务器
@@ -12,7 +17,34 @@ type IServer interface {
 	Serve()
 
 	// 路由功能：给当前的服务注册一个路由方法，供客户端的链接处理使用
-	AddRouter(uint32, IRouter)
+	AddRouter(uint32, IRouter, ...RouteOption)
+
+	// 路由功能：以函数的形式注册处理方法
+	AddHandlerFunc(uint32, HandlerFunc, ...RouteOption)
+
+	// 路由功能：注册流式处理分片消息的路由，大消息的分片逐个交给业务处理，需要开启 Worker 工作池
+	AddStreamRouter(uint32, IStreamRouter, ...RouteOption)
+
+	// 路由功能：将 [start, end] 范围内的消息转发给后端 zinx 服务，后端的回复发送给原来的链接
+	AddForward(start, end uint32, backends []string, opts ...RouteOption)
+
+	// 路由功能：创建（或获取同名的）路由分组，分组可以在不同的模块中分别注册
+	Group(name string, start, end uint32, middlewares ...Middleware) IRouterGroup
+
+	// 获取所有已注册的路由，用于调试
+	Routes() []RouteInfo
+
+	// 设置消息内容默认的序列化器，类型化的处理方法、Bind、SendObj 使用它进行编解码
+	SetSerializer(ISerializer)
+
+	// 获取消息内容默认的序列化器
+	GetSerializer() ISerializer
+
+	// 为某个 MsgID 单独设置序列化器，收发该 MsgID 的消息时都会使用
+	SetMsgSerializer(uint32, ISerializer)
+
+	// 获取某个 MsgID 使用的序列化器，没有单独设置时返回默认的序列化器
+	GetMsgSerializer(uint32) ISerializer
 
 	// 获取当前 Server 的链接管理器
 	GetConnMgr() IConnManager
@@ -28,4 +60,40 @@ type IServer interface {
 
 	// 调用 OnConnStop 钩子函数的方法
 	CallOnConnStop(connection IConnection)
+
+	// 替换接入的黑白名单（网段或 IP），可以在运行时调用
+	SetAccessList(allow, deny []string) error
+
+	// 注册新的链接通过内置的接入控制之后调用的回调，返回 false 时拒绝该链接
+	SetOnAccept(func(conn *net.TCPConn) bool)
+
+	// 开启链接认证，客户端需要在超时时间内发送认证消息，认证通过之前只处理白名单中的 MsgID
+	SetAuthenticator(authenticator Authenticator, whitelist ...uint32)
+
+	// 注册会话被新的链接恢复之后的回调，此时链接已经得到会话中的属性、身份和分组
+	SetOnSessionResume(func(conn IConnection, session ISession))
+
+	// 调用 OnSessionResume 钩子函数的方法
+	CallOnSessionResume(conn IConnection, session ISession)
+
+	// 向用户（链接认证后的 UserID）的所有链接发送消息，开启集群时转发到用户所在的节点
+	SendMsgToUser(userID string, msgID uint32, data []byte) error
+
+	// 设置服务发现，启动时注册、停止时注销
+	SetRegistry(registry IRegistry, metadata map[string]string)
+
+	// 替换保存等待恢复的会话的存储，需要在启动之前调用
+	SetSessionStore(store ISessionStore)
+
+	// 注册消息超出速率限制时的回调，scope 为超出的限制：ip、conn、msg、heartbeat，可以在回调中关闭链接或封禁 IP
+	SetOnRateLimit(func(conn IConnection, msgID uint32, scope string))
+
+	// 调用 OnRateLimit 钩子函数的方法
+	CallOnRateLimit(conn IConnection, msgID uint32, scope string)
+
+	// 注册工作池任务队列已满、请求被拒绝时的回调
+	SetOnReject(func(request IRequest, reason error))
+
+	// 注册业务处理超出超时时间时的回调
+	SetOnHandlerTimeout(func(request IRequest, timeout time.Duration))
 }
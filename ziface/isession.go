@@ -0,0 +1,23 @@
+package ziface
+
+// ISession 可恢复的会话，链接断开后在保留时间内可以被新的链接恢复
+// 恢复时新的链接得到原来的链接属性、身份和分组
+type ISession interface {
+	// 获取会话的 ID，即客户端恢复会话时使用的 Token
+	GetID() string
+
+	// 获取会话当前绑定的链接，链接断开、会话等待恢复时为 nil
+	GetConnection() IConnection
+
+	// 加入分组，如房间、频道
+	JoinGroup(name string)
+
+	// 离开分组
+	LeaveGroup(name string)
+
+	// 是否在分组中
+	InGroup(name string) bool
+
+	// 获取加入的所有分组
+	Groups() []string
+}
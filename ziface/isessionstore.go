@@ -0,0 +1,43 @@
+package ziface
+
+import "time"
+
+// SessionData 会话需要持久化的状态
+type SessionData struct {
+	// 会话的 ID
+	ID string
+	// 链接属性，文件存储使用 gob 编码，自定义类型的属性值需要先 gob.Register
+	Properties map[string]interface{}
+	// 认证通过后的身份
+	Identity *Identity
+	// 加入的分组
+	Groups []string
+	// 下一个可靠消息的序列号
+	NextSeq uint64
+	// 未确认的可靠消息，恢复后重新发送，投递结果的回调不会被保存
+	Pending []PendingMsg
+	// 会话的过期时间
+	ExpireAt time.Time
+}
+
+// PendingMsg 未确认的可靠消息
+type PendingMsg struct {
+	Seq   uint64
+	MsgID uint32
+	Data  []byte
+}
+
+// ISessionStore 会话存储的抽象层，保存等待恢复的会话，使进程重启后会话仍然可以恢复
+type ISessionStore interface {
+	// 保存会话，覆盖同一个 ID 的会话
+	Save(data *SessionData) error
+
+	// 读取会话，不存在或已经过期时返回 error
+	Load(id string) (*SessionData, error)
+
+	// 删除会话
+	Delete(id string) error
+
+	// 关闭存储，Server 停止时调用，之后不再有任何操作
+	Close() error
+}
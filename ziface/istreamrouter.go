@@ -0,0 +1,12 @@
+package ziface
+
+// IStreamRouter 流式处理分片消息的路由
+// 大消息的分片按顺序逐个交给 HandleChunk，不会在内存中重组整个消息
+// 分片需要在同一个 Worker 中按顺序处理，注册了流式处理的路由时 WorkerPoolSize 不能为 0
+type IStreamRouter interface {
+	// 处理一个分片，request.GetData() 为分片的内容，offset 为分片在整个消息中的偏移，total 为整个消息的长度
+	HandleChunk(request IRequest, offset, total uint32)
+
+	// 消息接收结束，err 为 nil 表示所有分片都已收到，否则表示消息被中止（超时、链接断开、分片被任务队列拒绝）
+	HandleEnd(request IRequest, err error)
+}
@@ -0,0 +1,121 @@
+package znet
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+// 新的链接被拒绝接入的原因
+var (
+	ErrIPDenied         = errors.New("remote ip denied")
+	ErrTooManyConnPerIP = errors.New("too many connections from remote ip")
+	ErrConnRateLimited  = errors.New("new connection rate limited")
+	ErrAcceptRejected   = errors.New("rejected by OnAccept hook")
+)
+
+// acceptFilter 接入控制模块，在 Accept 之后、创建链接之前检查
+type acceptFilter struct {
+	// 保护黑白名单的读写锁，名单可以在运行时替换
+	lock  sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	// 新建链接的令牌桶，未限制时为 nil
+	rate *tokenBucket
+}
+
+// newAcceptFilter 按照配置创建接入控制模块
+func newAcceptFilter() (*acceptFilter, error) {
+	f := &acceptFilter{
+		rate: newTokenBucket(utils.RateLimit{Rate: utils.GlobalObject.MaxNewConnPerSecond}),
+	}
+	if err := f.setLists(utils.GlobalObject.AllowCIDRs, utils.GlobalObject.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseCIDRs 解析网段列表，单个 IP 视为只包含该 IP 的网段
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: cidr}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// setLists 替换黑白名单，任何一个网段不合法时保持原有的名单
+func (f *acceptFilter) setLists(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.allow, f.deny = allowNets, denyNets
+
+	return nil
+}
+
+// allowed 黑名单优先，白名单为空时允许所有不在黑名单中的 IP
+func (f *acceptFilter) allowed(ip net.IP) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check 依次检查黑白名单、单个 IP 的链接数、新建链接的速率
+func (f *acceptFilter) check(ip net.IP, ipConns int) error {
+	if !f.allowed(ip) {
+		return ErrIPDenied
+	}
+	if utils.GlobalObject.MaxConnPerIP > 0 && ipConns >= utils.GlobalObject.MaxConnPerIP {
+		return ErrTooManyConnPerIP
+	}
+	if f.rate != nil {
+		if _, ok := f.rate.take(time.Now()); !ok {
+			return ErrConnRateLimited
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package znet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+func TestAcceptFilter(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.AllowCIDRs = []string{"10.0.0.0/8", "192.168.1.1"}
+	utils.GlobalObject.DenyCIDRs = []string{"10.1.0.0/16"}
+	utils.GlobalObject.MaxConnPerIP = 2
+	utils.GlobalObject.MaxNewConnPerSecond = 0
+
+	f, err := newAcceptFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]error{
+		"10.0.0.1":    nil,
+		"10.1.2.3":    ErrIPDenied, // 黑名单优先
+		"192.168.1.1": nil,
+		"192.168.1.2": ErrIPDenied, // 不在白名单中
+	} {
+		if err := f.check(net.ParseIP(ip), 0); err != want {
+			t.Fatalf("check %s = %v, want %v", ip, err, want)
+		}
+	}
+	if err := f.check(net.ParseIP("10.0.0.1"), 2); err != ErrTooManyConnPerIP {
+		t.Fatalf("err = %v, want ErrTooManyConnPerIP", err)
+	}
+
+	// 替换名单，不合法的网段不影响原有的名单
+	if err := f.setLists(nil, []string{"bad"}); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+	if err := f.check(net.ParseIP("192.168.1.2"), 0); err != ErrIPDenied {
+		t.Fatalf("err = %v, want ErrIPDenied", err)
+	}
+	if err := f.setLists(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.check(net.ParseIP("192.168.1.2"), 0); err != nil {
+		t.Fatalf("err = %v after reload", err)
+	}
+
+	// 新建链接的速率限制
+	utils.GlobalObject.MaxNewConnPerSecond = 0.001
+	if f, err = newAcceptFilter(); err != nil {
+		t.Fatal(err)
+	}
+	f.check(net.ParseIP("10.0.0.1"), 0)
+	if err := f.check(net.ParseIP("10.0.0.2"), 0); err != ErrConnRateLimited {
+		t.Fatalf("err = %v, want ErrConnRateLimited", err)
+	}
+}
+
+func TestMaxConnPerIPCountsQueue(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.MaxConn = 1
+	utils.GlobalObject.ConnQueueSize = 5
+	utils.GlobalObject.MaxConnPerIP = 2
+
+	s := NewServer("perip").(*Server)
+	s.Start()
+	defer s.Stop()
+
+	// 第一个链接接入，第二个链接进入等待队列
+	first := dialTest(t, s.Port)
+	for deadline := time.Now().Add(3 * time.Second); s.ConnMgr.Len() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("first connection not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := dialTest(t, s.Port)
+	if msg := readTestMsg(t, second); msg.ID != MsgIDQueuePosition {
+		t.Fatalf("msg id=%x, want MsgIDQueuePosition", msg.ID)
+	}
+
+	// 同一个 IP 的第三个链接超出限制，不进入等待队列而是直接关闭
+	third := dialTest(t, s.Port)
+	defer third.Close()
+	third.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := third.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("third connection got %d bytes, want closed", n)
+	}
+	if n := s.queue.lenByIP("127.0.0.1"); n != 1 {
+		t.Fatalf("queued = %d, want 1", n)
+	}
+
+	// 关闭所有链接，等待服务端的链接退出后再恢复配置
+	first.Close()
+	if msg := readTestMsg(t, second); msg.ID != MsgIDQueuePosition {
+		t.Fatalf("msg id=%x, want MsgIDQueuePosition", msg.ID)
+	}
+	second.Close()
+	for deadline := time.Now().Add(3 * time.Second); s.ConnMgr.Len() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connections not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	for addr, want := range map[net.Addr]string{
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8999}: "10.0.0.1",
+		&net.UDPAddr{IP: net.ParseIP("::1"), Port: 8999}:      "::1",
+		&net.UnixAddr{Name: "/tmp/zinx.sock", Net: "unix"}:    "/tmp/zinx.sock",
+	} {
+		if ip := remoteIP(addr); ip != want {
+			t.Fatalf("remoteIP(%v) = %q, want %q", addr, ip, want)
+		}
+	}
+	if ip := remoteIP(nil); ip != "" {
+		t.Fatalf("remoteIP(nil) = %q", ip)
+	}
+}
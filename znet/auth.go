@@ -0,0 +1,100 @@
+package znet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 认证结果，服务端回复 MsgIDAuth 时的第一个字节
+const (
+	AuthOK     uint8 = 0 // 认证通过
+	AuthFailed uint8 = 1 // 认证失败，之后是失败的原因，服务端随后关闭链接
+)
+
+// authConfig 链接认证的配置，由 Server 的 SetAuthenticator 设置
+type authConfig struct {
+	authenticator ziface.Authenticator
+	// 认证通过之前也可以处理的 MsgID
+	whitelist map[uint32]bool
+}
+
+// authProvider 提供认证配置的 Server
+type authProvider interface {
+	authConfig() *authConfig
+}
+
+// startAuth 开启认证时，超时未通过认证的链接被关闭
+func (c *Connection) startAuth() {
+	provider, ok := c.TCPServer.(authProvider)
+	if !ok || provider.authConfig() == nil {
+		return
+	}
+	c.auth = provider.authConfig()
+	c.authTimer = time.AfterFunc(time.Duration(utils.GlobalObject.AuthTimeout)*time.Second, func() {
+		if c.GetIdentity() == nil {
+			fmt.Println("ConnID=", c.ConnID, " auth timeout")
+			// 关闭 socket 使 Reader 退出，由 Reader 停止链接
+			c.Conn.Close()
+		}
+	})
+}
+
+// authenticate 认证通过之前只处理认证消息和白名单中的 MsgID
+// pass 为 false 时丢弃该消息，closeConn 为 true 时需要关闭链接
+func (c *Connection) authenticate(msg ziface.IMessage) (pass, closeConn bool) {
+	if c.auth == nil {
+		return true, false
+	}
+	if c.GetIdentity() != nil {
+		// 已经通过认证，重复的认证消息直接丢弃
+		return msg.GetMsgID() != MsgIDAuth, false
+	}
+
+	if msg.GetMsgID() != MsgIDAuth {
+		if c.auth.whitelist[msg.GetMsgID()] {
+			return true, false
+		}
+		fmt.Println("ConnID=", c.ConnID, " not authenticated, drop msgID=", msg.GetMsgID())
+		return false, false
+	}
+
+	identity, err := c.auth.authenticator(c, msg.GetData())
+	if err == nil && identity == nil {
+		err = fmt.Errorf("%s", "empty identity")
+	}
+	if err != nil {
+		fmt.Println("ConnID=", c.ConnID, " auth failed ", err)
+		c.SendMsg(MsgIDAuth, append([]byte{AuthFailed}, err.Error()...))
+		return false, true
+	}
+
+	c.authTimer.Stop()
+	c.setIdentity(identity)
+	if err := c.SendMsg(MsgIDAuth, []byte{AuthOK}); err != nil {
+		return false, true
+	}
+	return false, false
+}
+
+// GetIdentity 获取链接认证通过后的身份，未通过认证时为 nil
+func (c *Connection) GetIdentity() *ziface.Identity {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	return c.identity
+}
+
+// setIdentity 设置链接的身份
+func (c *Connection) setIdentity(identity *ziface.Identity) {
+	c.propertyLock.Lock()
+	c.identity = identity
+	c.propertyLock.Unlock()
+
+	// 按用户 ID 索引链接，用于向用户发送消息
+	if identity != nil && identity.UserID != "" && c.TCPServer != nil {
+		c.TCPServer.GetConnMgr().BindUser(identity.UserID, c)
+	}
+}
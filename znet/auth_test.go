@@ -0,0 +1,109 @@
+package znet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestAuthenticator(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+
+	s := NewServer("auth").(*Server)
+	s.SetAuthenticator(func(conn ziface.IConnection, token []byte) (*ziface.Identity, error) {
+		if string(token) != "secret" {
+			return nil, fmt.Errorf("%s", "invalid token")
+		}
+		return &ziface.Identity{UserID: "u1"}, nil
+	}, 1)
+	echoUser := func(request ziface.IRequest) {
+		userID := ""
+		if identity := request.GetConnection().GetIdentity(); identity != nil {
+			userID = identity.UserID
+		}
+		request.GetConnection().SendMsg(request.GetMsgID(), []byte(userID))
+	}
+	s.AddHandlerFunc(1, echoUser)
+	s.AddHandlerFunc(2, echoUser)
+	s.Start()
+
+	conn := dialTest(t, s.Port)
+	defer conn.Close()
+
+	// 认证之前 MsgID 2 被丢弃，白名单中的 MsgID 1 正常处理
+	sendTestMsg(conn, 2, nil)
+	sendTestMsg(conn, 1, nil)
+	if msg := readTestMsg(t, conn); msg.ID != 1 || len(msg.Data) != 0 {
+		t.Fatalf("msg id=%d data=%s, want whitelisted msg 1", msg.ID, msg.Data)
+	}
+
+	// 认证通过后身份对所有路由可见
+	sendTestMsg(conn, MsgIDAuth, []byte("secret"))
+	if msg := readTestMsg(t, conn); msg.ID != MsgIDAuth || msg.Data[0] != AuthOK {
+		t.Fatalf("auth reply id=%x data=%v", msg.ID, msg.Data)
+	}
+	sendTestMsg(conn, 2, nil)
+	if msg := readTestMsg(t, conn); msg.ID != 2 || string(msg.Data) != "u1" {
+		t.Fatalf("msg id=%d data=%s, want identity u1", msg.ID, msg.Data)
+	}
+
+	// 认证失败时回复原因并关闭链接
+	bad := dialTest(t, s.Port)
+	defer bad.Close()
+	sendTestMsg(bad, MsgIDAuth, []byte("wrong"))
+	if msg := readTestMsg(t, bad); msg.ID != MsgIDAuth || msg.Data[0] != AuthFailed || string(msg.Data[1:]) != "invalid token" {
+		t.Fatalf("auth reply id=%x data=%v", msg.ID, msg.Data)
+	}
+
+	// 关闭所有链接，等待服务端的链接退出后再恢复配置
+	conn.Close()
+	for deadline := time.Now().Add(3 * time.Second); s.ConnMgr.Len() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connections not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoleAuthorization(t *testing.T) {
+	mh := NewMsgHandler()
+	var handled []uint32
+	record := func(request ziface.IRequest) {
+		handled = append(handled, request.GetMsgID())
+	}
+	admin := mh.Group("admin", 1000, 1999)
+	admin.RequireRoles("admin")
+	admin.AddHandlerFunc(1001, record)
+	admin.AddHandlerFunc(1002, record, WithRoles("super"))
+	mh.AddRouter(1, FuncRouter(record), WithRoles("player", "admin"))
+
+	conn := &Connection{ConnID: 1, msgChan: make(chan *[]byte, 4), dp: NewDataPack()}
+	conn.setIdentity(&ziface.Identity{UserID: "u1", Roles: []string{"admin"}})
+	for _, msgID := range []uint32{1, 1001, 1002} {
+		mh.DoMsgHandler(&Request{conn: conn, msg: NewMessage(msgID, nil)})
+	}
+
+	// 1002 同时要求分组的 admin 和消息的 super
+	if len(handled) != 2 || handled[0] != 1 || handled[1] != 1001 {
+		t.Fatalf("handled = %v, want [1 1001]", handled)
+	}
+	bp := <-conn.msgChan
+	msg, _ := conn.dp.UnPack(*bp)
+	if msg.GetMsgID() != MsgIDForbidden || binary.LittleEndian.Uint32((*bp)[conn.dp.GetHeadLen():]) != 1002 {
+		t.Fatalf("reply msgID=%x, want MsgIDForbidden for 1002", msg.GetMsgID())
+	}
+
+	// 没有身份的链接不能处理要求角色的消息
+	anonymous := &Connection{ConnID: 2, msgChan: make(chan *[]byte, 4), dp: NewDataPack()}
+	mh.DoMsgHandler(&Request{conn: anonymous, msg: NewMessage(1, nil)})
+	if len(handled) != 2 || len(anonymous.msgChan) != 1 {
+		t.Fatalf("anonymous request handled = %v", handled)
+	}
+}
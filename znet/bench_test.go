@@ -0,0 +1,98 @@
+package znet
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 基准测试使用的消息内容
+var benchData = make([]byte, 256)
+
+func BenchmarkPack(b *testing.B) {
+	dp := NewDataPack()
+	msg := NewMessage(1, benchData)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		if _, err := dp.Pack(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPackPooled(b *testing.B) {
+	dp := NewDataPack()
+	msg := NewMessage(1, benchData)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		bp := getBuffer(int(dp.GetHeadLen()) + len(benchData))
+		if err := dp.packTo(*bp, msg); err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(bp)
+	}
+}
+
+func BenchmarkUnPack(b *testing.B) {
+	dp := NewDataPack()
+	binaryData, _ := dp.Pack(NewMessage(1, benchData))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := dp.UnPack(binaryData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 回显服务只启动一次，基准函数会被多次调用
+var (
+	echoOnce sync.Once
+	echoPort int
+)
+
+func startEchoServer(b *testing.B) {
+	echoOnce.Do(func() {
+		old := *utils.GlobalObject
+		defer func() { *utils.GlobalObject = old }()
+		utils.GlobalObject.Host = "127.0.0.1"
+		utils.GlobalObject.TCPPort = freePort(b)
+
+		s := NewServer("echo").(*Server)
+		s.AddHandlerFunc(1, func(request ziface.IRequest) {
+			request.GetConnection().SendMsg(request.GetMsgID(), request.GetData())
+			// SendMsg 已经复制了数据，回收读取时的缓冲
+			request.Release()
+		})
+		s.Start()
+		echoPort = s.Port
+	})
+}
+
+func BenchmarkEcho(b *testing.B) {
+	startEchoServer(b)
+
+	// 等待服务端开始监听
+	conn := dialTest(b, echoPort)
+	defer conn.Close()
+
+	dp := NewDataPack()
+	binaryData, _ := dp.Pack(NewMessage(1, benchData))
+	reply := make([]byte, len(binaryData))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchData)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(binaryData); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package znet
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+// 缓冲池按容量分级，从 512B 到 64KB，每级的容量都是 2 的幂
+// 更大的缓冲直接分配，由 GC 回收
+const (
+	minBufferShift = 9
+	maxBufferShift = 16
+)
+
+// bufferPools 每个容量等级对应一个 sync.Pool，存放 *[]byte 避免放回时的额外分配
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass 获取能容纳 size 字节的最小容量等级，超过最大等级时返回 -1
+func bufferClass(size int) int {
+	if size <= 1<<minBufferShift {
+		return 0
+	}
+	shift := bits.Len(uint(size - 1))
+	if shift > maxBufferShift {
+		return -1
+	}
+	return shift - minBufferShift
+}
+
+// getBuffer 从缓冲池中获取一个长度为 size 的缓冲，内容未初始化
+func getBuffer(size int) *[]byte {
+	class := bufferClass(size)
+	if class < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+	if v := bufferPools[class].Get(); v != nil {
+		bp := v.(*[]byte)
+		*bp = (*bp)[:size]
+		return bp
+	}
+	buf := make([]byte, size, 1<<(class+minBufferShift))
+	return &buf
+}
+
+// putBuffer 将缓冲放回缓冲池，不是从缓冲池中获取的缓冲会被忽略
+func putBuffer(bp *[]byte) {
+	size := cap(*bp)
+	class := bufferClass(size)
+	if class < 0 || size != 1<<(class+minBufferShift) {
+		return
+	}
+	bufferPools[class].Put(bp)
+}
+
+// releaseMsg 将消息内容所在的缓冲放回缓冲池，之后消息内容不可再使用
+func releaseMsg(msg ziface.IMessage) {
+	if m, ok := msg.(*Message); ok {
+		m.release()
+	}
+}
@@ -0,0 +1,92 @@
+package znet
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+func TestDataPackChecksum(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Checksum = true
+
+	dp := NewDataPack()
+	binaryData, err := dp.Pack(NewMessage(1, []byte("zinx")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headLen := dp.GetHeadLen()
+
+	unpack := func(frame []byte) error {
+		msg, err := dp.UnPack(frame[:headLen])
+		if err != nil {
+			return err
+		}
+		msg.SetData(frame[headLen : headLen+msg.GetDataLen()])
+		return dp.Verify(msg)
+	}
+
+	if err := unpack(binaryData); err != nil {
+		t.Fatalf("valid frame: %v", err)
+	}
+
+	failures := IntegrityFailures()
+
+	// 损坏的消息内容：包头仍然可信，返回 ErrDataChecksum
+	corrupted := append([]byte{}, binaryData...)
+	corrupted[headLen] ^= 0xFF
+	if err := unpack(corrupted); err != ErrDataChecksum {
+		t.Fatalf("corrupted data err = %v, want ErrDataChecksum", err)
+	}
+
+	// 损坏的 DataLen：包头校验失败
+	corrupted = append([]byte{}, binaryData...)
+	corrupted[0] ^= 0x01
+	if _, err := dp.UnPack(corrupted[:headLen]); err == nil || err == ErrDataChecksum {
+		t.Fatalf("corrupted head err = %v", err)
+	}
+
+	if got := IntegrityFailures() - failures; got != 2 {
+		t.Fatalf("integrity failures = %d, want 2", got)
+	}
+}
+
+func TestChecksumDropEncrypted(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.Checksum = true
+	utils.GlobalObject.ChecksumFailAction = ChecksumFailDrop
+	utils.GlobalObject.Encryption = "required"
+
+	s := NewServer("checksum").(*Server)
+	s.Start()
+	defer s.Stop()
+
+	conn := dialTest(t, s.Port)
+	defer conn.Close()
+	cs, err := clientHandshake(conn)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	// 加密的链接上消息内容损坏时关闭链接，而不是丢弃之后继续读取
+	msg := NewMessage(1, []byte("zinx"))
+	cs.seal(msg)
+	dp := NewDataPack()
+	frame, err := dp.Pack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[dp.GetHeadLen()] ^= 0xFF
+	conn.Write(frame)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read err = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,484 @@
+package znet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+const (
+	// 链接服务端的超时时间
+	clientDialTimeout = 5 * time.Second
+	// 写入一个消息的超时时间，超时后关闭链接，避免服务端不读取时一直阻塞发送方
+	clientWriteTimeout = 5 * time.Second
+)
+
+var (
+	// ErrEncryptedMsg 没有开启加密（Encryption 为空）的客户端收到加密的消息时断开链接
+	ErrEncryptedMsg = errors.New("encrypted msg not supported by client")
+
+	// ErrSendBufferFull 重新链接期间缓存的消息已达到上限
+	ErrSendBufferFull = errors.New("client send buffer is full")
+)
+
+// Client 客户端模块，用于服务之间的内部链接
+// 与服务端使用相同的封包格式，支持校验、压缩和分片，开启加密（Encryption 不为空）时链接之后先完成握手
+type Client struct {
+	// 服务端的地址
+	Addr string
+	// 当前的 socket，未链接时为 nil
+	conn net.Conn
+	// 当前 socket 的加密状态，未开启加密时为 nil
+	cipher *cipherState
+	// 是否已经链接，与 conn 一起在锁中修改，IsConnected 不需要等待正在进行的写入
+	connected uint32
+	// 保护 conn 以及保证消息完整地写入
+	lock sync.Mutex
+	// MsgID 对应的处理方法
+	handlers     map[uint32]ziface.ClientHandler
+	handlersLock sync.RWMutex
+	// 封包，拆包的模块
+	dp *DataPack
+	// 拆分为分片发送的消息的编号，在锁中递增
+	streamID uint32
+	// 链接建立、断开之后调用的 Hook 函数
+	onConnect    func(client ziface.IClient)
+	onDisconnect func(client ziface.IClient, err error)
+
+	// 自动重新链接的最大次数，0 表示不重新链接，小于 0 表示不限次数
+	maxAttempts int
+	// 重新链接的等待时间从 baseDelay 开始逐次翻倍，最多为 maxDelay
+	baseDelay, maxDelay time.Duration
+	// 重新链接期间最多缓存的消息数，0 表示不缓存
+	sendBufferSize int
+	// 重新链接期间缓存的消息，重新链接并完成握手之后再封包
+	pending []queuedMsg
+	// 是否正在重新链接
+	reconnecting bool
+	// 调用 Stop 时关闭，中止重新链接，每次重新链接使用开始时的 exit
+	exit chan struct{}
+	// 重新链接的 Hook 函数
+	onReconnecting func(client ziface.IClient, attempt int, delay time.Duration)
+	onReconnected  func(client ziface.IClient, attempts int)
+	onGiveUp       func(client ziface.IClient, err error)
+}
+
+// NewClient 创建客户端
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:     addr,
+		handlers: make(map[uint32]ziface.ClientHandler),
+		dp:       NewDataPack(),
+		exit:     make(chan struct{}),
+	}
+}
+
+// Start 链接服务端并启动 Reader
+func (c *Client) Start() error {
+	conn, cs, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if c.conn != nil || c.reconnecting {
+		c.lock.Unlock()
+		conn.Close()
+		return fmt.Errorf("client %s already started", c.Addr)
+	}
+	select {
+	case <-c.exit:
+		// 调用过 Stop 之后重新启动
+		c.exit = make(chan struct{})
+	default:
+	}
+	c.attach(conn, cs)
+	c.lock.Unlock()
+
+	if c.onConnect != nil {
+		c.onConnect(c)
+	}
+	return nil
+}
+
+// dial 链接服务端，开启加密时先完成握手
+func (c *Client) dial() (net.Conn, *cipherState, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, clientDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if utils.GlobalObject.Encryption == EncryptionOff {
+		return conn, nil, nil
+	}
+
+	// 服务端没有开启加密时不会回复握手，等待同样受链接超时的限制
+	conn.SetDeadline(time.Now().Add(clientDialTimeout))
+	cs, err := clientHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("handshake error %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, cs, nil
+}
+
+// attach 使用新的 socket 并启动 Reader，调用方需持有锁
+func (c *Client) attach(conn net.Conn, cs *cipherState) {
+	c.conn = conn
+	c.cipher = cs
+	atomic.StoreUint32(&c.connected, 1)
+
+	fmt.Println("[Client] connected to ", c.Addr)
+	go c.startReader(conn, cs)
+}
+
+// Stop 关闭链接，中止重新链接，丢弃缓存的消息
+// 不等待 Reader 和重新链接退出，可以在消息的处理方法和钩子函数中调用
+func (c *Client) Stop() {
+	c.lock.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.cipher = nil
+	atomic.StoreUint32(&c.connected, 0)
+	c.reconnecting = false
+	c.pending = nil
+	select {
+	case <-c.exit:
+	default:
+		close(c.exit)
+	}
+	c.lock.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// startReader 读取服务端的消息，交给对应的处理方法
+func (c *Client) startReader(conn net.Conn, cs *cipherState) {
+	headBuf := make([]byte, c.dp.GetHeadLen())
+	// 分片消息重组为完整的消息之后再交给处理方法
+	fragments := newReassembler(nil)
+	defer fragments.abortAll(ErrConnClosed)
+	for {
+		msg, err := c.readMsg(conn, headBuf, cs)
+		if err == nil && msg.GetFlags()&FlagFragment != 0 {
+			msg, err = fragments.assemble(msg)
+		}
+		if err != nil {
+			c.disconnect(conn, err)
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		c.handlersLock.RLock()
+		handler, ok := c.handlers[msg.GetMsgID()]
+		c.handlersLock.RUnlock()
+		if ok {
+			handler(c, msg)
+		}
+	}
+}
+
+// readMsg 读取一个完整的消息，并依次进行解密、解压
+func (c *Client) readMsg(conn net.Conn, headBuf []byte, cs *cipherState) (ziface.IMessage, error) {
+	if _, err := io.ReadFull(conn, headBuf); err != nil {
+		return nil, err
+	}
+	msg, err := c.dp.UnPack(headBuf)
+	if err != nil {
+		return nil, err
+	}
+	if msg.GetDataLen() > 0 {
+		data := make([]byte, msg.GetDataLen())
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, err
+		}
+		msg.SetData(data)
+	}
+	if err := c.dp.Verify(msg); err != nil {
+		return nil, err
+	}
+
+	if cs != nil {
+		// 加密的链接上不接受明文消息
+		if err := cs.open(msg); err != nil {
+			return nil, err
+		}
+	} else if msg.GetFlags()&FlagEncrypted != 0 {
+		return nil, ErrEncryptedMsg
+	}
+	if msg.GetFlags()&FlagCompressed != 0 {
+		if err := decompressMsg(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// disconnect Reader 退出时清理链接，调用过 Stop 时不再通知断开，开启自动重新链接时开始重新链接
+func (c *Client) disconnect(conn net.Conn, err error) {
+	c.lock.Lock()
+	active := c.conn == conn
+	if active {
+		c.conn = nil
+		c.cipher = nil
+		atomic.StoreUint32(&c.connected, 0)
+	}
+	reconnect := active && c.maxAttempts != 0
+	if reconnect {
+		c.reconnecting = true
+	}
+	exit := c.exit
+	c.lock.Unlock()
+
+	conn.Close()
+	if !active {
+		err = nil
+	}
+	fmt.Println("[Client] disconnected from ", c.Addr, " ", err)
+	if c.onDisconnect != nil {
+		c.onDisconnect(c, err)
+	}
+	if reconnect {
+		// 回调中调用了 Stop 时 exit 已经关闭，重新链接直接退出
+		go c.reconnect(exit)
+	}
+}
+
+// backoff 第 attempt 次重新链接之前等待的时间
+func (c *Client) backoff(attempt int) time.Duration {
+	return backoffDelay(c.baseDelay, c.maxDelay, attempt)
+}
+
+// backoffDelay 从 base 开始逐次翻倍、最多为 max 的等待时间，并随机减少最多一半，避免大量链接同时重试
+func backoffDelay(base, max time.Duration, attempt int) time.Duration {
+	delay := max
+	if shift := attempt - 1; shift < 32 && base<<shift < max {
+		delay = base << shift
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// reconnect 按照指数退避重新链接，直到成功、达到最大次数或 exit 关闭（调用了 Stop）
+// 成功或放弃的回调在结束重新链接之后调用
+func (c *Client) reconnect(exit chan struct{}) {
+	var err error
+	for attempt := 1; c.maxAttempts < 0 || attempt <= c.maxAttempts; attempt++ {
+		delay := c.backoff(attempt)
+		select {
+		case <-exit:
+			return
+		default:
+		}
+		if c.onReconnecting != nil {
+			c.onReconnecting(c, attempt, delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-exit:
+			return
+		}
+
+		var conn net.Conn
+		var cs *cipherState
+		if conn, cs, err = c.dial(); err != nil {
+			fmt.Println("[Client] reconnect ", c.Addr, " attempt ", attempt, " error ", err)
+			continue
+		}
+
+		c.lock.Lock()
+		select {
+		case <-exit:
+			c.lock.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		// 先发送断开期间缓存的消息，之后的消息才能写入，保证发送的顺序
+		pending := c.pending
+		c.pending = nil
+		conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		for _, msg := range pending {
+			var binaryData []byte
+			if binaryData, err = c.pack(cs, msg.msgID, msg.data); err != nil {
+				break
+			}
+			if _, err = conn.Write(binaryData); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			c.pending = pending
+			c.lock.Unlock()
+			conn.Close()
+			continue
+		}
+		c.reconnecting = false
+		c.attach(conn, cs)
+		c.lock.Unlock()
+
+		if c.onConnect != nil {
+			c.onConnect(c)
+		}
+		if c.onReconnected != nil {
+			c.onReconnected(c, attempt)
+		}
+		return
+	}
+
+	// 结束重新链接，丢弃缓存的消息
+	c.lock.Lock()
+	select {
+	case <-exit:
+		c.lock.Unlock()
+		return
+	default:
+	}
+	c.reconnecting = false
+	c.pending = nil
+	c.lock.Unlock()
+
+	fmt.Println("[Client] give up reconnecting ", c.Addr, " ", err)
+	if c.onGiveUp != nil {
+		c.onGiveUp(c, err)
+	}
+}
+
+// SendMsg 发送消息给服务端，重新链接期间按配置缓存消息，链接成功后按顺序发送
+// 写入超过 clientWriteTimeout 时关闭链接并返回错误
+func (c *Client) SendMsg(msgID uint32, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		if !c.reconnecting || c.sendBufferSize <= 0 {
+			return ErrConnClosed
+		}
+		if len(c.pending) >= c.sendBufferSize {
+			return ErrSendBufferFull
+		}
+		if uint64(len(data)) > uint64(maxSendLen()) {
+			return fmt.Errorf("%s", "too large message data send !!!")
+		}
+		c.pending = append(c.pending, queuedMsg{msgID: msgID, data: append([]byte(nil), data...)})
+		return nil
+	}
+
+	// 加密的序列号必须与写入的顺序一致，在锁中封包
+	binaryData, err := c.pack(c.cipher, msgID, data)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	if _, err = c.conn.Write(binaryData); err != nil {
+		// 消息可能只写入了一部分，关闭 socket，由 Reader 处理断开
+		c.conn.Close()
+	}
+	return err
+}
+
+// pack 依次进行拆分、加密、封包，超过一个包所能承载的消息拆分为多个分片，所有分片一起写入
+// cs 为 socket 的加密状态，调用方需持有锁
+func (c *Client) pack(cs *cipherState, msgID uint32, data []byte) ([]byte, error) {
+	msgs := []ziface.IMessage{NewMessage(msgID, data)}
+	if utils.GlobalObject.MaxMessageSize > 0 {
+		chunkSize, err := maxChunkSize(cs != nil)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(data)) > chunkSize {
+			if uint32(len(data)) > utils.GlobalObject.MaxMessageSize {
+				return nil, fmt.Errorf("%s", "too large message data send !!!")
+			}
+			c.streamID++
+			msgs = splitFragments(msgID, c.streamID, data, chunkSize)
+		}
+	}
+
+	var binaryData []byte
+	for _, msg := range msgs {
+		if cs != nil {
+			cs.seal(msg)
+		}
+		frame, err := c.dp.Pack(msg)
+		if err != nil {
+			return nil, err
+		}
+		binaryData = append(binaryData, frame...)
+	}
+	return binaryData, nil
+}
+
+// AddHandler 注册处理某个 MsgID 的方法
+func (c *Client) AddHandler(msgID uint32, handler ziface.ClientHandler) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	c.handlers[msgID] = handler
+}
+
+// SetOnConnect 注册 OnConnect 钩子函数的方法，重新链接成功时同样调用
+func (c *Client) SetOnConnect(hookFunc func(client ziface.IClient)) {
+	c.onConnect = hookFunc
+}
+
+// SetOnDisconnect 注册 OnDisconnect 钩子函数的方法
+func (c *Client) SetOnDisconnect(hookFunc func(client ziface.IClient, err error)) {
+	c.onDisconnect = hookFunc
+}
+
+// SetReconnect 开启断开后的自动重新链接，maxAttempts 为 0 时关闭，小于 0 时不限次数
+// 等待时间从 baseDelay 开始逐次翻倍，最多为 maxDelay，并随机减少最多一半
+func (c *Client) SetReconnect(maxAttempts int, baseDelay, maxDelay time.Duration) {
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+	c.maxAttempts, c.baseDelay, c.maxDelay = maxAttempts, baseDelay, maxDelay
+}
+
+// SetSendBuffer 设置重新链接期间最多缓存的消息数，0 表示重新链接期间 SendMsg 返回错误
+func (c *Client) SetSendBuffer(size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sendBufferSize = size
+}
+
+// SetOnReconnecting 注册每次重新链接之前调用的钩子函数
+func (c *Client) SetOnReconnecting(hookFunc func(client ziface.IClient, attempt int, delay time.Duration)) {
+	c.onReconnecting = hookFunc
+}
+
+// SetOnReconnected 注册重新链接成功之后调用的钩子函数，attempts 为尝试的次数
+func (c *Client) SetOnReconnected(hookFunc func(client ziface.IClient, attempts int)) {
+	c.onReconnected = hookFunc
+}
+
+// SetOnGiveUp 注册达到最大次数仍未重新链接成功时调用的钩子函数，err 为最后一次链接的错误
+func (c *Client) SetOnGiveUp(hookFunc func(client ziface.IClient, err error)) {
+	c.onGiveUp = hookFunc
+}
+
+// GetAddr 获取服务端的地址
+func (c *Client) GetAddr() string {
+	return c.Addr
+}
+
+// IsConnected 是否已经链接
+func (c *Client) IsConnected() bool {
+	return atomic.LoadUint32(&c.connected) == 1
+}
@@ -0,0 +1,244 @@
+package znet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestClientReconnect(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+
+	port := freePort(t)
+	startServer := func() *Server {
+		utils.GlobalObject.TCPPort = port
+		s := NewServer("reconnect").(*Server)
+		s.AddHandlerFunc(1, func(request ziface.IRequest) {
+			request.GetConnection().SendMsg(1, request.GetData())
+		})
+		s.Start()
+		return s
+	}
+	s := startServer()
+
+	client := NewClient(fmt.Sprintf("127.0.0.1:%d", port))
+	echo := make(chan string, 8)
+	client.AddHandler(1, func(_ ziface.IClient, msg ziface.IMessage) {
+		echo <- string(msg.GetData())
+	})
+	disconnected := make(chan struct{}, 4)
+	client.SetOnDisconnect(func(ziface.IClient, error) {
+		disconnected <- struct{}{}
+	})
+	var lock sync.Mutex
+	var delays []time.Duration
+	reconnected := make(chan int, 1)
+	client.SetReconnect(-1, 20*time.Millisecond, 80*time.Millisecond)
+	client.SetSendBuffer(2)
+	client.SetOnReconnecting(func(_ ziface.IClient, attempt int, delay time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		delays = append(delays, delay)
+	})
+	client.SetOnReconnected(func(_ ziface.IClient, attempts int) {
+		reconnected <- attempts
+	})
+
+	for deadline := time.Now().Add(3 * time.Second); client.Start() != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("dial timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer client.Stop()
+	expect := func(want string) {
+		select {
+		case got := <-echo:
+			if got != want {
+				t.Fatalf("echo %q, want %q", got, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for echo %q", want)
+		}
+	}
+	client.SendMsg(1, []byte("a"))
+	expect("a")
+
+	// 服务端重启期间发送的消息被缓存，超出上限时返回错误
+	s.Stop()
+	<-disconnected
+	for _, data := range []string{"b", "c"} {
+		if err := client.SendMsg(1, []byte(data)); err != nil {
+			t.Fatalf("buffered send %s: %v", data, err)
+		}
+	}
+	if err := client.SendMsg(1, []byte("d")); err != ErrSendBufferFull {
+		t.Fatalf("send over buffer err=%v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	s = startServer()
+	defer s.Stop()
+
+	select {
+	case attempts := <-reconnected:
+		if attempts < 2 {
+			t.Fatalf("reconnected after %d attempts", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	expect("b")
+	expect("c")
+
+	// 等待时间按指数退避，随机抖动不超过一半，且不超过最大值
+	lock.Lock()
+	for i, delay := range delays {
+		max := 20 * time.Millisecond << i
+		if max > 80*time.Millisecond {
+			max = 80 * time.Millisecond
+		}
+		if delay < max/2 || delay > max {
+			t.Fatalf("attempt %d delay %v, want [%v, %v]", i+1, delay, max/2, max)
+		}
+	}
+	lock.Unlock()
+
+	// 超过最大次数后放弃
+	client.SetReconnect(2, 10*time.Millisecond, 20*time.Millisecond)
+	gaveUp := make(chan error, 1)
+	client.SetOnGiveUp(func(_ ziface.IClient, err error) {
+		gaveUp <- err
+	})
+	s.Stop()
+	select {
+	case err := <-gaveUp:
+		if err == nil {
+			t.Fatal("give up without error")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("not given up")
+	}
+	if err := client.SendMsg(1, nil); err != ErrConnClosed {
+		t.Fatalf("send after give up err=%v", err)
+	}
+}
+
+func TestClientStopInCallback(t *testing.T) {
+	// 每个链接收到一个消息之后被服务端关闭
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		data, _ := NewDataPack().Pack(NewMessage(1, nil))
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(data)
+			conn.Close()
+		}
+	}()
+
+	cases := map[string]func(client *Client, stop func()){
+		"handler": func(client *Client, stop func()) {
+			client.AddHandler(1, func(ziface.IClient, ziface.IMessage) { stop() })
+		},
+		"OnDisconnect": func(client *Client, stop func()) {
+			client.SetOnDisconnect(func(ziface.IClient, error) { stop() })
+		},
+		"OnReconnecting": func(client *Client, stop func()) {
+			client.SetOnReconnecting(func(ziface.IClient, int, time.Duration) { stop() })
+		},
+	}
+	for name, setup := range cases {
+		client := NewClient(ln.Addr().String())
+		client.SetReconnect(-1, 10*time.Millisecond, 10*time.Millisecond)
+		stopped := make(chan struct{})
+		var once sync.Once
+		setup(client, func() {
+			once.Do(func() {
+				client.Stop()
+				close(stopped)
+			})
+		})
+		reconnected := make(chan struct{}, 1)
+		client.SetOnReconnected(func(ziface.IClient, int) { reconnected <- struct{}{} })
+
+		if err := client.Start(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-stopped:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Stop in %s blocked", name)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if client.IsConnected() {
+			t.Fatalf("connected after Stop in %s", name)
+		}
+		select {
+		case <-reconnected:
+			t.Fatalf("reconnected after Stop in %s", name)
+		default:
+		}
+	}
+}
+
+func TestClientEncryption(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.Encryption = EncryptionRequired
+	utils.GlobalObject.MaxPackageSize = 128
+	utils.GlobalObject.MaxMessageSize = 4096
+
+	// 服务端要求加密，客户端链接后先完成握手，大消息拆分为分片之后逐个加密
+	s := NewServer("encryption").(*Server)
+	s.AddHandlerFunc(1, func(request ziface.IRequest) {
+		request.GetConnection().SendMsg(1, request.GetData())
+	})
+	s.Start()
+	defer s.Stop()
+
+	client := NewClient(fmt.Sprintf("127.0.0.1:%d", s.Port))
+	echo := make(chan string, 2)
+	client.AddHandler(1, func(_ ziface.IClient, msg ziface.IMessage) {
+		echo <- string(msg.GetData())
+	})
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		err := client.Start()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	defer client.Stop()
+
+	for _, data := range []string{"hello", strings.Repeat("0123456789", 100)} {
+		if err := client.SendMsg(1, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-echo:
+			if got != data {
+				t.Fatalf("echo len=%d, want %d", len(got), len(data))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no echo over encrypted link")
+		}
+	}
+}
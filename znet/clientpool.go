@@ -0,0 +1,396 @@
+package znet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 链接池的负载均衡策略
+const (
+	BalanceRoundRobin     = "round_robin"     // 轮询
+	BalanceLeastInflight  = "least_inflight"  // 选择正在使用中（Pick 之后还没有 done）次数最少的
+	BalanceConsistentHash = "consistent_hash" // 按 key 一致性哈希，服务端增减时只有少量 key 改变
+)
+
+// 一致性哈希中每个服务端的虚拟节点数
+const hashReplicas = 100
+
+// 心跳超时为心跳间隔的倍数
+const heartbeatTimeoutRatio = 3
+
+// ErrNoHealthyClient 链接池中没有健康的客户端
+var ErrNoHealthyClient = errors.New("no healthy client in pool")
+
+// poolMember 链接池中的一个服务端
+type poolMember struct {
+	addr   string
+	client *Client
+	// 是否健康，只有健康的客户端会被选择
+	healthy bool
+	// 使用中的次数
+	inflight int64
+	// 最后一次收到心跳回复的时间
+	lastPong int64
+	// 是否正在检查，上一次检查还没有结束时跳过
+	checking int32
+}
+
+// ClientPool 客户端链接池
+type ClientPool struct {
+	// 负载均衡策略
+	Balance string
+	// 发送心跳的间隔，超过 HeartbeatTimeout 没有回复时视为不健康，关闭后重新链接
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	lock    sync.RWMutex
+	members map[string]*poolMember
+	// 按地址排序的服务端，用于轮询
+	order []*poolMember
+	// 一致性哈希环
+	ring     []uint32
+	ringAddr map[uint32]string
+
+	next uint32
+	// 是否已经 Start，Start 之前设置的地址由 Start 链接
+	started bool
+	exit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewClientPool 创建客户端链接池，balance 为空时使用轮询
+func NewClientPool(addrs []string, balance string) *ClientPool {
+	if balance == "" {
+		balance = BalanceRoundRobin
+	}
+	interval := time.Duration(utils.GlobalObject.ClientHeartbeatInterval) * time.Second
+	p := &ClientPool{
+		Balance:           balance,
+		HeartbeatInterval: interval,
+		HeartbeatTimeout:  heartbeatTimeoutRatio * interval,
+		members:           make(map[string]*poolMember),
+		exit:              make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		p.members[addr] = &poolMember{addr: addr}
+	}
+	p.rebuild()
+	return p
+}
+
+// Start 链接所有服务端并开始健康检查
+func (p *ClientPool) Start() error {
+	p.lock.Lock()
+	p.started = true
+	members := append([]*poolMember(nil), p.order...)
+	p.lock.Unlock()
+
+	healthy := 0
+	for _, m := range members {
+		if p.dial(m) == nil {
+			healthy++
+		}
+	}
+
+	if p.HeartbeatInterval > 0 {
+		p.wg.Add(1)
+		go p.healthCheck()
+	}
+
+	if healthy == 0 && len(members) > 0 {
+		return ErrNoHealthyClient
+	}
+	return nil
+}
+
+// Stop 停止健康检查并关闭所有链接
+func (p *ClientPool) Stop() {
+	select {
+	case <-p.exit:
+		return
+	default:
+	}
+	close(p.exit)
+	p.wg.Wait()
+
+	p.lock.Lock()
+	p.started = false
+	members := append([]*poolMember(nil), p.order...)
+	p.lock.Unlock()
+	for _, m := range members {
+		p.evict(m)
+	}
+}
+
+// SetAddrs 替换服务端的地址
+func (p *ClientPool) SetAddrs(addrs []string) {
+	p.lock.Lock()
+	keep := make(map[string]bool)
+	var added, removed []*poolMember
+	for _, addr := range addrs {
+		keep[addr] = true
+		if _, ok := p.members[addr]; !ok {
+			m := &poolMember{addr: addr}
+			p.members[addr] = m
+			added = append(added, m)
+		}
+	}
+	for addr, m := range p.members {
+		if !keep[addr] {
+			delete(p.members, addr)
+			removed = append(removed, m)
+		}
+	}
+	p.rebuild()
+	started := p.started
+	p.lock.Unlock()
+
+	for _, m := range removed {
+		p.evict(m)
+	}
+	// 还没有 Start 时由 Start 链接
+	if !started {
+		return
+	}
+	for _, m := range added {
+		p.dial(m)
+	}
+}
+
+// WatchRegistry 从服务发现中获取服务端的地址，实例变化时更新链接池
+func (p *ClientPool) WatchRegistry(registry ziface.IRegistry, name string) (func(), error) {
+	return registry.Watch(name, func(instances []ziface.ServiceInstance) {
+		addrs := make([]string, 0, len(instances))
+		for _, instance := range instances {
+			addrs = append(addrs, instance.Addr)
+		}
+		p.SetAddrs(addrs)
+	})
+}
+
+// rebuild 重建轮询的顺序和一致性哈希环，调用方需持有写锁
+func (p *ClientPool) rebuild() {
+	p.order = p.order[:0]
+	p.ring = p.ring[:0]
+	p.ringAddr = make(map[uint32]string)
+	for addr, m := range p.members {
+		p.order = append(p.order, m)
+		for i := 0; i < hashReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, h)
+			p.ringAddr[h] = addr
+		}
+	}
+	sort.Slice(p.order, func(i, j int) bool {
+		return p.order[i].addr < p.order[j].addr
+	})
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i] < p.ring[j]
+	})
+}
+
+// dial 链接服务端，成功后标记为健康
+func (p *ClientPool) dial(m *poolMember) error {
+	client := NewClient(m.addr)
+	client.AddHandler(MsgIDHeartbeat, func(ziface.IClient, ziface.IMessage) {
+		atomic.StoreInt64(&m.lastPong, time.Now().UnixNano())
+	})
+	if err := client.Start(); err != nil {
+		fmt.Println("[ClientPool] dial ", m.addr, " error ", err)
+		return err
+	}
+
+	p.lock.Lock()
+	if !p.started || p.members[m.addr] != m {
+		// 链接池已经停止或者地址已经被移除
+		p.lock.Unlock()
+		client.Stop()
+		return ErrConnClosed
+	}
+	m.client = client
+	m.healthy = true
+	atomic.StoreInt64(&m.lastPong, time.Now().UnixNano())
+	p.lock.Unlock()
+	return nil
+}
+
+// evict 将服务端标记为不健康并关闭链接
+func (p *ClientPool) evict(m *poolMember) {
+	p.lock.Lock()
+	client := m.client
+	m.client = nil
+	m.healthy = false
+	p.lock.Unlock()
+
+	// 在锁外关闭，Stop 需要等待正在进行的写入超时
+	if client != nil {
+		client.Stop()
+	}
+}
+
+// healthCheck 定时检查所有的服务端
+// 每个服务端在单独的 Goroutine 中检查，链接超时或写入阻塞的服务端不影响其它服务端的检查和驱逐
+func (p *ClientPool) healthCheck() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.exit:
+			return
+		}
+
+		p.lock.RLock()
+		members := append([]*poolMember(nil), p.order...)
+		p.lock.RUnlock()
+
+		now := time.Now()
+		nonce := make([]byte, 8)
+		binary.LittleEndian.PutUint64(nonce, uint64(now.UnixNano()))
+		for _, m := range members {
+			if !atomic.CompareAndSwapInt32(&m.checking, 0, 1) {
+				continue
+			}
+			go func(m *poolMember) {
+				defer atomic.StoreInt32(&m.checking, 0)
+				p.check(m, now, nonce)
+			}(m)
+		}
+	}
+}
+
+// check 发送心跳，驱逐断开或心跳超时的链接，并重新链接不健康的服务端
+// 链接和写入分别受 clientDialTimeout 和 clientWriteTimeout 限制
+func (p *ClientPool) check(m *poolMember, now time.Time, nonce []byte) {
+	p.lock.RLock()
+	client, healthy := m.client, m.healthy
+	p.lock.RUnlock()
+
+	if !healthy {
+		p.dial(m)
+		return
+	}
+	lastPong := time.Unix(0, atomic.LoadInt64(&m.lastPong))
+	if !client.IsConnected() || now.Sub(lastPong) > p.HeartbeatTimeout || client.SendMsg(MsgIDHeartbeat, nonce) != nil {
+		fmt.Println("[ClientPool] evict unhealthy ", m.addr)
+		p.evict(m)
+	}
+}
+
+// Pick 按负载均衡策略选择一个健康的客户端
+// 在读锁中按策略的优先顺序取出健康的服务端，释放锁之后再检查客户端是否已经链接
+func (p *ClientPool) Pick(key string) (ziface.IClient, func(), error) {
+	p.lock.RLock()
+	candidates := p.candidates(key)
+	p.lock.RUnlock()
+
+	var m *poolMember
+	var client *Client
+	for _, c := range candidates {
+		if !c.client.IsConnected() {
+			continue
+		}
+		if p.Balance != BalanceLeastInflight {
+			m, client = c.member, c.client
+			break
+		}
+		if m == nil || atomic.LoadInt64(&c.member.inflight) < atomic.LoadInt64(&m.inflight) {
+			m, client = c.member, c.client
+		}
+	}
+	if m == nil {
+		return nil, nil, ErrNoHealthyClient
+	}
+	atomic.AddInt64(&m.inflight, 1)
+
+	var once sync.Once
+	return client, func() {
+		once.Do(func() {
+			atomic.AddInt64(&m.inflight, -1)
+		})
+	}, nil
+}
+
+// candidate 选择时的一个健康的服务端以及它当前的客户端
+type candidate struct {
+	member *poolMember
+	client *Client
+}
+
+// candidates 按负载均衡策略的优先顺序获取健康的服务端，调用方需持有读锁
+func (p *ClientPool) candidates(key string) []candidate {
+	var candidates []candidate
+	add := func(m *poolMember) {
+		if m.healthy && m.client != nil {
+			candidates = append(candidates, candidate{member: m, client: m.client})
+		}
+	}
+
+	switch p.Balance {
+	case BalanceLeastInflight:
+		for _, m := range p.order {
+			add(m)
+		}
+
+	case BalanceConsistentHash:
+		if len(p.ring) == 0 {
+			return nil
+		}
+		// 从 key 在环上的位置开始顺时针依次获取服务端，每个服务端只取第一次出现的位置
+		h := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= h })
+		seen := make(map[*poolMember]bool, len(p.order))
+		for i := 0; i < len(p.ring) && len(seen) < len(p.order); i++ {
+			m := p.members[p.ringAddr[p.ring[(start+i)%len(p.ring)]]]
+			if !seen[m] {
+				seen[m] = true
+				add(m)
+			}
+		}
+
+	default:
+		n := len(p.order)
+		start := int(atomic.AddUint32(&p.next, 1))
+		for i := 0; i < n; i++ {
+			add(p.order[(start+i)%n])
+		}
+	}
+	return candidates
+}
+
+// SendMsg 选择一个健康的客户端发送消息
+func (p *ClientPool) SendMsg(key string, msgID uint32, data []byte) error {
+	client, done, err := p.Pick(key)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return client.SendMsg(msgID, data)
+}
+
+// Healthy 获取所有健康的客户端
+func (p *ClientPool) Healthy() []ziface.IClient {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	clients := make([]ziface.IClient, 0, len(p.order))
+	for _, m := range p.order {
+		if m.healthy && m.client != nil {
+			clients = append(clients, m.client)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,218 @@
+package znet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestClientPool(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	// 测试中的心跳间隔很短
+	utils.GlobalObject.HeartbeatRateLimit = utils.RateLimit{Rate: 1000}
+
+	startServer := func(port int) *Server {
+		utils.GlobalObject.TCPPort = port
+		s := NewServer("pool").(*Server)
+		s.Start()
+		return s
+	}
+	var addrs []string
+	servers := map[string]*Server{}
+	for i := 0; i < 3; i++ {
+		port := freePort(t)
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		addrs = append(addrs, addr)
+		servers[addr] = startServer(port)
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	// 服务端异步开始监听，链接失败的服务端在健康检查中重新链接
+	newPool := func(balance string) *ClientPool {
+		p := NewClientPool(addrs, balance)
+		p.HeartbeatInterval = 50 * time.Millisecond
+		p.HeartbeatTimeout = 200 * time.Millisecond
+		p.Start()
+		for deadline := time.Now().Add(3 * time.Second); len(p.Healthy()) != 3; {
+			if time.Now().After(deadline) {
+				t.Fatalf("pool healthy=%d", len(p.Healthy()))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return p
+	}
+	pick := func(p *ClientPool, key string) (string, func()) {
+		client, done, err := p.Pick(key)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		return client.GetAddr(), done
+	}
+
+	// 轮询：每个服务端被选中的次数相同
+	rr := newPool(BalanceRoundRobin)
+	defer rr.Stop()
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		addr, done := pick(rr, "")
+		done()
+		counts[addr]++
+	}
+	for _, addr := range addrs {
+		if counts[addr] != 2 {
+			t.Fatalf("round robin counts = %v", counts)
+		}
+	}
+
+	// 最少使用中：没有 done 的服务端不会被再次选中
+	least := newPool(BalanceLeastInflight)
+	defer least.Stop()
+	picked := map[string]func(){}
+	for i := 0; i < 3; i++ {
+		addr, done := pick(least, "")
+		if _, ok := picked[addr]; ok {
+			t.Fatalf("least inflight picked %s twice", addr)
+		}
+		picked[addr] = done
+	}
+	picked[addrs[1]]()
+	if addr, _ := pick(least, ""); addr != addrs[1] {
+		t.Fatalf("least inflight picked %s, want %s", addr, addrs[1])
+	}
+
+	// 一致性哈希：同一个 key 总是选中同一个服务端
+	hash := newPool(BalanceConsistentHash)
+	defer hash.Stop()
+	owner, _ := pick(hash, "user-42")
+	for i := 0; i < 5; i++ {
+		if addr, _ := pick(hash, "user-42"); addr != owner {
+			t.Fatalf("consistent hash picked %s, want %s", addr, owner)
+		}
+	}
+
+	// 服务端停止后被驱逐，key 迁移到其它服务端；重新启动后重新链接，key 回到原来的服务端
+	port := servers[owner].Port
+	servers[owner].Stop()
+	waitHealthy := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); len(hash.Healthy()) != n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("healthy=%d, want %d", len(hash.Healthy()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitHealthy(2)
+	if addr, _ := pick(hash, "user-42"); addr == owner {
+		t.Fatal("picked stopped server")
+	}
+	servers[owner] = startServer(port)
+	waitHealthy(3)
+	if addr, _ := pick(hash, "user-42"); addr != owner {
+		t.Fatalf("consistent hash picked %s after redial, want %s", addr, owner)
+	}
+
+	// 心跳由服务端原样回复
+	client, done, _ := hash.Pick("user-42")
+	defer done()
+	pong := make(chan string, 1)
+	client.AddHandler(MsgIDHeartbeat, func(_ ziface.IClient, msg ziface.IMessage) {
+		pong <- string(msg.GetData())
+	})
+	client.SendMsg(MsgIDHeartbeat, []byte("ping"))
+	select {
+	case data := <-pong:
+		if data != "ping" {
+			t.Fatalf("heartbeat reply %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("heartbeat reply timeout")
+	}
+}
+
+func TestClientPoolHeartbeatRateLimit(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	// 每个链接只允许一个消息，心跳使用单独的限制
+	utils.GlobalObject.ConnRateLimit = utils.RateLimit{Rate: 0.001, Burst: 1}
+	utils.GlobalObject.HeartbeatRateLimit = utils.RateLimit{Rate: 1000}
+
+	s := NewServer("pool").(*Server)
+	s.Start()
+	defer s.Stop()
+
+	p := NewClientPool([]string{fmt.Sprintf("127.0.0.1:%d", s.Port)}, "")
+	p.HeartbeatInterval = 20 * time.Millisecond
+	p.HeartbeatTimeout = 100 * time.Millisecond
+	p.Start()
+	defer p.Stop()
+	for deadline := time.Now().Add(3 * time.Second); len(p.Healthy()) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("pool not healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client := p.Healthy()[0]
+
+	// 超过心跳超时的时间之后仍然是同一个健康的链接
+	time.Sleep(300 * time.Millisecond)
+	if healthy := p.Healthy(); len(healthy) != 1 || healthy[0] != client {
+		t.Fatal("healthy server evicted by rate limit")
+	}
+}
+
+func TestClientPoolPickWhileSending(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.HeartbeatRateLimit = utils.RateLimit{Rate: 1000}
+
+	s := NewServer("pool").(*Server)
+	s.Start()
+	defer s.Stop()
+
+	p := NewClientPool([]string{fmt.Sprintf("127.0.0.1:%d", s.Port)}, "")
+	p.HeartbeatInterval = 20 * time.Millisecond
+	p.Start()
+	defer p.Stop()
+	for deadline := time.Now().Add(3 * time.Second); len(p.Healthy()) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("pool not healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 模拟写入阻塞的客户端：持有客户端的锁时 Pick 不等待
+	client := p.Healthy()[0].(*Client)
+	client.lock.Lock()
+	picked := make(chan error, 1)
+	go func() {
+		_, done, err := p.Pick("")
+		if err == nil {
+			done()
+		}
+		picked <- err
+	}()
+	select {
+	case err := <-picked:
+		client.lock.Unlock()
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+	case <-time.After(time.Second):
+		client.lock.Unlock()
+		<-picked
+		t.Fatal("pick blocked by client lock")
+	}
+}
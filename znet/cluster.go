@@ -0,0 +1,456 @@
+package znet
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+const (
+	// 与其它节点的链接断开后重新链接的间隔
+	clusterRedialInterval = time.Second
+	// 发往每个节点的消息队列长度，队列满时认为节点卡住，断开后重新链接并同步用户目录
+	clusterSendQueueLen = 1024
+)
+
+var (
+	// ErrUserNotFound 用户在所有节点上都没有链接
+	ErrUserNotFound = errors.New("user NOT FOUND")
+
+	// ErrClusterSecretRequired 开启集群时必须设置节点之间的密钥
+	ErrClusterSecretRequired = errors.New("ClusterSecret is required when ClusterNodeID is set")
+)
+
+// Cluster 集群模块，节点之间两两建立内部链接，同步用户目录，并将发给其它节点上用户的消息转发过去
+// 每个节点主动链接其它所有节点，通过自己建立的链接发送，通过其它节点建立的链接接收
+type Cluster struct {
+	server *Server
+	nodeID string
+	secret string
+	nodes  map[string]string
+
+	lock sync.RWMutex
+	// 主动建立的到其它节点的链接
+	peers map[string]*clusterPeer
+	// 其它节点建立的链接，节点 ID 对应链接 ID，链接断开时清除该节点的用户
+	inbound map[string]uint32
+	// 其它节点上的用户，用户 ID 对应所在的节点
+	users map[string]map[string]struct{}
+
+	// 保证用户目录的快照和变化按顺序发送给其它节点
+	syncLock sync.Mutex
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newCluster 按照配置创建集群模块，没有设置密钥时任何人都可以冒充节点，返回错误
+func newCluster(server *Server) (*Cluster, error) {
+	if utils.GlobalObject.ClusterSecret == "" {
+		return nil, ErrClusterSecretRequired
+	}
+	nodes := make(map[string]string)
+	for id, addr := range utils.GlobalObject.ClusterNodes {
+		if id != utils.GlobalObject.ClusterNodeID {
+			nodes[id] = addr
+		}
+	}
+	return &Cluster{
+		server:  server,
+		nodeID:  utils.GlobalObject.ClusterNodeID,
+		secret:  utils.GlobalObject.ClusterSecret,
+		nodes:   nodes,
+		peers:   make(map[string]*clusterPeer),
+		inbound: make(map[string]uint32),
+		users:   make(map[string]map[string]struct{}),
+		exit:    make(chan struct{}),
+	}, nil
+}
+
+// GetNodeID 获取当前节点的 ID
+func (cl *Cluster) GetNodeID() string {
+	return cl.nodeID
+}
+
+// GetUserNodes 获取用户所在的其它节点
+func (cl *Cluster) GetUserNodes(userID string) []string {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	nodes := make([]string, 0, len(cl.users[userID]))
+	for nodeID := range cl.users[userID] {
+		nodes = append(nodes, nodeID)
+	}
+	return nodes
+}
+
+// start 监听本节点用户的上线、下线，并链接其它所有节点
+func (cl *Cluster) start() {
+	cl.server.ConnMgr.(*ConnManager).setOnUser(cl.broadcastUser)
+
+	for nodeID, addr := range cl.nodes {
+		cl.wg.Add(1)
+		go cl.link(nodeID, addr)
+	}
+}
+
+// stop 断开与其它节点的链接
+func (cl *Cluster) stop() {
+	select {
+	case <-cl.exit:
+		return
+	default:
+	}
+	close(cl.exit)
+	cl.wg.Wait()
+}
+
+// link 保持到一个节点的链接，断开后重新链接
+func (cl *Cluster) link(nodeID, addr string) {
+	defer cl.wg.Done()
+
+	for {
+		client := NewClient(addr)
+		disconnected := make(chan struct{})
+		client.SetOnDisconnect(func(ziface.IClient, error) {
+			close(disconnected)
+		})
+
+		if err := client.Start(); err == nil {
+			peer := cl.addPeer(nodeID, client)
+			fmt.Println("[Cluster] linked to node ", nodeID)
+
+			exit := false
+			select {
+			case <-disconnected:
+				fmt.Println("[Cluster] lost node ", nodeID)
+			case <-cl.exit:
+				exit = true
+			}
+			cl.lock.Lock()
+			if cl.peers[nodeID] == peer {
+				delete(cl.peers, nodeID)
+			}
+			cl.lock.Unlock()
+			peer.close()
+			client.Stop()
+			if exit {
+				return
+			}
+		}
+
+		select {
+		case <-time.After(clusterRedialInterval):
+		case <-cl.exit:
+			return
+		}
+	}
+}
+
+// addPeer 开始通过新的链接向节点发送消息，先发送身份和本节点用户目录的快照
+// 快照和加入 peers 在 syncLock 中完成，之后的用户变化一定排在快照之后
+func (cl *Cluster) addPeer(nodeID string, client *Client) *clusterPeer {
+	hello := make([]byte, 2, 2+len(cl.nodeID)+len(cl.secret))
+	binary.LittleEndian.PutUint16(hello, uint16(len(cl.nodeID)))
+	hello = append(hello, cl.nodeID...)
+	hello = append(hello, cl.secret...)
+
+	peer := &clusterPeer{
+		nodeID: nodeID,
+		client: client,
+		queue:  make(chan queuedMsg, clusterSendQueueLen),
+		done:   make(chan struct{}),
+	}
+
+	cl.syncLock.Lock()
+	users := cl.server.ConnMgr.(*ConnManager).Users()
+	cl.lock.Lock()
+	cl.peers[nodeID] = peer
+	cl.lock.Unlock()
+	cl.syncLock.Unlock()
+
+	go peer.run(hello, users)
+	return peer
+}
+
+// broadcastUser 本节点的用户上线、下线时通知其它节点
+func (cl *Cluster) broadcastUser(userID string, online bool) {
+	cl.syncLock.Lock()
+	defer cl.syncLock.Unlock()
+
+	data := encodeClusterUser(userID, online)
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	for _, peer := range cl.peers {
+		peer.send(MsgIDClusterUser, data)
+	}
+}
+
+// forward 将消息转发到用户所在的其它节点，返回是否至少转发到一个节点
+func (cl *Cluster) forward(userID string, msgID uint32, data []byte) bool {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	if len(cl.users[userID]) == 0 {
+		return false
+	}
+
+	msg := make([]byte, 6, 6+len(userID)+len(data))
+	binary.LittleEndian.PutUint32(msg, msgID)
+	binary.LittleEndian.PutUint16(msg[4:], uint16(len(userID)))
+	msg = append(msg, userID...)
+	msg = append(msg, data...)
+
+	sent := false
+	for nodeID := range cl.users[userID] {
+		if peer, ok := cl.peers[nodeID]; ok && peer.send(MsgIDClusterForward, msg) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// queuedMsg 等待发送的消息，集群和网关的链接都先放入队列再由单独的 Goroutine 发送
+type queuedMsg struct {
+	msgID uint32
+	data  []byte
+}
+
+// clusterPeer 主动建立的到一个节点的链接，消息先进入队列，由单独的协程发送
+// 集群的锁中只会把消息放入队列，不会因为节点不读取而阻塞本节点的链接
+type clusterPeer struct {
+	nodeID string
+	client *Client
+	queue  chan queuedMsg
+	// 链接不再使用或者队列已满时关闭
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// run 发送身份、用户目录的快照以及队列中的消息，发送失败时断开链接
+func (p *clusterPeer) run(hello []byte, users []string) {
+	fail := func(err error) {
+		fmt.Println("[Cluster] send to node ", p.nodeID, " error ", err)
+		p.close()
+		p.client.Stop()
+	}
+
+	if err := p.client.SendMsg(MsgIDClusterHello, hello); err != nil {
+		fail(err)
+		return
+	}
+	for _, userID := range users {
+		if err := p.client.SendMsg(MsgIDClusterUser, encodeClusterUser(userID, true)); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case msg := <-p.queue:
+			if err := p.client.SendMsg(msg.msgID, msg.data); err != nil {
+				fail(err)
+				return
+			}
+		case <-p.done:
+			// 队列满时关闭，断开链接，重新链接后重新同步用户目录
+			p.client.Stop()
+			return
+		}
+	}
+}
+
+// send 将消息放入队列，不会阻塞，队列已满时断开链接并返回 false
+func (p *clusterPeer) send(msgID uint32, data []byte) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	select {
+	case p.queue <- queuedMsg{msgID: msgID, data: data}:
+		return true
+	default:
+		fmt.Println("[Cluster] send queue of node ", p.nodeID, " is full")
+		p.close()
+		return false
+	}
+}
+
+// close 停止发送
+func (p *clusterPeer) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// encodeClusterUser 生成用户上线、下线消息的内容
+func encodeClusterUser(userID string, online bool) []byte {
+	data := make([]byte, 1, 1+len(userID))
+	if online {
+		data[0] = 1
+	}
+	return append(data, userID...)
+}
+
+// accept 校验其它节点建立的链接，成功时返回节点 ID
+func (cl *Cluster) accept(data []byte, connID uint32) (string, bool) {
+	if len(data) < 2 {
+		return "", false
+	}
+	idLen := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+idLen {
+		return "", false
+	}
+	nodeID, secret := string(data[2:2+idLen]), data[2+idLen:]
+	if _, ok := cl.nodes[nodeID]; !ok || cl.secret == "" || subtle.ConstantTimeCompare(secret, []byte(cl.secret)) != 1 {
+		return "", false
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	// 节点重新链接，之前的用户目录会随快照重新同步
+	cl.dropUsers(nodeID)
+	cl.inbound[nodeID] = connID
+
+	return nodeID, true
+}
+
+// dropUsers 清除节点上的所有用户，调用方需持有写锁
+func (cl *Cluster) dropUsers(nodeID string) {
+	for userID, nodes := range cl.users {
+		delete(nodes, nodeID)
+		if len(nodes) == 0 {
+			delete(cl.users, userID)
+		}
+	}
+}
+
+// nodeDown 其它节点建立的链接断开时清除该节点的用户
+func (cl *Cluster) nodeDown(nodeID string, connID uint32) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if cl.inbound[nodeID] != connID {
+		// 节点已经重新链接
+		return
+	}
+	delete(cl.inbound, nodeID)
+	cl.dropUsers(nodeID)
+}
+
+// updateUser 更新其它节点上用户的上线、下线
+func (cl *Cluster) updateUser(nodeID string, data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	userID := string(data[1:])
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	nodes, ok := cl.users[userID]
+	if data[0] == 0 {
+		if ok {
+			delete(nodes, nodeID)
+			if len(nodes) == 0 {
+				delete(cl.users, userID)
+			}
+		}
+		return
+	}
+	if !ok {
+		nodes = make(map[string]struct{})
+		cl.users[userID] = nodes
+	}
+	nodes[nodeID] = struct{}{}
+}
+
+// deliver 将其它节点转发的消息发送给本节点上用户的链接，不再继续转发
+func (cl *Cluster) deliver(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	msgID := binary.LittleEndian.Uint32(data)
+	idLen := int(binary.LittleEndian.Uint16(data[4:]))
+	if len(data) < 6+idLen {
+		return
+	}
+	userID := string(data[6 : 6+idLen])
+	// 消息内容在读取时使用池化的缓冲，发送之前复制一份
+	payload := append([]byte(nil), data[6+idLen:]...)
+
+	for _, conn := range cl.server.ConnMgr.GetByUser(userID) {
+		conn.SendMsg(msgID, payload)
+	}
+}
+
+// clusterProvider 提供集群模块的 Server
+type clusterProvider interface {
+	clusterMgr() *Cluster
+}
+
+// handleCluster 处理其它节点发送的集群消息，返回 false 表示该消息不是集群消息
+func (c *Connection) handleCluster(msg ziface.IMessage) bool {
+	msgID := msg.GetMsgID()
+	if msgID < MsgIDClusterHello || msgID > MsgIDClusterForward {
+		return false
+	}
+	provider, ok := c.TCPServer.(clusterProvider)
+	if !ok || provider.clusterMgr() == nil {
+		return false
+	}
+	cl := provider.clusterMgr()
+
+	if msgID == MsgIDClusterHello {
+		nodeID, ok := cl.accept(msg.GetData(), c.ConnID)
+		if !ok {
+			fmt.Println("ConnID=", c.ConnID, " cluster hello rejected")
+			c.Conn.Close()
+			return true
+		}
+		c.setPeerNode(nodeID)
+		// 节点之间的链接不需要认证
+		if c.authTimer != nil {
+			c.authTimer.Stop()
+		}
+		return true
+	}
+
+	nodeID := c.getPeerNode()
+	if nodeID == "" {
+		fmt.Println("ConnID=", c.ConnID, " cluster msg from non-cluster connection dropped")
+		return true
+	}
+	switch msgID {
+	case MsgIDClusterUser:
+		cl.updateUser(nodeID, msg.GetData())
+	case MsgIDClusterForward:
+		cl.deliver(msg.GetData())
+	}
+	return true
+}
+
+// getPeerNode 获取链接对应的集群节点 ID
+func (c *Connection) getPeerNode() string {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	return c.peerNode
+}
+
+// setPeerNode 设置链接对应的集群节点 ID
+func (c *Connection) setPeerNode(nodeID string) {
+	c.propertyLock.Lock()
+	defer c.propertyLock.Unlock()
+
+	c.peerNode = nodeID
+}
@@ -0,0 +1,187 @@
+package znet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestClusterSendMsgToUser(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.ClusterSecret = "cluster-secret"
+	utils.GlobalObject.ClusterNodes = map[string]string{}
+	ports := map[string]int{}
+	for _, nodeID := range []string{"n1", "n2", "n3"} {
+		ports[nodeID] = freePort(t)
+		utils.GlobalObject.ClusterNodes[nodeID] = fmt.Sprintf("127.0.0.1:%d", ports[nodeID])
+	}
+
+	// 三个节点，认证时 Token 即用户 ID，MsgID 1 将消息转发给 Data 中的用户
+	servers := map[string]*Server{}
+	for _, nodeID := range []string{"n1", "n2", "n3"} {
+		utils.GlobalObject.TCPPort = ports[nodeID]
+		utils.GlobalObject.ClusterNodeID = nodeID
+		s := NewServer(nodeID).(*Server)
+		s.SetAuthenticator(func(conn ziface.IConnection, token []byte) (*ziface.Identity, error) {
+			return &ziface.Identity{UserID: string(token)}, nil
+		})
+		s.AddHandlerFunc(1, func(request ziface.IRequest) {
+			from := request.GetConnection().GetIdentity().UserID
+			request.GetConnection().GetTCPServer().SendMsgToUser(string(request.GetData()), 2, []byte("from "+from))
+		})
+		s.Start()
+		servers[nodeID] = s
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	alice := loginTest(t, ports["n1"], "alice")
+	defer alice.Close()
+	bob := loginTest(t, ports["n3"], "bob")
+	defer bob.Close()
+
+	// 用户目录同步到其它节点
+	waitFor("directory", func() bool {
+		return len(servers["n3"].GetCluster().GetUserNodes("alice")) == 1 &&
+			len(servers["n2"].GetCluster().GetUserNodes("alice")) == 1 &&
+			len(servers["n1"].GetCluster().GetUserNodes("bob")) == 1
+	})
+
+	// n3 上的 bob 发给 n1 上的 alice，以及反方向
+	sendTestMsg(bob, 1, []byte("alice"))
+	if msg := readTestMsg(t, alice); msg.ID != 2 || string(msg.Data) != "from bob" {
+		t.Fatalf("alice got id=%d data=%s", msg.ID, msg.Data)
+	}
+	sendTestMsg(alice, 1, []byte("bob"))
+	if msg := readTestMsg(t, bob); msg.ID != 2 || string(msg.Data) != "from alice" {
+		t.Fatalf("bob got id=%d data=%s", msg.ID, msg.Data)
+	}
+
+	// 不在任何节点上的用户
+	if err := servers["n2"].SendMsgToUser("carol", 2, nil); err != ErrUserNotFound {
+		t.Fatalf("send to unknown user err=%v", err)
+	}
+
+	// 密钥错误的节点链接被关闭
+	fake := dialTest(t, ports["n2"])
+	sendTestMsg(fake, MsgIDClusterHello, []byte("\x02\x00n1wrong"))
+	fake.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := fake.Read(make([]byte, 1)); err == nil {
+		t.Fatal("fake node not closed")
+	}
+	fake.Close()
+
+	// alice 下线后其它节点不再转发
+	alice.Close()
+	waitFor("alice offline", func() bool {
+		return servers["n2"].SendMsgToUser("alice", 2, nil) == ErrUserNotFound
+	})
+}
+
+func TestClusterSecretRequired(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.ClusterNodeID = "n1"
+	utils.GlobalObject.ClusterNodes = map[string]string{"n2": "127.0.0.1:1"}
+	utils.GlobalObject.ClusterSecret = ""
+
+	func() {
+		defer func() {
+			if err := recover(); err != ErrClusterSecretRequired {
+				t.Fatalf("NewServer without secret recover=%v", err)
+			}
+		}()
+		NewServer("n1")
+	}()
+
+	// 即使没有经过 NewServer 的校验，空的密钥也不能通过
+	cl := &Cluster{nodes: map[string]string{"n2": "127.0.0.1:1"}, inbound: map[string]uint32{}, users: map[string]map[string]struct{}{}}
+	if _, ok := cl.accept([]byte("\x02\x00n2"), 1); ok {
+		t.Fatal("empty secret accepted")
+	}
+}
+
+func TestClusterPeerQueueFull(t *testing.T) {
+	// 节点不读取时消息留在队列中，队列满时不阻塞发送方，而是放弃这个链接
+	peer := &clusterPeer{nodeID: "n2", client: NewClient("127.0.0.1:1"), queue: make(chan queuedMsg, 1), done: make(chan struct{})}
+	if !peer.send(MsgIDClusterUser, encodeClusterUser("alice", true)) {
+		t.Fatal("first send failed")
+	}
+	if peer.send(MsgIDClusterUser, encodeClusterUser("bob", true)) {
+		t.Fatal("send to full queue succeeded")
+	}
+	select {
+	case <-peer.done:
+	default:
+		t.Fatal("peer not closed when queue is full")
+	}
+}
+
+func TestConnManagerUserEventsOrder(t *testing.T) {
+	cm := NewConnManager()
+	var lock sync.Mutex
+	online := false
+	cm.setOnUser(func(userID string, on bool) {
+		// 放大上线事件从修改目录到通知之间的间隔
+		if on {
+			time.Sleep(time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if on == online {
+			t.Errorf("duplicated event online=%v", on)
+		}
+		online = on
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 同一个用户的链接同时认证和断开，事件的顺序与用户目录一致
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		c := &Connection{ConnID: uint32(i), Conn: conn.(*net.TCPConn)}
+		cm.Add(c)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cm.BindUser("alice", c)
+		}()
+		go func() {
+			defer wg.Done()
+			cm.Remove(c)
+		}()
+	}
+	wg.Wait()
+
+	if online || len(cm.Users()) != 0 {
+		t.Fatalf("online=%v users=%v after all connections removed", online, cm.Users())
+	}
+}
@@ -0,0 +1,197 @@
+package znet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+	"github.com/golang/snappy"
+)
+
+var (
+	// compressors 按编号注册的压缩算法
+	compressors = map[uint8]ziface.ICompressor{}
+	// 保护 compressors 的读写锁
+	compressorsLock sync.RWMutex
+)
+
+func init() {
+	RegisterCompressor(NewGzipCompressor())
+	RegisterCompressor(NewSnappyCompressor())
+}
+
+// RegisterCompressor 注册一个压缩算法，收发两端需要注册相同编号的算法
+func RegisterCompressor(compressor ziface.ICompressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+
+	compressors[compressor.ID()] = compressor
+}
+
+// GetCompressorByName 根据名称获取已注册的压缩算法
+func GetCompressorByName(name string) (ziface.ICompressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+
+	for _, compressor := range compressors {
+		if compressor.Name() == name {
+			return compressor, nil
+		}
+	}
+	return nil, fmt.Errorf("compressor %s NOT FOUND", name)
+}
+
+// getCompressor 根据编号获取已注册的压缩算法
+func getCompressor(id uint8) (ziface.ICompressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+
+	if compressor, ok := compressors[id]; ok {
+		return compressor, nil
+	}
+	return nil, fmt.Errorf("compressor id=%d NOT FOUND", id)
+}
+
+// compressMsg 消息内容达到 CompressThreshold 时使用配置的算法压缩，并设置 FlagCompressed
+// 压缩后的内容 |CompressorID(1)|CompressedData|，压缩后没有变小时保持原样发送
+func compressMsg(msg ziface.IMessage) error {
+	if utils.GlobalObject.Compression == "" || msg.GetDataLen() < utils.GlobalObject.CompressThreshold {
+		return nil
+	}
+
+	compressor, err := GetCompressorByName(utils.GlobalObject.Compression)
+	if err != nil {
+		return err
+	}
+	compressed, err := compressor.Compress(msg.GetData())
+	if err != nil {
+		return err
+	}
+	if len(compressed)+1 >= len(msg.GetData()) {
+		return nil
+	}
+
+	msg.SetData(append([]byte{compressor.ID()}, compressed...))
+	msg.SetDataLen(uint32(len(msg.GetData())))
+	msg.SetFlags(msg.GetFlags() | FlagCompressed)
+
+	return nil
+}
+
+// decompressMsg 解压设置了 FlagCompressed 的消息，解压后的长度不能超过 MaxPackageSize
+func decompressMsg(msg ziface.IMessage) error {
+	if msg.GetFlags()&FlagCompressed == 0 {
+		return nil
+	}
+	if msg.GetDataLen() == 0 {
+		return fmt.Errorf("%s", "compressed msg without compressor id")
+	}
+
+	compressor, err := getCompressor(msg.GetData()[0])
+	if err != nil {
+		return err
+	}
+	maxSize := utils.GlobalObject.MaxPackageSize
+	if maxSize == 0 {
+		maxSize = dataLenMask
+	}
+	data, err := compressor.Decompress(msg.GetData()[1:], maxSize)
+	if err != nil {
+		return err
+	}
+
+	msg.SetData(data)
+	msg.SetDataLen(uint32(len(data)))
+	msg.SetFlags(msg.GetFlags() &^ FlagCompressed)
+
+	return nil
+}
+
+// GzipCompressor 基于 compress/gzip 的压缩算法
+type GzipCompressor struct{}
+
+// NewGzipCompressor 创建一个 gzip 压缩算法
+func NewGzipCompressor() *GzipCompressor {
+	return &GzipCompressor{}
+}
+
+// ID 压缩算法的编号
+func (c *GzipCompressor) ID() uint8 {
+	return 1
+}
+
+// Name 压缩算法的名称
+func (c *GzipCompressor) Name() string {
+	return "gzip"
+}
+
+// Compress 压缩数据
+func (c *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress 解压数据，最多读取 maxSize+1 个字节来判断是否超出限制
+func (c *GzipCompressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > maxSize {
+		return nil, fmt.Errorf("%s", "too large decompressed message data !!!")
+	}
+	return out, nil
+}
+
+// SnappyCompressor 基于 snappy 块格式的压缩算法，压缩率较低但速度很快
+type SnappyCompressor struct{}
+
+// NewSnappyCompressor 创建一个 snappy 压缩算法
+func NewSnappyCompressor() *SnappyCompressor {
+	return &SnappyCompressor{}
+}
+
+// ID 压缩算法的编号
+func (c *SnappyCompressor) ID() uint8 {
+	return 2
+}
+
+// Name 压缩算法的名称
+func (c *SnappyCompressor) Name() string {
+	return "snappy"
+}
+
+// Compress 压缩数据
+func (c *SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Decompress 解压数据，snappy 块头部记录了解压后的长度，先检查长度再解压
+func (c *SnappyCompressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || uint64(n) > uint64(maxSize) {
+		return nil, fmt.Errorf("%s", "too large decompressed message data !!!")
+	}
+	return snappy.Decode(nil, data)
+}
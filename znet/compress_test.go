@@ -0,0 +1,87 @@
+package znet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/646222472/zinx/utils"
+)
+
+func TestCompressMsg(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.CompressThreshold = 64
+	utils.GlobalObject.MaxPackageSize = 4096
+
+	data := bytes.Repeat([]byte("zinx"), 512)
+	for _, name := range []string{"gzip", "snappy"} {
+		utils.GlobalObject.Compression = name
+
+		msg := NewMessage(1, data)
+		if err := compressMsg(msg); err != nil {
+			t.Fatalf("%s compress: %v", name, err)
+		}
+		if msg.GetFlags()&FlagCompressed == 0 || msg.GetDataLen() >= uint32(len(data)) {
+			t.Fatalf("%s: msg not compressed, len=%d", name, msg.GetDataLen())
+		}
+
+		// 经过封包、拆包后标志位保持不变
+		dp := NewDataPack()
+		binaryData, err := dp.Pack(msg)
+		if err != nil {
+			t.Fatalf("%s pack: %v", name, err)
+		}
+		head, err := dp.UnPack(binaryData[:dp.GetHeadLen()])
+		if err != nil {
+			t.Fatalf("%s unpack: %v", name, err)
+		}
+		if head.GetFlags() != FlagCompressed || head.GetDataLen() != msg.GetDataLen() {
+			t.Fatalf("%s: head flags=%d len=%d", name, head.GetFlags(), head.GetDataLen())
+		}
+		head.SetData(binaryData[dp.GetHeadLen():])
+
+		if err := decompressMsg(head); err != nil {
+			t.Fatalf("%s decompress: %v", name, err)
+		}
+		if !bytes.Equal(head.GetData(), data) || head.GetFlags() != 0 {
+			t.Fatalf("%s: decompressed data mismatch", name)
+		}
+
+		// 解压后超过 MaxPackageSize 的消息被拒绝
+		bomb := NewMessage(1, bytes.Repeat([]byte{0}, 64*1024))
+		utils.GlobalObject.MaxPackageSize = 0
+		if err := compressMsg(bomb); err != nil {
+			t.Fatalf("%s compress bomb: %v", name, err)
+		}
+		utils.GlobalObject.MaxPackageSize = 4096
+		if err := decompressMsg(bomb); err == nil {
+			t.Fatalf("%s: decompression bomb should be rejected", name)
+		}
+	}
+}
+
+func TestDataPackUnknownFlags(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Checksum = false
+
+	dp := NewDataPack()
+	head := func(flags uint8) []byte {
+		data := make([]byte, dp.GetHeadLen())
+		binary.LittleEndian.PutUint32(data, uint32(flags)<<flagsShift|4)
+		binary.LittleEndian.PutUint32(data[4:], 1)
+		return data
+	}
+
+	msg, err := dp.UnPack(head(FlagCompressed | FlagFragment))
+	if err != nil || msg.GetFlags() != FlagCompressed|FlagFragment || msg.GetDataLen() != 4 {
+		t.Fatalf("known flags: msg=%v err=%v", msg, err)
+	}
+	// 保留的最高位，以及未开启校验时的校验标志位
+	for _, flags := range []uint8{1 << 4, FlagChecksum} {
+		if _, err := dp.UnPack(head(flags)); err != ErrUnknownFlags {
+			t.Fatalf("flags %b err = %v, want ErrUnknownFlags", flags, err)
+		}
+	}
+}
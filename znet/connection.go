@@ -1,15 +1,26 @@
 package znet
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/646222472/zinx/utils"
 	"github.com/646222472/zinx/ziface"
 )
 
+var (
+	// ErrConnClosed 链接已经关闭
+	ErrConnClosed = errors.New("connection closed")
+
+	// ErrPropertyNotFound 链接属性不存在
+	ErrPropertyNotFound = errors.New("property NOT FOUND")
+)
+
 // Connection 链接模块
 type Connection struct {
 	// 当前 Conn 隶属于哪个 Server
@@ -20,16 +31,58 @@ type Connection struct {
 	ConnID uint32
 	// 当前链接的状态
 	isClosed bool
+	// 保护链接的状态，其它 Goroutine（如向用户发送消息）也会检查链接是否已经关闭
+	closeLock sync.Mutex
 	// 告知当前链接已经停止/退出 channel （由 Reader 告知 Writer 退出）
 	ExitChan chan bool
-	// 无缓冲的管道，用于 Goroutine 之间的消息通信
-	msgChan chan []byte
+	// 无缓冲的管道，用于 Goroutine 之间的消息通信，传递的是池化的缓冲，由 Writer 写完后放回缓冲池
+	msgChan chan *[]byte
 	// 消息管理 MsgID 和对应的处理业务 API 关系
 	MsgHandler ziface.IMsgHandler
 	// 链接属性集合
 	property map[string]interface{}
 	// 保护链接属性的修改锁
 	propertyLock sync.RWMutex
+	// 链接属性变化的观察者
+	propertyObservers map[string][]ziface.PropertyObserver
+	// 链接的 Context，链接关闭时取消，请求的 Context 都派生自它
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 加密握手后的加密状态，未加密时为 nil
+	cipher *cipherState
+	// 加密握手阶段读到的第一个明文消息，由 Reader 优先处理
+	pendingMsg ziface.IMessage
+	// 保证消息按加密的顺序进入发送队列
+	sendLock sync.Mutex
+	// 发送分片消息时使用的分片流编号
+	streamID uint32
+	// 分片消息的重组模块
+	fragments *reassembler
+	// 封包，拆包的模块
+	dp *DataPack
+	// Reader 读取包头使用的缓冲，每个消息都复用
+	headBuf []byte
+	// 消息的限流模块，没有配置限流时为 nil
+	limiter *rateLimiter
+	// 心跳的令牌桶，未设置心跳限流时为 nil
+	heartbeat *tokenBucket
+	// 链接认证的配置，未开启认证时为 nil
+	auth *authConfig
+	// 认证超时的定时器
+	authTimer *time.Timer
+	// 认证通过后的身份
+	identity *ziface.Identity
+	// Writer 退出时关闭，未启动 Writer 时为 nil
+	writerDone chan struct{}
+	// 链接的会话，未开启会话时为 nil
+	session  *Session
+	sessions *SessionManager
+	// 未开启会话时等待客户端确认的可靠消息
+	reliable *reliableBuffer
+	// 其它集群节点建立的链接对应的节点 ID，普通链接为空
+	peerNode string
+	// 网关建立的链接转发的客户端链接，普通链接为 nil
+	gatewayPeer *gatewayPeer
 }
 
 // NewConnection 初始化链接模块的方法
@@ -40,11 +93,22 @@ func NewConnection(tcpServer ziface.IServer, conn *net.TCPConn, connID uint32, m
 		ConnID:       connID,
 		isClosed:     false,
 		ExitChan:     make(chan bool, 1),
-		msgChan:      make(chan []byte),
+		msgChan:      make(chan *[]byte),
 		MsgHandler:   msgHandler,
 		property:     make(map[string]interface{}),
 		propertyLock: sync.RWMutex{},
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.fragments = newReassembler(c)
+	c.dp = NewDataPack()
+	c.headBuf = make([]byte, c.dp.GetHeadLen())
+	var ips *ipBuckets
+	if provider, ok := tcpServer.(rateLimitProvider); ok {
+		ips = provider.ipRateBuckets()
+	}
+	c.limiter = newRateLimiter(ips, conn.RemoteAddr())
+	c.heartbeat = newHeartbeatBucket()
+	c.reliable = newReliableBuffer()
 
 	// 将 conn 加入到 ConnManager 中
 	c.TCPServer.GetConnMgr().Add(c)
@@ -58,52 +122,236 @@ func (c *Connection) StartReader() {
 
 	defer fmt.Println("connID=", c.ConnID, " 【Reader is exit, remote addr is】 ", c.RemoteAddr().String())
 	defer c.Stop()
+	// 中止还没有接收完毕的分片消息
+	defer c.fragments.abortAll(ErrConnClosed)
 
 	for {
-		// 创建一个拆包、解包对象
-		dp := NewDataPack()
-
-		// 读取客户端的 Msg Head 二进制流 8个字节
-		headData := make([]byte, dp.GetHeadLen())
-		if _, err := io.ReadFull(c.GetTCPConnection(), headData); err != nil {
-			fmt.Println("read msg head error ", err)
+		// 读取一个完整的消息
+		msg, err := c.readMsg()
+		if err != nil {
+			fmt.Println(err)
+			// 只是消息内容损坏时，可以按配置丢弃该消息继续读取
+			// 加密的链接上丢弃的消息没有解密，接收序号无法继续对齐，总是关闭链接
+			if err == ErrDataChecksum && utils.GlobalObject.ChecksumFailAction == ChecksumFailDrop && c.cipher == nil {
+				continue
+			}
 			break
 		}
 
-		// 拆包，得到 msgID 和 msgDataLen 放在 msg 消息中
-		msg, err := dp.UnPack(headData)
-		if err != nil {
-			fmt.Println("unpack error", err)
-			break
+		// 集群和网关的内部消息在处理之前重组，业务消息的分片在认证之后才处理
+		if msg.GetFlags()&FlagFragment != 0 && isInternalMsg(msg.GetMsgID()) {
+			if msg, err = c.fragments.assemble(msg); err != nil {
+				fmt.Println("fragment error ", err)
+				break
+			}
+			if msg == nil {
+				continue
+			}
 		}
 
-		// 根据 datalen 再次读取 Data， 放在 msg.Data 中
-		var data []byte
-		if msg.GetDataLen() > 0 {
-			data = make([]byte, msg.GetDataLen())
-			_, err := io.ReadFull(c.GetTCPConnection(), data)
-			if err != nil {
-				fmt.Println("read msg data error ", err)
+		// 其它集群节点发送的消息，不受限流和认证的限制
+		if c.handleCluster(msg) {
+			releaseMsg(msg)
+			continue
+		}
+
+		// 网关发送的消息，转发的消息已经在网关上经过限流和认证
+		if c.handleGateway(msg) {
+			continue
+		}
+
+		// 心跳不受速率限制，避免健康的服务端因为限流被客户端的链接池驱逐
+		if c.handleHeartbeat(msg) {
+			releaseMsg(msg)
+			continue
+		}
+
+		// 超出速率限制的消息按配置丢弃、延迟处理或关闭链接
+		pass, closeConn := c.rateLimit(msg.GetMsgID())
+		if !pass {
+			releaseMsg(msg)
+			if closeConn {
 				break
 			}
+			continue
+		}
+
+		// 恢复会话和确认可靠消息的消息，恢复的会话已经通过认证时不再需要认证
+		if c.handleResume(msg) || c.handleAck(msg) {
+			releaseMsg(msg)
+			continue
 		}
-		msg.SetData(data)
 
-		// 得到当前conn数据的Request请求数据
-		req := Request{
-			conn: c,
-			msg:  msg,
+		// 认证通过之前只处理认证消息和白名单中的 MsgID
+		if pass, closeConn := c.authenticate(msg); !pass {
+			releaseMsg(msg)
+			if closeConn {
+				break
+			}
+			continue
 		}
 
+		// 得到当前conn数据的Request请求数据，分片消息在重组后（或流式处理时每个分片）才生成请求
+		if msg.GetFlags()&FlagFragment != 0 {
+			if err := c.fragments.handle(msg, c.MsgHandler.IsStream(msg.GetMsgID())); err != nil {
+				fmt.Println("fragment error ", err)
+				break
+			}
+		} else if !c.dispatch(&Request{conn: c, msg: msg}) {
+			return
+		}
+
+		// 工作池积压过多时暂停读取 socket，由 TCP 流控向客户端施加背压
 		if utils.GlobalObject.WorkerPoolSize > 0 {
-			// 已经开启了工作池机制，将消息发送给 Worker 工作池处理即可
-			c.MsgHandler.SendMsgToTaskQueue(&req)
-		} else {
-			// 从路由中，找到注册绑定的Conn对应的router调用
-			// 根据绑定好的 MsgID 找到对应的处理业务的 API 方法
-			go c.MsgHandler.DoMsgHandler(&req)
+			c.MsgHandler.Throttle(c)
+		}
+	}
+}
+
+// dispatch 将请求交给业务处理，返回 false 表示请求被拒绝且链接需要关闭
+func (c *Connection) dispatch(req *Request) bool {
+	if err := c.enqueue(req); err != nil && utils.GlobalObject.RejectPolicy == RejectPolicyClose {
+		return false
+	}
+	return true
+}
+
+// enqueue 将请求交给业务处理，请求被任务队列拒绝时返回 error
+func (c *Connection) enqueue(req *Request) error {
+	if utils.GlobalObject.WorkerPoolSize > 0 {
+		// 已经开启了工作池机制，将消息发送给 Worker 工作池处理即可
+		if err := c.MsgHandler.SendMsgToTaskQueue(req); err != nil {
+			// 被拒绝的请求不会再被处理，回收消息数据的缓冲
+			req.Release()
+			return err
 		}
+		return nil
 	}
+	// 从路由中，找到注册绑定的Conn对应的router调用
+	// 根据绑定好的 MsgID 找到对应的处理业务的 API 方法
+	go c.MsgHandler.DoMsgHandler(req)
+	return nil
+}
+
+// enqueueWait 将请求交给业务处理，任务队列已满时不按照拒绝策略丢弃，而是等待
+// 用于分片消息中止的通知，保证流式处理的业务总能收到 HandleEnd
+func (c *Connection) enqueueWait(req *Request) {
+	if mh, ok := c.MsgHandler.(*MsgHandler); ok && utils.GlobalObject.WorkerPoolSize > 0 {
+		mh.sendToTaskQueue(req, RejectPolicyBlock)
+		return
+	}
+	c.enqueue(req)
+}
+
+// readMsg 读取一个完整的消息，并依次进行解密、解压
+func (c *Connection) readMsg() (ziface.IMessage, error) {
+	// 加密握手阶段读到的第一个明文消息
+	msg := c.pendingMsg
+	c.pendingMsg = nil
+
+	if msg == nil {
+		// 读取客户端的 Msg Head 二进制流 8个字节
+		if _, err := io.ReadFull(c.GetTCPConnection(), c.headBuf); err != nil {
+			return nil, fmt.Errorf("read msg head error %v", err)
+		}
+
+		var err error
+		if msg, err = c.readData(c.headBuf); err != nil {
+			return nil, err
+		}
+	}
+
+	// 解密消息，加密的链接上不接受明文消息，解密在原缓冲中进行
+	if c.cipher != nil {
+		if err := c.cipher.open(msg); err != nil {
+			releaseMsg(msg)
+			return nil, fmt.Errorf("decrypt msg error %v", err)
+		}
+	}
+
+	// 解压缩的消息，解压后的长度同样受 MaxPackageSize 限制
+	if msg.GetFlags()&FlagCompressed != 0 {
+		m := msg.(*Message)
+		err := decompressMsg(msg)
+		// 解压后的内容不再引用读取时的缓冲
+		m.freeBuffer()
+		if err != nil {
+			return nil, fmt.Errorf("decompress msg error %v", err)
+		}
+	}
+
+	return msg, nil
+}
+
+// readData 拆包得到 Head 信息，再根据 DataLen 读取 Data
+func (c *Connection) readData(headData []byte) (ziface.IMessage, error) {
+	// 拆包，得到 msgID 和 msgDataLen 放在 msg 消息中
+	msg, err := c.dp.UnPack(headData)
+	if err != nil {
+		return nil, fmt.Errorf("unpack error %v", err)
+	}
+
+	// 根据 datalen 再次读取 Data， 放在 msg.Data 中，Data 使用池化的缓冲
+	if msg.GetDataLen() > 0 {
+		m := msg.(*Message)
+		m.buf = getBuffer(int(m.DataLen))
+		m.Data = *m.buf
+		if _, err := io.ReadFull(c.GetTCPConnection(), m.Data); err != nil {
+			m.release()
+			return nil, fmt.Errorf("read msg data error %v", err)
+		}
+	}
+
+	// 校验消息内容的完整性
+	if err := c.dp.Verify(msg); err != nil {
+		releaseMsg(msg)
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// handshake 按照配置的加密模式与客户端进行密钥交换
+// optional 模式下客户端第一个消息不是握手消息，或者在超时时间内没有发送任何数据时，链接使用明文
+// 服务端不会先发送任何消息，握手结束之前不启动 Writer、不调用 OnConnStart
+// 等待服务端先发消息的明文客户端要等到 HandshakeTimeout 之后才能收到会话 ID 和 OnConnStart 中发送的消息
+func (c *Connection) handshake() error {
+	mode := utils.GlobalObject.Encryption
+	if mode == EncryptionOff {
+		return nil
+	}
+	cipherID, err := cipherIDByName(utils.GlobalObject.Cipher)
+	if err != nil {
+		return err
+	}
+
+	// 等待客户端的第一个消息
+	c.Conn.SetReadDeadline(time.Now().Add(time.Duration(utils.GlobalObject.HandshakeTimeout) * time.Second))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	if n, err := io.ReadFull(c.Conn, c.headBuf); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && n == 0 && mode == EncryptionOptional {
+			return nil
+		}
+		return fmt.Errorf("read handshake error %v", err)
+	}
+	msg, err := c.readData(c.headBuf)
+	if err != nil {
+		return err
+	}
+
+	if msg.GetMsgID() != MsgIDHandshake {
+		if mode == EncryptionRequired {
+			return fmt.Errorf("%s", "encryption handshake required")
+		}
+		// 明文链接，第一个消息交给 Reader 正常处理
+		c.pendingMsg = msg
+		return nil
+	}
+
+	c.cipher, err = serverHandshake(c.Conn, msg, cipherID)
+	releaseMsg(msg)
+	return err
 }
 
 // StartWriter 写消息的 Goroutine 用户将消息发送客户端，专门发送给客户端消息的模块
@@ -111,18 +359,27 @@ func (c *Connection) StartWriter() {
 	fmt.Println("[Writer Goroutine is running...]")
 
 	defer fmt.Println(c.RemoteAddr(), "[conn write exit!]")
+	if c.writerDone != nil {
+		defer close(c.writerDone)
+	}
 
 	// 不断的阻塞等待 channel 的消息，进行写给客户端
 	for {
 		select {
-		case data := <-c.msgChan:
-			// 有数据写给客户端
-			if _, err := c.Conn.Write(data); err != nil {
+		case bp, ok := <-c.msgChan:
+			if !ok {
+				return
+			}
+			// 有数据写给客户端，写完后将缓冲放回缓冲池
+			_, err := c.Conn.Write(*bp)
+			putBuffer(bp)
+			if err != nil {
 				fmt.Println("Send data error ", err)
 				return
 			}
 		case <-c.ExitChan:
 			// 代表 Reader 已经退出，此时 Writer 也要退出
+			return
 		}
 	}
 }
@@ -130,12 +387,32 @@ func (c *Connection) StartWriter() {
 // Start 启动链接  让当前链接准备开始工作
 func (c *Connection) Start() {
 	fmt.Println("Conn Start() ... ConnID=", c.ConnID)
-	// 启动从当前链接的读数据的业务
-	go c.StartReader()
+	// 按照配置的加密模式进行握手，失败时关闭链接
+	if err := c.handshake(); err != nil {
+		fmt.Println("ConnID=", c.ConnID, " handshake error ", err)
+		c.Stop()
+		return
+	}
 
-	// 启动从当前链接的写数据的业务
+	// Server 停止时其它 Goroutine 可能同时调用 Stop，在 closeLock 中启动认证和 Writer
+	c.closeLock.Lock()
+	if c.isClosed {
+		c.closeLock.Unlock()
+		return
+	}
+	// 开启认证时，等待客户端在超时时间内完成认证
+	c.startAuth()
+	// 启动从当前链接的写数据的业务，Reader 退出时会等待 Writer 退出
+	c.writerDone = make(chan struct{})
+	c.closeLock.Unlock()
 	go c.StartWriter()
 
+	// 开启会话时为链接创建会话，并将会话的 ID 告知客户端
+	c.startSession()
+
+	// 启动从当前链接的读数据的业务
+	go c.StartReader()
+
 	// 按照开发者传递进来的  创建链接之后需要调用的处理业务，执行对应的 hook 函数
 	c.TCPServer.CallOnConnStart(c)
 }
@@ -144,27 +421,66 @@ func (c *Connection) Start() {
 func (c *Connection) Stop() {
 	fmt.Println("Conn Stop() ... ConnID=", c.ConnID)
 	// 如果当前链接已经关闭
+	c.closeLock.Lock()
 	if c.isClosed == true {
+		c.closeLock.Unlock()
 		return
 	}
-
 	c.isClosed = true
+	authTimer, writerDone := c.authTimer, c.writerDone
+	c.closeLock.Unlock()
+
+	// 取消链接的 Context，通知仍在处理中的业务
+	c.cancel()
+
+	if authTimer != nil {
+		authTimer.Stop()
+	}
+
+	// 会话在保留时间内等待新的链接恢复，没有会话时未确认的可靠消息投递失败
+	if session := c.currentSession(); session != nil {
+		c.sessions.detach(session, c)
+	} else {
+		c.reliable.fail(ErrConnClosed)
+	}
+
+	// 其它集群节点建立的链接断开时，该节点上的用户不再可达
+	if nodeID := c.getPeerNode(); nodeID != "" {
+		if provider, ok := c.TCPServer.(clusterProvider); ok {
+			provider.clusterMgr().nodeDown(nodeID, c.ConnID)
+		}
+	}
+
+	// 网关的链接断开时，它转发的客户端链接全部关闭
+	c.closeGatewayConns()
+
+	// 释放远程 IP 共享的令牌桶
+	if c.limiter != nil {
+		c.limiter.close()
+	}
 
 	// 按照开发者传递进来的  销毁链接之前需要执行对应的 hook 函数
 	c.TCPServer.CallOnConnStop(c)
 
+	// 告知 Writer 关闭，等待 Writer 写完已经交给它的消息（如认证失败的回复）再关闭 socket
+	c.ExitChan <- true
+	if writerDone != nil {
+		c.Conn.SetWriteDeadline(time.Now().Add(sysMsgWriteTimeout))
+		<-writerDone
+	}
+
 	// 关闭 Socket 链接
 	c.Conn.Close()
 
-	// 告知 Writer 关闭
-	c.ExitChan <- true
-
-	// 将当前链接从 ConnMgr 中摘除掉
+	// 将当前链接从 ConnMgr 中摘除掉，并通知 Server 有了空闲的位置
 	c.TCPServer.GetConnMgr().Remove(c)
+	if s, ok := c.TCPServer.(interface{ connRemoved(conn *Connection) }); ok {
+		s.connRemoved(c)
+	}
 
 	// 关闭 退出 的channel，回收资源
+	// 发送队列不关闭，其它 Goroutine 可能仍在发送，它们通过链接的 Context 得知链接已经关闭
 	close(c.ExitChan)
-	close(c.msgChan)
 }
 
 // GetTCPConnection 获取当前链接所绑定的socket conn
@@ -177,38 +493,119 @@ func (c *Connection) GetConnID() uint32 {
 	return c.ConnID
 }
 
+// GetTCPServer 获取当前链接隶属的 Server
+func (c *Connection) GetTCPServer() ziface.IServer {
+	return c.TCPServer
+}
+
 // RemoteAddr 获取远程客户端的 TCP状态 IP Port
 func (c *Connection) RemoteAddr() net.Addr {
 	return c.Conn.RemoteAddr()
 }
 
+// Context 获取链接的 Context，链接关闭时被取消
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
 // SendMsg 提供一个 SendMsg 方法，将我们给客户端的消息先进行封包，再进行发送
 func (c *Connection) SendMsg(msgID uint32, data []byte) error {
-	if c.isClosed == true {
+	c.closeLock.Lock()
+	closed := c.isClosed
+	c.closeLock.Unlock()
+	if closed {
 		return fmt.Errorf("%s", "Connection closed when send msg")
 	}
 
-	// 将 Data 进行封包 ｜MsgDataLen ｜ MsgID ｜ Data ｜
-	dp := NewDataPack()
-	binaryData, err := dp.Pack(NewMessage(msgID, data))
+	// 加密的序列号必须与进入发送队列的顺序一致，分片也要连续地进入发送队列
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	// 超过一个包所能承载的消息拆分为多个分片发送
+	if utils.GlobalObject.MaxMessageSize == 0 {
+		return c.sendFrame(NewMessage(msgID, data))
+	}
+	chunkSize, err := maxChunkSize(c.cipher != nil)
 	if err != nil {
-		fmt.Println("Pack error msg id=", msgID)
+		return err
+	}
+	if uint32(len(data)) <= chunkSize {
+		return c.sendFrame(NewMessage(msgID, data))
+	}
+	if uint32(len(data)) > utils.GlobalObject.MaxMessageSize {
+		return fmt.Errorf("%s", "too large message data send !!!")
+	}
+
+	c.streamID++
+	for _, msg := range splitFragments(msgID, c.streamID, data, chunkSize) {
+		if err := c.sendFrame(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendFrame 依次进行压缩、加密、封包，再放入发送队列，调用方需持有 sendLock
+func (c *Connection) sendFrame(msg ziface.IMessage) error {
+	// 消息内容较大时进行压缩
+	if err := compressMsg(msg); err != nil {
+		fmt.Println("Compress error msg id=", msg.GetMsgID(), err)
+		return fmt.Errorf("%s", "Compress error msg")
+	}
+
+	if c.cipher != nil {
+		c.cipher.seal(msg)
+	}
+
+	// 将 Data 封包到池化的缓冲中 ｜MsgDataLen ｜ MsgID ｜ Data ｜
+	bp := getBuffer(int(c.dp.GetHeadLen()) + len(msg.GetData()))
+	if err := c.dp.packTo(*bp, msg); err != nil {
+		putBuffer(bp)
+		fmt.Println("Pack error msg id=", msg.GetMsgID())
 		return fmt.Errorf("%s", "Pack error msg")
 	}
 
-	// 将数据发送给客户端
-	c.msgChan <- binaryData
+	// 将数据发送给客户端，链接关闭后 Writer 不再读取发送队列
+	var done <-chan struct{}
+	if c.ctx != nil {
+		done = c.ctx.Done()
+	}
+	select {
+	case c.msgChan <- bp:
+	case <-done:
+		putBuffer(bp)
+		return ErrConnClosed
+	}
 
 	return nil
 }
 
+// SendObj 使用该 MsgID 对应的序列化器将对象编码后再发送
+func (c *Connection) SendObj(msgID uint32, v interface{}) error {
+	data, err := c.TCPServer.GetMsgSerializer(msgID).Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode msg id=%d error %v", msgID, err)
+	}
+
+	return c.SendMsg(msgID, data)
+}
+
 // SetProPerty 设置链接属性
 func (c *Connection) SetProPerty(key string, value interface{}) {
+	c.setProPerty(c, key, value)
+}
+
+// setProPerty 设置链接属性，owner 为传给观察者的链接
+func (c *Connection) setProPerty(owner ziface.IConnection, key string, value interface{}) {
 	// 使用写保护锁
 	c.propertyLock.Lock()
-	defer c.propertyLock.Unlock()
-
+	old, ok := c.property[key]
 	c.property[key] = value
+	observers := c.propertyObservers[key]
+	c.propertyLock.Unlock()
+
+	c.notifyProPerty(owner, observers, key, old, ok, value)
 }
 
 // GetProPerty 获取链接属性
@@ -219,14 +616,109 @@ func (c *Connection) GetProPerty(key string) (interface{}, error) {
 	if value, ok := c.property[key]; ok {
 		return value, nil
 	}
-	return nil, fmt.Errorf("%s", "property NOT FOUND")
+	return nil, ErrPropertyNotFound
 }
 
 // RemoveProPerty 移除链接属性
 func (c *Connection) RemoveProPerty(key string) {
+	c.removeProPerty(c, key)
+}
+
+// removeProPerty 移除链接属性，owner 为传给观察者的链接
+func (c *Connection) removeProPerty(owner ziface.IConnection, key string) {
 	// 使用写保护锁
+	c.propertyLock.Lock()
+	old, ok := c.property[key]
+	delete(c.property, key)
+	observers := c.propertyObservers[key]
+	c.propertyLock.Unlock()
+
+	if ok {
+		c.notifyProPerty(owner, observers, key, old, true, nil)
+	}
+}
+
+// GetOrSetProPerty 属性存在时返回已有的值，否则设置为 value，loaded 表示属性是否已经存在
+func (c *Connection) GetOrSetProPerty(key string, value interface{}) (actual interface{}, loaded bool) {
+	return c.getOrSetProPerty(c, key, value)
+}
+
+// getOrSetProPerty 属性不存在时设置为 value，owner 为传给观察者的链接
+func (c *Connection) getOrSetProPerty(owner ziface.IConnection, key string, value interface{}) (actual interface{}, loaded bool) {
+	c.propertyLock.Lock()
+	if actual, loaded = c.property[key]; loaded {
+		c.propertyLock.Unlock()
+		return actual, true
+	}
+	c.property[key] = value
+	observers := c.propertyObservers[key]
+	c.propertyLock.Unlock()
+
+	c.notifyProPerty(owner, observers, key, nil, false, value)
+	return value, false
+}
+
+// CompareAndSwapProPerty 属性的当前值等于 old 时替换为 value，值为不可比较的类型时总是失败
+func (c *Connection) CompareAndSwapProPerty(key string, old, value interface{}) bool {
+	return c.compareAndSwapProPerty(c, key, old, value)
+}
+
+// compareAndSwapProPerty 属性的当前值等于 old 时替换为 value，owner 为传给观察者的链接
+func (c *Connection) compareAndSwapProPerty(owner ziface.IConnection, key string, old, value interface{}) bool {
+	c.propertyLock.Lock()
+	if current, ok := c.property[key]; !ok || !sameValue(current, old) {
+		c.propertyLock.Unlock()
+		return false
+	}
+	c.property[key] = value
+	observers := c.propertyObservers[key]
+	c.propertyLock.Unlock()
+
+	c.notifyProPerty(owner, observers, key, old, true, value)
+	return true
+}
+
+// Properties 获取所有链接属性的快照
+func (c *Connection) Properties() map[string]interface{} {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	properties := make(map[string]interface{}, len(c.property))
+	for key, value := range c.property {
+		properties[key] = value
+	}
+	return properties
+}
+
+// ObserveProPerty 注册属性变化的观察者，属性被设置或移除时在修改它的 Goroutine 中调用
+// 观察者在释放属性锁之后调用，可以在其中读写属性，并发修改同一个属性时通知的顺序不保证与修改的顺序一致
+func (c *Connection) ObserveProPerty(key string, observer ziface.PropertyObserver) {
 	c.propertyLock.Lock()
 	defer c.propertyLock.Unlock()
 
-	delete(c.property, key)
+	if c.propertyObservers == nil {
+		c.propertyObservers = make(map[string][]ziface.PropertyObserver)
+	}
+	c.propertyObservers[key] = append(c.propertyObservers[key], observer)
+}
+
+// notifyProPerty 属性变化时通知观察者，值没有变化时不通知
+// owner 为属性所在的链接，网关的虚拟链接嵌入了 Connection，观察者收到的是虚拟链接本身
+func (c *Connection) notifyProPerty(owner ziface.IConnection, observers []ziface.PropertyObserver, key string, old interface{}, existed bool, value interface{}) {
+	if len(observers) == 0 || (existed && sameValue(old, value)) {
+		return
+	}
+	for _, observer := range observers {
+		observer(owner, key, old, value)
+	}
+}
+
+// sameValue 比较两个属性值，不可比较的类型视为不同
+func sameValue(a, b interface{}) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
 }
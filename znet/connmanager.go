@@ -2,6 +2,7 @@ package znet
 
 import (
 	"fmt"
+	"net"
 	"sync"
 
 	"github.com/646222472/zinx/ziface"
@@ -10,13 +11,24 @@ import (
 // ConnManager 实现链接管理模块
 type ConnManager struct {
 	connections map[uint32]ziface.IConnection // 管理的链接集合
+	ipConns     map[string]int                // 每个远程 IP 的链接数
 	connLock    sync.RWMutex                  // 保护链接集合的的读写锁
+
+	users    map[string]map[uint32]ziface.IConnection // 用户 ID 对应的链接，同一个用户可以有多个链接
+	connUser map[uint32]string                        // 链接绑定的用户 ID
+	// 用户的第一个链接绑定、最后一个链接移除时调用，用于同步集群中的用户目录
+	onUser func(userID string, online bool)
+	// 保证用户目录的变化按发生的顺序调用 onUser，同一个用户的上线、下线不会颠倒
+	userLock sync.Mutex
 }
 
 // NewConnManager 初始化当前链接的方法
 func NewConnManager() *ConnManager {
 	return &ConnManager{
 		connections: make(map[uint32]ziface.IConnection),
+		ipConns:     make(map[string]int),
+		users:       make(map[string]map[uint32]ziface.IConnection),
+		connUser:    make(map[uint32]string),
 	}
 }
 
@@ -28,18 +40,112 @@ func (cm *ConnManager) Add(conn ziface.IConnection) {
 
 	// 将 conn 加入 ConnManager 中
 	cm.connections[conn.GetConnID()] = conn
-	fmt.Printf("ConnID=%d add to ConnManager successfully:conn num := %d\n", conn.GetConnID(), cm.Len())
+	cm.ipConns[remoteIP(conn.RemoteAddr())]++
+	fmt.Printf("ConnID=%d add to ConnManager successfully:conn num := %d\n", conn.GetConnID(), len(cm.connections))
 }
 
 // Remove 删除链接
 func (cm *ConnManager) Remove(conn ziface.IConnection) {
+	cm.userLock.Lock()
+	defer cm.userLock.Unlock()
+
 	// 保护共享资源 map， 加写锁
 	cm.connLock.Lock()
-	defer cm.connLock.Unlock()
 
 	// 删除链接信息
-	delete(cm.connections, conn.GetConnID())
-	fmt.Printf("ConnID=%d remove to ConnManager successfully:conn num := %d\n", conn.GetConnID(), cm.Len())
+	if _, ok := cm.connections[conn.GetConnID()]; ok {
+		delete(cm.connections, conn.GetConnID())
+		cm.releaseIP(remoteIP(conn.RemoteAddr()))
+	}
+	userID, offline := cm.unbindUser(conn.GetConnID())
+	fmt.Printf("ConnID=%d remove to ConnManager successfully:conn num := %d\n", conn.GetConnID(), len(cm.connections))
+	onUser := cm.onUser
+	cm.connLock.Unlock()
+
+	if offline && onUser != nil {
+		onUser(userID, false)
+	}
+}
+
+// BindUser 将链接绑定到用户 ID，链接认证通过或恢复会话时调用，链接移除时自动解绑
+func (cm *ConnManager) BindUser(userID string, conn ziface.IConnection) {
+	cm.userLock.Lock()
+	defer cm.userLock.Unlock()
+
+	cm.connLock.Lock()
+
+	if _, ok := cm.connections[conn.GetConnID()]; !ok {
+		// 链接已经移除
+		cm.connLock.Unlock()
+		return
+	}
+	oldUserID, offline := cm.unbindUser(conn.GetConnID())
+	conns, ok := cm.users[userID]
+	if !ok {
+		conns = make(map[uint32]ziface.IConnection)
+		cm.users[userID] = conns
+	}
+	conns[conn.GetConnID()] = conn
+	cm.connUser[conn.GetConnID()] = userID
+	onUser := cm.onUser
+	cm.connLock.Unlock()
+
+	if onUser != nil {
+		if offline {
+			onUser(oldUserID, false)
+		}
+		if !ok {
+			onUser(userID, true)
+		}
+	}
+}
+
+// unbindUser 解绑链接的用户 ID，返回该用户是否已经没有链接，调用方需持有写锁
+func (cm *ConnManager) unbindUser(connID uint32) (string, bool) {
+	userID, ok := cm.connUser[connID]
+	if !ok {
+		return "", false
+	}
+	delete(cm.connUser, connID)
+	conns := cm.users[userID]
+	delete(conns, connID)
+	if len(conns) > 0 {
+		return userID, false
+	}
+	delete(cm.users, userID)
+	return userID, true
+}
+
+// GetByUser 获取用户 ID 绑定的所有链接
+func (cm *ConnManager) GetByUser(userID string) []ziface.IConnection {
+	cm.connLock.RLock()
+	defer cm.connLock.RUnlock()
+
+	conns := make([]ziface.IConnection, 0, len(cm.users[userID]))
+	for _, conn := range cm.users[userID] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Users 获取所有已绑定链接的用户 ID
+func (cm *ConnManager) Users() []string {
+	cm.connLock.RLock()
+	defer cm.connLock.RUnlock()
+
+	users := make([]string, 0, len(cm.users))
+	for userID := range cm.users {
+		users = append(users, userID)
+	}
+	return users
+}
+
+// setOnUser 注册用户上线、下线的回调，回调在 userLock 中按顺序调用，不能阻塞，也不能再绑定或移除链接
+func (cm *ConnManager) setOnUser(hookFunc func(userID string, online bool)) {
+	cm.connLock.Lock()
+	defer cm.connLock.Unlock()
+
+	cm.onUser = hookFunc
 }
 
 // Get 根据链接ID查找链接
@@ -57,21 +163,55 @@ func (cm *ConnManager) Get(connID uint32) (ziface.IConnection, error) {
 
 // Len 获取链接总数
 func (cm *ConnManager) Len() int {
+	cm.connLock.RLock()
+	defer cm.connLock.RUnlock()
+
 	return len(cm.connections)
 }
 
+// LenByIP 获取来自某个远程 IP 的链接数
+func (cm *ConnManager) LenByIP(ip string) int {
+	cm.connLock.RLock()
+	defer cm.connLock.RUnlock()
+
+	return cm.ipConns[ip]
+}
+
+// releaseIP 减少远程 IP 的链接数，调用方需持有写锁
+func (cm *ConnManager) releaseIP(ip string) {
+	if cm.ipConns[ip]--; cm.ipConns[ip] <= 0 {
+		delete(cm.ipConns, ip)
+	}
+}
+
+// remoteIP 获取远程地址中的 IP，没有远程地址时返回空字符串
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 // ClearConn 清除所有的链接
 func (cm *ConnManager) ClearConn() {
-	// 保护共享资源 map， 加写锁
-	cm.connLock.Lock()
-	defer cm.connLock.Unlock()
+	// 复制一份链接列表之后释放锁，链接 Stop 时会调用 Remove 将自己从 ConnMgr 中摘除
+	cm.connLock.RLock()
+	conns := make([]ziface.IConnection, 0, len(cm.connections))
+	for _, conn := range cm.connections {
+		conns = append(conns, conn)
+	}
+	cm.connLock.RUnlock()
 
-	for connID, conn := range cm.connections {
+	for _, conn := range conns {
 		// 停止
 		conn.Stop()
-
-		// 删除
-		delete(cm.connections, connID)
 	}
 
 	fmt.Printf("Clear All connections succ! conn num=%d", cm.Len())
@@ -0,0 +1,280 @@
+package znet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+// 写入系统消息的超时时间，避免不读取数据的客户端阻塞服务端
+const sysMsgWriteTimeout = time.Second
+
+// writeSysMsg 在链接模块创建之前，直接向 socket 写入一个系统消息
+func writeSysMsg(conn *net.TCPConn, msgID uint32, data []byte) error {
+	binaryData, err := NewDataPack().Pack(NewMessage(msgID, data))
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(sysMsgWriteTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err = conn.Write(binaryData)
+	return err
+}
+
+// rejectFull 回复 MsgIDServerFull 之后关闭链接
+func rejectFull(conn *net.TCPConn) {
+	fmt.Printf("Too many connections MaxConn=%d, reject %s\n", utils.GlobalObject.MaxConn, conn.RemoteAddr())
+	writeSysMsg(conn, MsgIDServerFull, []byte(utils.GlobalObject.ServerFullReason))
+	conn.Close()
+}
+
+// sendQueuePosition 告知客户端在等待队列中的位置，0 表示已经接入
+func sendQueuePosition(conn *net.TCPConn, position uint32) error {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, position)
+	return writeSysMsg(conn, MsgIDQueuePosition, data)
+}
+
+// waitingConn 等待队列中的一个链接
+type waitingConn struct {
+	conn  *net.TCPConn
+	timer *time.Timer
+	// 最新的位置，在队列的锁中更新，0 表示已经接入
+	position uint32
+	// 保证同一个链接的位置按顺序写入，只写入最新的位置
+	writeLock sync.Mutex
+	sent      uint32
+}
+
+// flush 将最新的位置写入 socket，已经写入过时跳过，在队列的锁之外调用
+func (w *waitingConn) flush() error {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	position := atomic.LoadUint32(&w.position)
+	if position == w.sent {
+		return nil
+	}
+	if err := sendQueuePosition(w.conn, position); err != nil {
+		return err
+	}
+	w.sent = position
+	return nil
+}
+
+// admittedConn 离开等待队列的链接，链接模块已经创建并占用了位置，告知客户端之后启动
+type admittedConn struct {
+	waiting *waitingConn
+	conn    *Connection
+}
+
+// connQueue 链接数超出 MaxConn 时的等待队列，有空闲的位置时按顺序接入
+// 队列的锁中只修改队列，写入 socket 都在锁之外进行，不读取数据的客户端不会阻塞接入和链接的断开
+type connQueue struct {
+	lock    sync.Mutex
+	server  *Server
+	waiting []*waitingConn
+	// 服务器停止之后不再接入新的链接，也不再从队列中接入
+	closed bool
+}
+
+// newConnQueue 创建等待队列
+func newConnQueue(server *Server) *connQueue {
+	return &connQueue{server: server}
+}
+
+// accept 处理一个新的链接：有空闲的位置且没有链接在等待时直接接入，否则进入等待队列，队列已满时拒绝
+func (q *connQueue) accept(conn *net.TCPConn) {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		conn.Close()
+		return
+	}
+	if len(q.waiting) == 0 && q.server.ConnMgr.Len() < utils.GlobalObject.MaxConn {
+		q.server.startConn(conn)
+		q.lock.Unlock()
+		return
+	}
+	if len(q.waiting) >= utils.GlobalObject.ConnQueueSize {
+		q.lock.Unlock()
+		go rejectFull(conn)
+		return
+	}
+
+	w := &waitingConn{conn: conn, sent: math.MaxUint32}
+	if timeout := utils.GlobalObject.ConnQueueTimeout; timeout > 0 {
+		w.timer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+			q.expire(w)
+		})
+	}
+	q.waiting = append(q.waiting, w)
+	position := uint32(len(q.waiting))
+	atomic.StoreUint32(&w.position, position)
+	q.lock.Unlock()
+
+	fmt.Printf("Too many connections MaxConn=%d, %s waiting at %d\n", utils.GlobalObject.MaxConn, conn.RemoteAddr(), position)
+	// 在新的 Goroutine 中写入，不阻塞 Accept
+	go func() {
+		if err := w.flush(); err != nil {
+			q.drop(w)
+		}
+	}()
+}
+
+// lenByIP 获取等待队列中来自某个远程 IP 的链接数
+func (q *connQueue) lenByIP(ip string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	n := 0
+	for _, w := range q.waiting {
+		if remoteIP(w.conn.RemoteAddr()) == ip {
+			n++
+		}
+	}
+	return n
+}
+
+// admit 有链接移除时调用，按顺序接入等待中的链接，并通知其余的链接新的位置
+func (q *connQueue) admit() {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
+	var admitted []admittedConn
+	for len(q.waiting) > 0 && q.server.ConnMgr.Len() < utils.GlobalObject.MaxConn {
+		w := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		atomic.StoreUint32(&w.position, 0)
+		// 先创建链接模块占用位置，告知客户端已经接入之后再启动
+		admitted = append(admitted, admittedConn{
+			waiting: w,
+			conn:    NewConnection(q.server, w.conn, q.server.nextConnID(), q.server.MsgHandler),
+		})
+	}
+	waiting := q.reposition()
+	q.lock.Unlock()
+
+	if len(admitted) > 0 {
+		// 在新的 Goroutine 中写入，不阻塞调用 admit 的链接的 Stop
+		go q.deliver(admitted, waiting)
+	}
+}
+
+// deliver 告知离开队列的链接已经接入并启动链接模块，再通知其余的链接新的位置
+func (q *connQueue) deliver(admitted []admittedConn, waiting []*waitingConn) {
+	released := false
+	for _, a := range admitted {
+		if err := a.waiting.flush(); err != nil || q.isClosed() {
+			// 链接模块还没有启动，直接释放它占用的位置
+			if a.conn.limiter != nil {
+				a.conn.limiter.close()
+			}
+			a.conn.Conn.Close()
+			q.server.ConnMgr.Remove(a.conn)
+			released = true
+			continue
+		}
+		go a.conn.Start()
+	}
+	q.notify(waiting)
+	if released {
+		q.admit()
+	}
+}
+
+// isClosed 服务器是否已经停止
+func (q *connQueue) isClosed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.closed
+}
+
+// close 服务器停止时调用，关闭所有等待中的链接并停止它们的超时定时器
+// 需要在 ClearConn 之前调用，否则链接移除时会从队列中接入新的链接
+func (q *connQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	waiting := q.waiting
+	q.waiting = nil
+	q.lock.Unlock()
+
+	for _, w := range waiting {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		w.conn.Close()
+	}
+}
+
+// expire 等待超时的链接回复 MsgIDServerFull 之后关闭
+func (q *connQueue) expire(w *waitingConn) {
+	q.lock.Lock()
+	removed := q.remove(w)
+	waiting := q.reposition()
+	q.lock.Unlock()
+
+	if removed {
+		go rejectFull(w.conn)
+		go q.notify(waiting)
+	}
+}
+
+// drop 移除写入失败的链接并关闭
+func (q *connQueue) drop(w *waitingConn) {
+	q.lock.Lock()
+	removed := q.remove(w)
+	waiting := q.reposition()
+	q.lock.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.conn.Close()
+	if removed {
+		q.notify(waiting)
+	}
+}
+
+// remove 从等待队列中移除，调用方需持有锁
+func (q *connQueue) remove(w *waitingConn) bool {
+	for i, waiting := range q.waiting {
+		if waiting == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// reposition 更新等待中的链接的位置，返回需要通知的链接，调用方需持有锁
+func (q *connQueue) reposition() []*waitingConn {
+	waiting := make([]*waitingConn, len(q.waiting))
+	for i, w := range q.waiting {
+		atomic.StoreUint32(&w.position, uint32(i+1))
+		waiting[i] = w
+	}
+	return waiting
+}
+
+// notify 通知等待中的链接新的位置，写入失败的链接被移除
+func (q *connQueue) notify(waiting []*waitingConn) {
+	for _, w := range waiting {
+		if err := w.flush(); err != nil {
+			q.drop(w)
+			return
+		}
+	}
+}
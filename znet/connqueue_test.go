@@ -0,0 +1,186 @@
+package znet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+// freePort 获取一个空闲的端口，Server 停止时不会关闭监听，每次测试都使用新的端口
+func freePort(t testing.TB) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// readTestMsg 客户端读取一个完整的消息
+func readTestMsg(t *testing.T, conn net.Conn) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	dp := NewDataPack()
+	headData := make([]byte, dp.GetHeadLen())
+	if _, err := io.ReadFull(conn, headData); err != nil {
+		t.Fatalf("read head: %v", err)
+	}
+	msg, err := dp.UnPack(headData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, msg.GetDataLen())
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("read data: %v", err)
+	}
+	msg.SetData(data)
+	return msg.(*Message)
+}
+
+// dialTest 链接本机的测试服务端，服务端异步开始监听，链接失败时重试
+func dialTest(t testing.TB, port int) net.Conn {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("dial timeout")
+	return nil
+}
+
+// sendTestMsg 客户端发送一个消息
+func sendTestMsg(conn net.Conn, msgID uint32, data []byte) {
+	binaryData, _ := NewDataPack().Pack(NewMessage(msgID, data))
+	conn.Write(binaryData)
+}
+
+// loginTest 链接测试服务端并以 token 认证，返回认证成功的链接
+func loginTest(t *testing.T, port int, token string) net.Conn {
+	t.Helper()
+	conn := dialTest(t, port)
+	sendTestMsg(conn, MsgIDAuth, []byte(token))
+	if msg := readTestMsg(t, conn); msg.ID != MsgIDAuth || msg.Data[0] != AuthOK {
+		t.Fatalf("auth reply id=%x data=%v", msg.ID, msg.Data)
+	}
+	return conn
+}
+
+func TestServerFullQueue(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.MaxConn = 1
+	utils.GlobalObject.ConnQueueSize = 1
+
+	s := NewServer("queue").(*Server)
+	s.Start()
+
+	position := func(msg *Message) uint32 {
+		if msg.ID != MsgIDQueuePosition {
+			t.Fatalf("msgID = %x, want MsgIDQueuePosition", msg.ID)
+		}
+		return binary.LittleEndian.Uint32(msg.Data)
+	}
+
+	// 第一个链接直接接入，第二个链接进入等待队列，第三个链接被拒绝
+	first := dialTest(t, s.Port)
+	for s.ConnMgr.Len() != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := dialTest(t, s.Port)
+	defer second.Close()
+	if pos := position(readTestMsg(t, second)); pos != 1 {
+		t.Fatalf("position = %d, want 1", pos)
+	}
+	third := dialTest(t, s.Port)
+	defer third.Close()
+	if msg := readTestMsg(t, third); msg.ID != MsgIDServerFull || string(msg.Data) != "server is full" {
+		t.Fatalf("msg id=%x data=%s, want MsgIDServerFull", msg.ID, msg.Data)
+	}
+
+	// 第一个链接关闭后，等待中的链接接入
+	// 向它写入时阻塞（模拟不读取数据的客户端）也不影响新的链接进入队列
+	s.queue.lock.Lock()
+	w := s.queue.waiting[0]
+	s.queue.lock.Unlock()
+	w.writeLock.Lock()
+	first.Close()
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.queue.lock.Lock()
+		n := len(s.queue.waiting)
+		s.queue.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiting connection not admitted")
+		}
+	}
+	fourth := dialTest(t, s.Port)
+	defer fourth.Close()
+	if pos := position(readTestMsg(t, fourth)); pos != 1 {
+		t.Fatalf("position = %d, want 1", pos)
+	}
+	w.writeLock.Unlock()
+	if pos := position(readTestMsg(t, second)); pos != 0 {
+		t.Fatalf("position = %d, want 0", pos)
+	}
+	fourth.Close()
+
+	// 关闭所有链接，等待服务端的链接退出后再恢复配置
+	second.Close()
+	for deadline := time.Now().Add(3 * time.Second); s.ConnMgr.Len() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connections not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnQueueClosedOnStop(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.MaxConn = 1
+	utils.GlobalObject.ConnQueueSize = 1
+	utils.GlobalObject.ConnQueueTimeout = 60
+
+	s := NewServer("queue").(*Server)
+	s.Start()
+
+	first := dialTest(t, s.Port)
+	defer first.Close()
+	for s.ConnMgr.Len() != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	second := dialTest(t, s.Port)
+	defer second.Close()
+	if msg := readTestMsg(t, second); msg.ID != MsgIDQueuePosition || binary.LittleEndian.Uint32(msg.Data) != 1 {
+		t.Fatalf("msg id=%x data=%v, want position 1", msg.ID, msg.Data)
+	}
+
+	// 停止时等待中的链接被关闭，而不是在第一个链接断开之后接入
+	s.Stop()
+	second.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("waiting connection read %d bytes, err=%v, want EOF", n, err)
+	}
+	if s.ConnMgr.Len() != 0 {
+		t.Fatalf("%d connections after stop", s.ConnMgr.Len())
+	}
+	s.queue.lock.Lock()
+	defer s.queue.lock.Unlock()
+	if len(s.queue.waiting) != 0 {
+		t.Fatalf("%d connections still waiting", len(s.queue.waiting))
+	}
+}
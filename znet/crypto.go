@@ -0,0 +1,233 @@
+package znet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/646222472/zinx/ziface"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 链接的加密模式
+const (
+	EncryptionOff      = ""         // 不加密
+	EncryptionOptional = "optional" // 客户端发起握手时加密，否则使用明文，明文客户端需要先发送消息，否则等待 HandshakeTimeout
+	EncryptionRequired = "required" // 客户端必须先完成握手，否则关闭链接
+)
+
+// 对称加密算法的编号，由服务端在握手时告知客户端
+const (
+	CipherAESGCM           uint8 = 1
+	CipherChaCha20Poly1305 uint8 = 2
+)
+
+// 加密后的消息内容 |Seq(8)|Ciphertext|Tag(16)|
+const seqLen = 8
+
+// cipherIDByName 根据配置中的名称获取对称加密算法的编号
+func cipherIDByName(name string) (uint8, error) {
+	switch name {
+	case "aes-gcm":
+		return CipherAESGCM, nil
+	case "chacha20-poly1305":
+		return CipherChaCha20Poly1305, nil
+	}
+	return 0, fmt.Errorf("cipher %s NOT FOUND", name)
+}
+
+// newAEAD 创建对称加密算法的实例
+func newAEAD(cipherID uint8, key []byte) (cipher.AEAD, error) {
+	switch cipherID {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("cipher id=%d NOT FOUND", cipherID)
+}
+
+// cipherState 一个链接的加密状态
+// 收发两个方向使用不同的密钥，序列号既作为 nonce，也用于防止重放：接收的序列号必须严格递增
+type cipherState struct {
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+	sendSeq  uint64
+	recvSeq  uint64
+}
+
+// newCipherState 由 X25519 的共享密钥通过 HKDF 派生两个方向的密钥
+func newCipherState(cipherID uint8, shared, clientPub, serverPub []byte, isServer bool) (*cipherState, error) {
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+	deriveKey := func(info string) (cipher.AEAD, error) {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+			return nil, err
+		}
+		return newAEAD(cipherID, key)
+	}
+
+	c2s, err := deriveKey("zinx client to server")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := deriveKey("zinx server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	if isServer {
+		return &cipherState{sendAEAD: s2c, recvAEAD: c2s}, nil
+	}
+	return &cipherState{sendAEAD: c2s, recvAEAD: s2c}, nil
+}
+
+// nonce 由序列号生成 nonce
+func (cs *cipherState) nonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, seq)
+	return nonce
+}
+
+// additionalData MsgID 和标志位参与认证，防止被篡改
+func (cs *cipherState) additionalData(msg ziface.IMessage) []byte {
+	ad := make([]byte, 5)
+	binary.LittleEndian.PutUint32(ad, msg.GetMsgID())
+	ad[4] = msg.GetFlags()
+	return ad
+}
+
+// seal 加密消息内容并设置 FlagEncrypted，调用方需保证同一链接的消息按加密的顺序发送
+func (cs *cipherState) seal(msg ziface.IMessage) {
+	cs.sendSeq++
+	msg.SetFlags(msg.GetFlags() | FlagEncrypted)
+
+	data := make([]byte, seqLen, seqLen+len(msg.GetData())+cs.sendAEAD.Overhead())
+	binary.LittleEndian.PutUint64(data, cs.sendSeq)
+	data = cs.sendAEAD.Seal(data, cs.nonce(cs.sendAEAD, cs.sendSeq), msg.GetData(), cs.additionalData(msg))
+
+	msg.SetData(data)
+	msg.SetDataLen(uint32(len(data)))
+}
+
+// open 校验序列号并解密消息内容
+func (cs *cipherState) open(msg ziface.IMessage) error {
+	if msg.GetFlags()&FlagEncrypted == 0 {
+		return fmt.Errorf("%s", "plaintext msg on encrypted connection")
+	}
+	if msg.GetDataLen() < seqLen {
+		return fmt.Errorf("%s", "encrypted msg too short")
+	}
+
+	seq := binary.LittleEndian.Uint64(msg.GetData())
+	if seq != cs.recvSeq+1 {
+		return fmt.Errorf("encrypted msg seq=%d, expect %d, replayed or out of order", seq, cs.recvSeq+1)
+	}
+	// 在原缓冲中解密，避免再分配一块内存
+	ciphertext := msg.GetData()[seqLen:]
+	data, err := cs.recvAEAD.Open(ciphertext[:0], cs.nonce(cs.recvAEAD, seq), ciphertext, cs.additionalData(msg))
+	if err != nil {
+		return err
+	}
+	cs.recvSeq = seq
+
+	msg.SetFlags(msg.GetFlags() &^ FlagEncrypted)
+	msg.SetData(data)
+	msg.SetDataLen(uint32(len(data)))
+
+	return nil
+}
+
+// newKeyPair 生成 X25519 的密钥对
+func newKeyPair() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+// serverHandshake 服务端的握手，hello 为客户端发来的握手消息 |ClientPub(32)|
+// 服务端回复 |CipherID(1)|ServerPub(32)|
+func serverHandshake(conn net.Conn, hello ziface.IMessage, cipherID uint8) (*cipherState, error) {
+	clientPub := hello.GetData()
+	if len(clientPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("%s", "invalid handshake public key")
+	}
+
+	priv, serverPub, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(priv, clientPub)
+	if err != nil {
+		return nil, err
+	}
+
+	binaryData, err := NewDataPack().Pack(NewMessage(MsgIDHandshake, append([]byte{cipherID}, serverPub...)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(binaryData); err != nil {
+		return nil, err
+	}
+
+	return newCipherState(cipherID, shared, clientPub, serverPub, true)
+}
+
+// clientHandshake 客户端的握手，发送自己的公钥并等待服务端回复
+func clientHandshake(conn net.Conn) (*cipherState, error) {
+	priv, clientPub, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	dp := NewDataPack()
+	binaryData, err := dp.Pack(NewMessage(MsgIDHandshake, clientPub))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(binaryData); err != nil {
+		return nil, err
+	}
+
+	headData := make([]byte, dp.GetHeadLen())
+	if _, err := io.ReadFull(conn, headData); err != nil {
+		return nil, err
+	}
+	reply, err := dp.UnPack(headData)
+	if err != nil {
+		return nil, err
+	}
+	if reply.GetMsgID() != MsgIDHandshake || reply.GetDataLen() != 1+curve25519.PointSize {
+		return nil, fmt.Errorf("%s", "invalid handshake reply")
+	}
+	data := make([]byte, reply.GetDataLen())
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	reply.SetData(data)
+	if err := dp.Verify(reply); err != nil {
+		return nil, err
+	}
+
+	serverPub := data[1:]
+	shared, err := curve25519.X25519(priv, serverPub)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCipherState(data[0], shared, clientPub, serverPub, false)
+}
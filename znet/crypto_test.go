@@ -0,0 +1,67 @@
+package znet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHandshakeAndReplay(t *testing.T) {
+	for _, cipherID := range []uint8{CipherAESGCM, CipherChaCha20Poly1305} {
+		serverConn, clientConn := net.Pipe()
+
+		done := make(chan *cipherState, 1)
+		go func() {
+			cs, err := clientHandshake(clientConn)
+			if err != nil {
+				t.Errorf("client handshake: %v", err)
+			}
+			done <- cs
+		}()
+
+		// 服务端读取客户端的握手消息
+		dp := NewDataPack()
+		headData := make([]byte, dp.GetHeadLen())
+		if _, err := io.ReadFull(serverConn, headData); err != nil {
+			t.Fatal(err)
+		}
+		hello, _ := dp.UnPack(headData)
+		data := make([]byte, hello.GetDataLen())
+		io.ReadFull(serverConn, data)
+		hello.SetData(data)
+
+		server, err := serverHandshake(serverConn, hello, cipherID)
+		if err != nil {
+			t.Fatalf("server handshake: %v", err)
+		}
+		client := <-done
+		serverConn.Close()
+		clientConn.Close()
+
+		// 客户端加密的消息服务端可以解密，MsgID 和标志位参与认证
+		msg := NewMessage(1, []byte("hello zinx"))
+		client.seal(msg)
+		replay := NewMessage(1, append([]byte{}, msg.GetData()...))
+		replay.SetFlags(msg.GetFlags())
+		if err := server.open(msg); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if !bytes.Equal(msg.GetData(), []byte("hello zinx")) {
+			t.Fatalf("data = %q", msg.GetData())
+		}
+
+		// 重放同一个消息会被拒绝
+		if err := server.open(replay); err == nil {
+			t.Fatal("replayed msg should be rejected")
+		}
+
+		// 篡改 MsgID 的消息会被拒绝
+		tampered := NewMessage(2, []byte("hi"))
+		client.seal(tampered)
+		tampered.SetMsgID(3)
+		if err := server.open(tampered); err == nil {
+			t.Fatal("tampered msg should be rejected")
+		}
+	}
+}
@@ -1,14 +1,69 @@
 package znet
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
 
 	"github.com/646222472/zinx/utils"
 	"github.com/646222472/zinx/ziface"
 )
 
+// 包头 DataLen 字段的高 5 位用作消息的标志位，低 27 位才是真正的数据长度
+// 不使用任何标志位时与原有的包格式完全一致，最高位保留给以后的扩展，收到未知的标志位时拒绝该消息
+const (
+	// 数据长度在 DataLen 字段中占用的位
+	dataLenMask uint32 = 1<<flagsShift - 1
+	// 标志位在 DataLen 字段中的偏移
+	flagsShift = 27
+)
+
+// 消息的标志位
+const (
+	// FlagCompressed 消息内容经过压缩，第一个字节为压缩算法的编号
+	FlagCompressed uint8 = 1 << iota
+	// FlagEncrypted 消息内容经过加密，内容为 |Seq(8)|Ciphertext|Tag|
+	FlagEncrypted
+	// FlagChecksum 包头之后附带校验字段 |HeadCRC(4)|DataCRC(4)|
+	FlagChecksum
+	// FlagFragment 大消息的一个分片，内容为 |StreamID(4)|Offset(4)|Total(4)|Chunk|
+	FlagFragment
+
+	// 已经定义的标志位
+	knownFlags = FlagCompressed | FlagEncrypted | FlagChecksum | FlagFragment
+)
+
+// 校验字段的长度：包头的 CRC32 和消息内容的 CRC32
+const checksumLen = 8
+
+// 消息内容校验失败时的处理
+const (
+	ChecksumFailDrop  = "drop"  // 丢弃该消息，继续读取
+	ChecksumFailClose = "close" // 关闭链接
+)
+
+var (
+	// ErrDataChecksum 消息内容的校验失败，包头校验通过，数据流仍然是同步的
+	ErrDataChecksum = errors.New("msg data checksum mismatch")
+
+	// ErrUnknownFlags 包头中有未知的标志位，或者未开启校验时收到带校验字段的包，无法确定包头的长度
+	ErrUnknownFlags = errors.New("msg head has unknown flags")
+
+	// 使用 CRC32-C 计算校验值
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// 校验失败的总次数
+	integrityFailures uint64
+)
+
+// IntegrityFailures 获取包头或消息内容校验失败的总次数
+func IntegrityFailures() uint64 {
+	return atomic.LoadUint64(&integrityFailures)
+}
+
 // DataPack 封包，拆包的模块
 // 直接面向 TCP 连接中的数据流，用于处理 TCP 粘包问题
 type DataPack struct {
@@ -21,51 +76,82 @@ func NewDataPack() *DataPack {
 
 // GetHeadLen 获取头部长度的方法
 func (dp *DataPack) GetHeadLen() uint32 {
+	// 开启校验时还包括 HeadCRC uint32(4字节) + DataCRC uint32(4字节)
+	if utils.GlobalObject.Checksum {
+		return 8 + checksumLen
+	}
 	// DataLen uint32(4字节) + ID uint32(4字节)
 	return 8
 }
 
-// Pack 封包方法 |dataLen(4)|MsgId(4)|MsgData|
+// Pack 封包方法 |flags(4bit)+dataLen(28bit)|MsgId(4)|MsgData|
+// 开启校验时为 |flags(4bit)+dataLen(28bit)|MsgId(4)|HeadCRC(4)|DataCRC(4)|MsgData|
 func (dp *DataPack) Pack(msg ziface.IMessage) ([]byte, error) {
-	// 创建一个存放 bytes 字节流的缓冲
-	dataBuffer := bytes.NewBuffer([]byte{})
-
-	// 将 DataLen 写入 dataBuffer 中
-	if err := binary.Write(dataBuffer, binary.LittleEndian, msg.GetDataLen()); err != nil {
+	binaryData := make([]byte, int(dp.GetHeadLen())+len(msg.GetData()))
+	if err := dp.packTo(binaryData, msg); err != nil {
 		return nil, err
 	}
+	return binaryData, nil
+}
 
-	// 将 MsgId 写入 dataBuffer 中
-	if err := binary.Write(dataBuffer, binary.LittleEndian, msg.GetMsgID()); err != nil {
-		return nil, err
+// packTo 将消息封包到 binaryData 中，binaryData 的长度必须是包头长度加上消息内容的长度
+func (dp *DataPack) packTo(binaryData []byte, msg ziface.IMessage) error {
+	if msg.GetDataLen() > dataLenMask {
+		return fmt.Errorf("%s", "too large message data send !!!")
 	}
 
-	// 将 Data 写入 dataBuffer 中
-	if err := binary.Write(dataBuffer, binary.LittleEndian, msg.GetData()); err != nil {
-		return nil, err
+	flags := msg.GetFlags()
+	if utils.GlobalObject.Checksum {
+		flags |= FlagChecksum
+	}
+
+	// 写入 Flags 和 DataLen，再写入 MsgId
+	binary.LittleEndian.PutUint32(binaryData[0:], uint32(flags)<<flagsShift|msg.GetDataLen())
+	binary.LittleEndian.PutUint32(binaryData[4:], msg.GetMsgID())
+
+	// 写入 HeadCRC 和 DataCRC
+	headLen := 8
+	if utils.GlobalObject.Checksum {
+		binary.LittleEndian.PutUint32(binaryData[8:], crc32.Checksum(binaryData[:8], crcTable))
+		binary.LittleEndian.PutUint32(binaryData[12:], crc32.Checksum(msg.GetData(), crcTable))
+		headLen += checksumLen
 	}
 
-	return dataBuffer.Bytes(), nil
+	// 写入 Data
+	copy(binaryData[headLen:], msg.GetData())
+
+	return nil
 }
 
 // UnPack 拆包方法:1、将包中的 Head 信息读出；2、再根据 Head 信息中的 DataLen，再进行一次读取
 func (dp *DataPack) UnPack(binaryData []byte) (ziface.IMessage, error) {
-	// 创建一个 ioReader (数据从输入的二进制数据流得到)
-	dataBuffer := bytes.NewReader(binaryData)
+	if len(binaryData) < int(dp.GetHeadLen()) {
+		return nil, io.ErrUnexpectedEOF
+	}
 
-	// 接收拆包的数据
+	// 接收拆包的数据，只解压 Head 信息，得到 Flags、DataLen 和 MsgID
 	msg := &Message{}
 
-	// 只解压 Head 信息，得到 DataLen 和 MsgID
-
-	// 读取 DataLen
-	if err := binary.Read(dataBuffer, binary.LittleEndian, &msg.DataLen); err != nil {
-		return nil, err
+	// 读取 Flags 和 DataLen
+	msg.DataLen = binary.LittleEndian.Uint32(binaryData[0:])
+	msg.Flags = uint8(msg.DataLen >> flagsShift)
+	msg.DataLen &= dataLenMask
+	if msg.Flags&^knownFlags != 0 || (!utils.GlobalObject.Checksum && msg.Flags&FlagChecksum != 0) {
+		return nil, ErrUnknownFlags
 	}
 
 	// 读取 MsgID
-	if err := binary.Read(dataBuffer, binary.LittleEndian, &msg.ID); err != nil {
-		return nil, err
+	msg.ID = binary.LittleEndian.Uint32(binaryData[4:])
+
+	// 开启校验时，先校验包头，包头损坏时 DataLen 不可信，数据流已经无法同步
+	if utils.GlobalObject.Checksum {
+		headCRC := binary.LittleEndian.Uint32(binaryData[8:])
+		msg.Checksum = binary.LittleEndian.Uint32(binaryData[12:])
+		if msg.Flags&FlagChecksum == 0 || headCRC != crc32.Checksum(binaryData[:8], crcTable) {
+			atomic.AddUint64(&integrityFailures, 1)
+			return nil, fmt.Errorf("%s", "msg head checksum mismatch")
+		}
+		msg.Flags &^= FlagChecksum
 	}
 
 	// 判断 datalen 是否已经超出允许的最大包长度
@@ -75,3 +161,15 @@ func (dp *DataPack) UnPack(binaryData []byte) (ziface.IMessage, error) {
 
 	return msg, nil
 }
+
+// Verify 读取 Data 之后校验消息内容，未开启校验时总是成功
+func (dp *DataPack) Verify(msg ziface.IMessage) error {
+	if !utils.GlobalObject.Checksum {
+		return nil
+	}
+	if crc32.Checksum(msg.GetData(), crcTable) != msg.GetChecksum() {
+		atomic.AddUint64(&integrityFailures, 1)
+		return ErrDataChecksum
+	}
+	return nil
+}
@@ -5,16 +5,23 @@ import (
 	"io"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestDataPack(t *testing.T) {
 	// 模拟的服务器
 	// 1、创建 SocketTCP
-	listenner, err := net.Listen("tcp", "127.0.0.1:7777")
+	listenner, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		fmt.Println("Server listen error:", err)
 		return
 	}
+	defer listenner.Close()
+
+	// 服务端收到的消息，以及服务端处理完链接的通知
+	recvChan := make(chan *Message, 2)
+	doneChan := make(chan struct{})
+
 	// 创建一个go承载，负责从客户端处理业务
 	go func() {
 		// 2、从客户端读取数据，拆包处理
@@ -22,9 +29,11 @@ func TestDataPack(t *testing.T) {
 			conn, err := listenner.Accept()
 			if err != nil {
 				fmt.Println("server accpet error", err)
+				return
 			}
 
 			go func(conn net.Conn) {
+				defer close(doneChan)
 				// 处理客户端有请求
 				// ---->拆包的过程<----
 				// 定义一个拆包的对象 dp
@@ -55,6 +64,7 @@ func TestDataPack(t *testing.T) {
 
 						// 完整的一个消息已经读取完毕
 						fmt.Printf("--->Recv MsgID:%d, datalen:%d, data:%s\n", msg.ID, msg.DataLen, msg.Data)
+						recvChan <- msg
 					}
 				}
 			}(conn)
@@ -62,7 +72,7 @@ func TestDataPack(t *testing.T) {
 	}()
 
 	// 模拟客户端
-	conn, err := net.Dial("tcp", "127.0.0.1:7777")
+	conn, err := net.Dial("tcp", listenner.Addr().String())
 	if err != nil {
 		fmt.Println("client dial err ", err)
 		return
@@ -99,6 +109,19 @@ func TestDataPack(t *testing.T) {
 	// 一次性发送给服务端
 	conn.Write(sendData1)
 
-	// 客户端阻塞
-	select {}
+	// 等待服务端拆出两个完整的消息
+	for _, want := range []*Message{msg1, msg2} {
+		select {
+		case msg := <-recvChan:
+			if msg.ID != want.ID || string(msg.Data) != string(want.Data) {
+				t.Fatalf("recv msg id=%d data=%s, want id=%d data=%s", msg.ID, msg.Data, want.ID, want.Data)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("recv msg timeout")
+		}
+	}
+
+	// 关闭链接，等待服务端退出
+	conn.Close()
+	<-doneChan
 }
@@ -0,0 +1,275 @@
+package znet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 分片的内容 |StreamID(4)|Offset(4)|Total(4)|Chunk|
+const fragmentHeadLen = 12
+
+// 一个链接上同时在接收的分片消息数量的上限
+const maxPendingFragments = 8
+
+// ErrFragmentTimeout 分片消息在 FragmentTimeout 内没有接收完毕
+var ErrFragmentTimeout = errors.New("fragment reassembly timeout")
+
+// ErrFragmentRejected 流式处理的分片被任务队列拒绝，消息被中止
+var ErrFragmentRejected = errors.New("fragment rejected by task queue")
+
+// ErrPackageSizeTooSmall MaxPackageSize 容纳不下分片头和加密开销，无法拆分为分片发送
+var ErrPackageSizeTooSmall = errors.New("MaxPackageSize too small for fragment overhead")
+
+// chunkInfo 分片消息中的一个分片在整个消息中的位置
+type chunkInfo struct {
+	stream uint32
+	offset uint32
+	total  uint32
+	// 是否为最后一个分片
+	last bool
+	// 消息被中止的原因，不为 nil 时没有分片内容
+	err error
+}
+
+// assembly 一个正在接收的分片消息
+type assembly struct {
+	msgID    uint32
+	total    uint32
+	received uint32
+	// 是否流式处理，流式处理时不重组消息内容
+	stream bool
+	// 重组的消息内容，随分片的到达增长，不按照对端声明的长度预先分配
+	data []byte
+	// 流式处理的分片被任务队列拒绝后，剩余的分片直接丢弃
+	rejected bool
+	// 超时未接收完毕时中止
+	timer *time.Timer
+}
+
+// reassembler 链接的分片重组模块，客户端使用时 conn 为 nil
+// 分片的请求在锁中分发，与超时、链接断开时中止的通知保持顺序
+type reassembler struct {
+	conn       *Connection
+	assemblies map[uint32]*assembly
+	lock       sync.Mutex
+}
+
+// newReassembler 创建链接的分片重组模块
+func newReassembler(conn *Connection) *reassembler {
+	return &reassembler{
+		conn:       conn,
+		assemblies: make(map[uint32]*assembly),
+	}
+}
+
+// maxChunkSize 每个分片最多携带的内容长度，保证加上分片头和加密开销后不超过 MaxPackageSize
+// MaxPackageSize 不大于这些开销时返回 ErrPackageSizeTooSmall
+func maxChunkSize(encrypted bool) (uint32, error) {
+	if utils.GlobalObject.MaxPackageSize == 0 {
+		return dataLenMask, nil
+	}
+	overhead := uint32(fragmentHeadLen)
+	if encrypted {
+		overhead += seqLen + 16
+	}
+	if utils.GlobalObject.MaxPackageSize <= overhead {
+		return 0, ErrPackageSizeTooSmall
+	}
+	return utils.GlobalObject.MaxPackageSize - overhead, nil
+}
+
+// maxSendLen 一个消息最多能发送的内容长度，开启分片时为 MaxMessageSize，否则为 MaxPackageSize
+func maxSendLen() uint32 {
+	if utils.GlobalObject.MaxMessageSize > 0 {
+		return utils.GlobalObject.MaxMessageSize
+	}
+	if utils.GlobalObject.MaxPackageSize > 0 {
+		return utils.GlobalObject.MaxPackageSize
+	}
+	return dataLenMask
+}
+
+// splitFragments 将大消息拆分为多个分片消息
+func splitFragments(msgID, streamID uint32, data []byte, chunkSize uint32) []ziface.IMessage {
+	total := uint32(len(data))
+	msgs := make([]ziface.IMessage, 0, (total+chunkSize-1)/chunkSize)
+	for offset := uint32(0); offset < total; offset += chunkSize {
+		end := offset + chunkSize
+		if end > total {
+			end = total
+		}
+
+		payload := make([]byte, fragmentHeadLen, fragmentHeadLen+end-offset)
+		binary.LittleEndian.PutUint32(payload[0:], streamID)
+		binary.LittleEndian.PutUint32(payload[4:], offset)
+		binary.LittleEndian.PutUint32(payload[8:], total)
+		payload = append(payload, data[offset:end]...)
+
+		msg := NewMessage(msgID, payload)
+		msg.SetFlags(FlagFragment)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// handle 处理收到的一个分片，并将生成的请求交给业务
+// 返回 error 表示对端违反了分片协议或请求被拒绝，链接应该关闭
+func (r *reassembler) handle(msg ziface.IMessage, stream bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reqs, err := r.push(msg, stream)
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		chunk := req.chunk
+		if err := r.conn.enqueue(req); err != nil {
+			if chunk != nil {
+				r.reject(req.GetMsgID(), chunk)
+			}
+			if utils.GlobalObject.RejectPolicy == RejectPolicyClose {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// assemble 将分片重组为完整的消息，不进行流式处理，消息还没有接收完毕时返回 nil
+// 用于集群、网关的内部消息以及客户端收到的消息
+func (r *reassembler) assemble(msg ziface.IMessage) (ziface.IMessage, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reqs, err := r.push(msg, false)
+	if err != nil || len(reqs) == 0 {
+		return nil, err
+	}
+	return reqs[0].msg, nil
+}
+
+// push 处理收到的一个分片，调用方需持有锁
+// 流式处理的消息每个分片都生成一个请求，否则在所有分片到达后生成一个完整消息的请求
+// 返回 error 表示对端违反了分片协议，链接应该关闭
+func (r *reassembler) push(msg ziface.IMessage, stream bool) ([]*Request, error) {
+	data := msg.GetData()
+	if len(data) < fragmentHeadLen {
+		return nil, fmt.Errorf("%s", "fragment too short")
+	}
+	streamID := binary.LittleEndian.Uint32(data[0:])
+	offset := binary.LittleEndian.Uint32(data[4:])
+	total := binary.LittleEndian.Uint32(data[8:])
+	chunk := data[fragmentHeadLen:]
+
+	a, ok := r.assemblies[streamID]
+	if !ok {
+		// 第一个分片，检查整个消息的长度是否超出限制
+		if offset != 0 {
+			return nil, fmt.Errorf("fragment stream=%d NOT FOUND", streamID)
+		}
+		if total > utils.GlobalObject.MaxMessageSize {
+			return nil, fmt.Errorf("%s", "too large fragmented message recv !!!")
+		}
+		if len(r.assemblies) >= maxPendingFragments {
+			return nil, fmt.Errorf("%s", "too many pending fragmented messages")
+		}
+
+		a = &assembly{msgID: msg.GetMsgID(), total: total, stream: stream}
+		a.timer = time.AfterFunc(time.Duration(utils.GlobalObject.FragmentTimeout)*time.Second, func() {
+			r.expire(streamID)
+		})
+		r.assemblies[streamID] = a
+	}
+
+	// 分片必须按顺序到达，且不能超出整个消息的长度
+	if a.msgID != msg.GetMsgID() || a.total != total || a.received != offset || uint64(offset)+uint64(len(chunk)) > uint64(total) {
+		return nil, fmt.Errorf("invalid fragment stream=%d offset=%d", streamID, offset)
+	}
+	a.received += uint32(len(chunk))
+	last := a.received == a.total
+	if last {
+		a.timer.Stop()
+		delete(r.assemblies, streamID)
+	}
+
+	if a.rejected {
+		releaseMsg(msg)
+		return nil, nil
+	}
+
+	if a.stream {
+		// 分片的缓冲随请求一起交给业务，由业务决定何时释放
+		req := r.newRequest(a.msgID, chunk, &chunkInfo{stream: streamID, offset: offset, total: total, last: last})
+		if m, ok := msg.(*Message); ok {
+			req.msg.(*Message).buf, m.buf = m.buf, nil
+		}
+		return []*Request{req}, nil
+	}
+
+	// 分片的内容复制到重组的缓冲后即可回收
+	a.data = append(a.data, chunk...)
+	releaseMsg(msg)
+	if !last {
+		return nil, nil
+	}
+	return []*Request{r.newRequest(a.msgID, a.data, nil)}, nil
+}
+
+// reject 流式处理的分片被任务队列拒绝时中止该消息并通知业务，调用方需持有锁
+func (r *reassembler) reject(msgID uint32, chunk *chunkInfo) {
+	if a, ok := r.assemblies[chunk.stream]; ok {
+		a.rejected = true
+	}
+	fmt.Printf("ConnID=%d fragment stream=%d msgID=%d rejected\n", r.conn.ConnID, chunk.stream, msgID)
+	r.conn.enqueueWait(r.newRequest(msgID, nil, &chunkInfo{stream: chunk.stream, total: chunk.total, err: ErrFragmentRejected}))
+}
+
+// expire 中止超时的分片消息，流式处理时通知业务
+func (r *reassembler) expire(streamID uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a, ok := r.assemblies[streamID]
+	if !ok {
+		return
+	}
+	delete(r.assemblies, streamID)
+	if r.conn == nil {
+		// 客户端只重组完整的消息，超时的消息直接丢弃
+		return
+	}
+	fmt.Printf("ConnID=%d fragment stream=%d msgID=%d timeout\n", r.conn.ConnID, streamID, a.msgID)
+	if a.stream && !a.rejected {
+		r.conn.enqueueWait(r.newRequest(a.msgID, nil, &chunkInfo{stream: streamID, total: a.total, err: ErrFragmentTimeout}))
+	}
+}
+
+// abortAll 链接断开时中止所有未接收完毕的分片消息
+func (r *reassembler) abortAll(reason error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for streamID, a := range r.assemblies {
+		a.timer.Stop()
+		if a.stream && !a.rejected {
+			r.conn.enqueueWait(r.newRequest(a.msgID, nil, &chunkInfo{stream: streamID, total: a.total, err: reason}))
+		}
+	}
+	r.assemblies = make(map[uint32]*assembly)
+}
+
+// newRequest 生成分发给业务的请求
+func (r *reassembler) newRequest(msgID uint32, data []byte, chunk *chunkInfo) *Request {
+	return &Request{
+		conn:  r.conn,
+		msg:   NewMessage(msgID, data),
+		chunk: chunk,
+	}
+}
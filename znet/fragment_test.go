@@ -0,0 +1,199 @@
+package znet
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.MaxPackageSize = 64
+	utils.GlobalObject.MaxMessageSize = 1024
+	utils.GlobalObject.FragmentTimeout = 30
+
+	chunkSize, err := maxChunkSize(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 50)
+	frags := splitFragments(7, 1, data, chunkSize)
+	if len(frags) != 10 {
+		t.Fatalf("fragments = %d, want 10", len(frags))
+	}
+
+	// 重组为一个完整的消息
+	r := newReassembler(&Connection{ConnID: 1})
+	var reqs []*Request
+	for i, frag := range frags {
+		got, err := r.push(frag, false)
+		if err != nil {
+			t.Fatalf("push: %v", err)
+		}
+		// 重组的缓冲随分片增长，不按照对端声明的长度预先分配
+		if a := r.assemblies[1]; i == 0 && cap(a.data) >= len(data) {
+			t.Fatalf("reassembly buffer cap = %d after first chunk", cap(a.data))
+		}
+		reqs = append(reqs, got...)
+	}
+	if len(reqs) != 1 || reqs[0].GetMsgID() != 7 || !bytes.Equal(reqs[0].GetData(), data) {
+		t.Fatalf("reassembled requests = %d", len(reqs))
+	}
+
+	// 流式处理时每个分片生成一个请求，最后一个分片标记 last
+	var streamed []byte
+	for i, frag := range splitFragments(7, 2, data, chunkSize) {
+		got, err := r.push(frag, true)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("push stream: %v", err)
+		}
+		if got[0].chunk.offset != uint32(len(streamed)) || got[0].chunk.last != (i == len(frags)-1) {
+			t.Fatalf("chunk %d = %+v", i, got[0].chunk)
+		}
+		streamed = append(streamed, got[0].GetData()...)
+	}
+	if !bytes.Equal(streamed, data) {
+		t.Fatal("streamed data mismatch")
+	}
+
+	// 超过 MaxMessageSize 的消息被拒绝
+	utils.GlobalObject.MaxMessageSize = 100
+	if _, err := r.push(splitFragments(7, 3, data, chunkSize)[0], false); err == nil {
+		t.Fatal("too large fragmented message should be rejected")
+	}
+}
+
+func TestFragmentPackageSizeTooSmall(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.MaxMessageSize = 1024
+
+	// 分片头占满整个包，或者加上加密开销之后超出包的长度
+	utils.GlobalObject.MaxPackageSize = fragmentHeadLen
+	if _, err := maxChunkSize(false); err != ErrPackageSizeTooSmall {
+		t.Fatalf("chunk size err = %v, want ErrPackageSizeTooSmall", err)
+	}
+	utils.GlobalObject.MaxPackageSize = fragmentHeadLen + 1
+	if size, err := maxChunkSize(false); err != nil || size != 1 {
+		t.Fatalf("chunk size = %d, %v, want 1", size, err)
+	}
+	if _, err := maxChunkSize(true); err != ErrPackageSizeTooSmall {
+		t.Fatalf("encrypted chunk size err = %v, want ErrPackageSizeTooSmall", err)
+	}
+
+	// 开启分片时 NewServer 校验该配置
+	utils.GlobalObject.Encryption = "optional"
+	defer func() {
+		if err := recover(); err != ErrPackageSizeTooSmall {
+			t.Fatalf("NewServer recover=%v, want ErrPackageSizeTooSmall", err)
+		}
+	}()
+	NewServer("fragment")
+}
+
+// streamRecorder 按顺序记录流式处理的调用，第一个分片阻塞到 release 关闭
+type streamRecorder struct {
+	entered chan struct{}
+	release chan struct{}
+	calls   chan string
+}
+
+func (r *streamRecorder) HandleChunk(request ziface.IRequest, offset, total uint32) {
+	if offset == 0 {
+		r.entered <- struct{}{}
+		<-r.release
+	}
+	r.calls <- fmt.Sprintf("chunk %d", offset)
+}
+
+func (r *streamRecorder) HandleEnd(request ziface.IRequest, err error) {
+	r.calls <- fmt.Sprintf("end %v", err)
+}
+
+func TestFragmentStreamRejected(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.MaxPackageSize = 64
+	utils.GlobalObject.MaxMessageSize = 1024
+	utils.GlobalObject.FragmentTimeout = 30
+	utils.GlobalObject.WorkerPoolSize = 0
+
+	rec := &streamRecorder{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		calls:   make(chan string, 8),
+	}
+
+	// 流式处理需要 Worker 保证分片的顺序
+	mh := NewMsgHandler()
+	mh.AddStreamRouter(7, rec)
+	if err := mh.Validate(); err == nil {
+		t.Fatal("stream router without worker pool should fail")
+	}
+
+	utils.GlobalObject.WorkerPoolSize = 1
+	utils.GlobalObject.MaxWorkerPoolSize = 1
+	utils.GlobalObject.MaxWorkerTaskLen = 1
+	utils.GlobalObject.RejectPolicy = RejectPolicyDrop
+	mh = NewMsgHandler()
+	mh.AddStreamRouter(7, rec)
+	rejected := make(chan struct{}, 1)
+	mh.SetOnReject(func(request ziface.IRequest, reason error) {
+		rejected <- struct{}{}
+	})
+	mh.StartWorkerPool()
+
+	chunkSize, err := maxChunkSize(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frags := splitFragments(7, 1, bytes.Repeat([]byte("0123456789"), 20), chunkSize)
+	if len(frags) != 4 {
+		t.Fatalf("fragments = %d, want 4", len(frags))
+	}
+	r := newReassembler(&Connection{ConnID: 1, MsgHandler: mh})
+
+	// 第一个分片占住 Worker，第二个分片填满队列，第三个分片被拒绝
+	if err := r.handle(frags[0], true); err != nil {
+		t.Fatal(err)
+	}
+	<-rec.entered
+	if err := r.handle(frags[1], true); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.handle(frags[2], true) }()
+	<-rejected
+	close(rec.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// 中止之后剩余的分片直接丢弃
+	if err := r.handle(frags[3], true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"chunk 0", "chunk 52", "end " + ErrFragmentRejected.Error()} {
+		select {
+		case call := <-rec.calls:
+			if call != want {
+				t.Fatalf("call = %q, want %q", call, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%q not called", want)
+		}
+	}
+	select {
+	case call := <-rec.calls:
+		t.Fatalf("unexpected call %q", call)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(r.assemblies) != 0 {
+		t.Fatalf("%d pending assemblies", len(r.assemblies))
+	}
+}
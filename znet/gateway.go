@@ -0,0 +1,656 @@
+package znet
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+var (
+	// ErrGatewayUnsupported 经过网关的虚拟链接不支持该操作
+	ErrGatewayUnsupported = errors.New("not supported over gateway")
+
+	// ErrBackendUnavailable 到后端的链接断开或者发送队列已满，消息没有转发
+	ErrBackendUnavailable = errors.New("backend unavailable")
+
+	// ErrGatewayMsgTooLarge 加上转发的包头之后超出了网关链接所能发送的长度，消息没有转发
+	ErrGatewayMsgTooLarge = errors.New("msg too large for gateway link")
+)
+
+const (
+	// 网关转发消息的内容 |ConnID(4)|MsgID(4)|Data|
+	gatewayHeadLen = 8
+	// 到后端的每个链接的发送队列长度
+	gatewayLinkQueueLen = 1024
+	// 发给每个客户端链接的回复队列长度，客户端读取太慢导致队列满时关闭该链接
+	gatewayReplyQueueLen = 256
+	// 到后端的链接断开后重新链接的等待时间，按指数退避
+	gatewayRedialBaseDelay = 100 * time.Millisecond
+	gatewayRedialMaxDelay  = 5 * time.Second
+)
+
+// gateway 网关模块，将 MsgID 范围内的消息转发给后端，并将后端的回复发送给原来的客户端链接
+type gateway struct {
+	server *Server
+	lock   sync.Mutex
+	// 后端地址对应的链接池
+	backends map[string]*backendPool
+	// 客户端链接的回复队列
+	replies map[uint32]*replyQueue
+	// 是否已经开始链接后端
+	started bool
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// backendPool 到一个后端的链接池，同一个客户端链接的消息总是使用同一个链接，保证消息的顺序
+type backendPool struct {
+	addr  string
+	links []*gatewayLink
+}
+
+// gatewayLink 到后端的一个链接，由单独的 Goroutine 保持链接，断开后按指数退避重新链接
+// 转发的消息只在锁中放入发送队列，链接断开期间直接返回 ErrBackendUnavailable
+type gatewayLink struct {
+	gw   *gateway
+	addr string
+	lock sync.Mutex
+	// 当前链接的发送队列，链接断开时为 nil
+	queue chan queuedMsg
+	// 已经在当前链接上发送过 MsgIDGatewayOpen 的客户端链接，以及最后一次发送给后端的身份
+	opened map[uint32]*ziface.Identity
+}
+
+// newGateway 创建网关模块
+func newGateway(server *Server) *gateway {
+	return &gateway{
+		server:   server,
+		backends: make(map[string]*backendPool),
+		replies:  make(map[uint32]*replyQueue),
+		exit:     make(chan struct{}),
+	}
+}
+
+// pool 获取（或创建）到后端的链接池
+func (gw *gateway) pool(addr string) *backendPool {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	if p, ok := gw.backends[addr]; ok {
+		return p
+	}
+	size := utils.GlobalObject.GatewayPoolSize
+	if size <= 0 {
+		size = 1
+	}
+	p := &backendPool{addr: addr, links: make([]*gatewayLink, size)}
+	for i := range p.links {
+		p.links[i] = &gatewayLink{gw: gw, addr: addr, opened: make(map[uint32]*ziface.Identity)}
+		if gw.started {
+			gw.wg.Add(1)
+			go p.links[i].run()
+		}
+	}
+	gw.backends[addr] = p
+	return p
+}
+
+// pools 获取所有的链接池
+func (gw *gateway) pools() []*backendPool {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	pools := make([]*backendPool, 0, len(gw.backends))
+	for _, p := range gw.backends {
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// start 开始链接所有的后端
+func (gw *gateway) start() {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	if gw.started {
+		return
+	}
+	gw.started = true
+	for _, p := range gw.backends {
+		for _, link := range p.links {
+			gw.wg.Add(1)
+			go link.run()
+		}
+	}
+}
+
+// stop 断开与所有后端的链接
+func (gw *gateway) stop() {
+	select {
+	case <-gw.exit:
+		return
+	default:
+	}
+	close(gw.exit)
+	gw.wg.Wait()
+}
+
+// connClosed 客户端链接断开时通知转发过它的消息的后端
+func (gw *gateway) connClosed(connID uint32) {
+	gw.lock.Lock()
+	delete(gw.replies, connID)
+	gw.lock.Unlock()
+
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, connID)
+	for _, p := range gw.pools() {
+		for _, link := range p.links {
+			link.lock.Lock()
+			if _, ok := link.opened[connID]; ok {
+				delete(link.opened, connID)
+				link.enqueue(queuedMsg{msgID: MsgIDGatewayClose, data: data})
+			}
+			link.lock.Unlock()
+		}
+	}
+}
+
+// run 保持到后端的链接，链接成功后发送 MsgIDGatewayHello，之后发送队列中的消息
+func (link *gatewayLink) run() {
+	defer link.gw.wg.Done()
+
+	for attempt := 1; ; attempt++ {
+		client := NewClient(link.addr)
+		client.AddHandler(MsgIDGatewayForward, link.gw.reply)
+		client.AddHandler(MsgIDGatewayClose, link.gw.closeConn)
+		disconnected := make(chan struct{})
+		client.SetOnDisconnect(func(ziface.IClient, error) {
+			close(disconnected)
+		})
+
+		err := client.Start()
+		if err == nil {
+			if err = client.SendMsg(MsgIDGatewayHello, []byte(utils.GlobalObject.GatewaySecret)); err == nil {
+				attempt = 1
+				fmt.Println("[Gateway] linked to backend ", link.addr)
+				err = link.send(client, disconnected)
+			}
+			client.Stop()
+		}
+		if err != nil {
+			fmt.Println("[Gateway] link to backend ", link.addr, " error ", err)
+		}
+
+		select {
+		case <-time.After(backoffDelay(gatewayRedialBaseDelay, gatewayRedialMaxDelay, attempt)):
+		case <-link.gw.exit:
+			return
+		}
+	}
+}
+
+// send 开始接受转发的消息并按顺序发送，直到链接断开或网关停止
+// 后端的虚拟链接随断开的链接一起关闭，重新链接后需要重新发送 MsgIDGatewayOpen
+func (link *gatewayLink) send(client *Client, disconnected chan struct{}) error {
+	queue := make(chan queuedMsg, gatewayLinkQueueLen)
+	link.lock.Lock()
+	link.queue = queue
+	link.opened = make(map[uint32]*ziface.Identity)
+	link.lock.Unlock()
+
+	defer func() {
+		link.lock.Lock()
+		link.queue = nil
+		link.opened = make(map[uint32]*ziface.Identity)
+		link.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case msg := <-queue:
+			if err := client.SendMsg(msg.msgID, msg.data); err != nil {
+				return err
+			}
+		case <-disconnected:
+			return nil
+		case <-link.gw.exit:
+			return nil
+		}
+	}
+}
+
+// enqueue 将消息放入发送队列，不会阻塞，调用方需持有锁
+func (link *gatewayLink) enqueue(msgs ...queuedMsg) error {
+	if link.queue == nil || cap(link.queue)-len(link.queue) < len(msgs) {
+		return ErrBackendUnavailable
+	}
+	for _, msg := range msgs {
+		link.queue <- msg
+	}
+	return nil
+}
+
+// ready 链接是否可以转发消息
+func (link *gatewayLink) ready() bool {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	return link.queue != nil
+}
+
+// forward 将客户端链接的消息转发给后端，链接断开或队列已满时立即返回 ErrBackendUnavailable
+// 开启分片时大消息由链接拆分为分片发送
+func (link *gatewayLink) forward(conn ziface.IConnection, msgID uint32, data []byte) error {
+	// 发送失败会断开到后端的链接，超长的消息在放入队列之前拒绝
+	if uint64(gatewayHeadLen+len(data)) > uint64(maxSendLen()) {
+		return ErrGatewayMsgTooLarge
+	}
+	connID := conn.GetConnID()
+	msg := make([]byte, gatewayHeadLen+len(data))
+	binary.LittleEndian.PutUint32(msg, connID)
+	binary.LittleEndian.PutUint32(msg[4:], msgID)
+	copy(msg[gatewayHeadLen:], data)
+	msgs := []queuedMsg{{msgID: MsgIDGatewayForward, data: msg}}
+
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	// 第一次转发时打开后端的虚拟链接，之后身份变化（认证、恢复会话）时更新后端的身份
+	identity := conn.GetIdentity()
+	sent, opened := link.opened[connID]
+	if !opened || sent != identity {
+		openID := MsgIDGatewayOpen
+		if opened {
+			openID = MsgIDGatewayIdentity
+		}
+		open := make([]byte, 4)
+		binary.LittleEndian.PutUint32(open, connID)
+		if identity != nil {
+			encoded, err := json.Marshal(identity)
+			if err != nil {
+				return err
+			}
+			open = append(open, encoded...)
+		}
+		msgs = append([]queuedMsg{{msgID: openID, data: open}}, msgs...)
+	}
+	if err := link.enqueue(msgs...); err != nil {
+		return err
+	}
+	link.opened[connID] = identity
+	return nil
+}
+
+// replyQueue 发给一个客户端链接的后端回复，由单独的 Goroutine 发送
+// 读取太慢的客户端不会阻塞网关到后端的链接上的其它客户端
+type replyQueue struct {
+	conn  ziface.IConnection
+	queue chan queuedMsg
+}
+
+// run 按顺序发送回复，直到客户端链接关闭
+func (q *replyQueue) run() {
+	for {
+		select {
+		case msg := <-q.queue:
+			q.conn.SendMsg(msg.msgID, msg.data)
+		case <-q.conn.Context().Done():
+			return
+		}
+	}
+}
+
+// reply 将后端的回复放入原来的客户端链接的回复队列
+func (gw *gateway) reply(client ziface.IClient, msg ziface.IMessage) {
+	data := msg.GetData()
+	if len(data) < gatewayHeadLen {
+		return
+	}
+	connID := binary.LittleEndian.Uint32(data)
+	conn, err := gw.server.ConnMgr.Get(connID)
+	if err != nil {
+		// 客户端链接已经断开
+		return
+	}
+
+	gw.lock.Lock()
+	q, ok := gw.replies[connID]
+	if !ok {
+		if conn.Context().Err() != nil {
+			// 链接正在停止，connClosed 已经或即将移除它的回复队列
+			gw.lock.Unlock()
+			return
+		}
+		q = &replyQueue{conn: conn, queue: make(chan queuedMsg, gatewayReplyQueueLen)}
+		gw.replies[connID] = q
+		go q.run()
+	}
+	gw.lock.Unlock()
+
+	select {
+	case q.queue <- queuedMsg{msgID: binary.LittleEndian.Uint32(data[4:]), data: data[gatewayHeadLen:]}:
+	default:
+		fmt.Println("[Gateway] reply queue of ConnID=", connID, " is full, close it")
+		// 关闭 socket，由链接的 Reader 停止链接
+		conn.GetTCPConnection().Close()
+	}
+}
+
+// closeConn 后端要求关闭客户端链接
+func (gw *gateway) closeConn(client ziface.IClient, msg ziface.IMessage) {
+	if len(msg.GetData()) < 4 {
+		return
+	}
+	if conn, err := gw.server.ConnMgr.Get(binary.LittleEndian.Uint32(msg.GetData())); err == nil {
+		// 关闭 socket，由链接的 Reader 停止链接
+		conn.GetTCPConnection().Close()
+	}
+}
+
+// ForwardRouter 将消息转发给后端的路由，同一个客户端链接总是转发给同一个后端
+type ForwardRouter struct {
+	BaseRouter
+	backends []*backendPool
+}
+
+// Handle 转发消息，后端的回复由网关发送给客户端
+func (r *ForwardRouter) Handle(request ziface.IRequest) {
+	connID := request.GetConnection().GetConnID()
+	p := r.backends[connID%uint32(len(r.backends))]
+	link := p.links[connID%uint32(len(p.links))]
+	if err := link.forward(request.GetConnection(), request.GetMsgID(), request.GetData()); err != nil {
+		fmt.Println("[Gateway] forward msgID=", request.GetMsgID(), " to ", p.addr, " error ", err)
+	}
+}
+
+// AddForward 将 [start, end] 范围内的消息转发给后端，多个后端时按链接 ID 分配
+// 每个 MsgID 注册一个 ForwardRouter，路由选项、中间件和角色检查对转发的消息同样生效
+func (s *Server) AddForward(start, end uint32, backends []string, opts ...ziface.RouteOption) {
+	if start > end || len(backends) == 0 {
+		panic(fmt.Sprintf("invalid forward range [%d, %d] to %v", start, end, backends))
+	}
+	if s.gateway == nil {
+		s.gateway = newGateway(s)
+	}
+
+	router := &ForwardRouter{}
+	for _, addr := range backends {
+		router.backends = append(router.backends, s.gateway.pool(addr))
+	}
+	for msgID := start; ; msgID++ {
+		s.AddRouter(msgID, router, opts...)
+		if msgID == end {
+			break
+		}
+	}
+}
+
+// gatewayPeer 后端上一个网关链接转发的所有客户端链接
+type gatewayPeer struct {
+	lock  sync.Mutex
+	conns map[uint32]*gatewayConn
+}
+
+// gatewayConn 后端上代表网关另一侧客户端链接的虚拟链接，回复的消息经由网关链接发送
+type gatewayConn struct {
+	*Connection
+	// 客户端链接在网关上的 ID
+	remoteID uint32
+	// 网关链接
+	link *Connection
+	peer *gatewayPeer
+}
+
+// newGatewayConn 创建虚拟链接，使用后端分配的链接 ID，不加入 ConnMgr
+func newGatewayConn(link *Connection, peer *gatewayPeer, remoteID uint32, identity *ziface.Identity) *gatewayConn {
+	connID := remoteID
+	if s, ok := link.TCPServer.(interface{ nextConnID() uint32 }); ok {
+		connID = s.nextConnID()
+	}
+	c := &Connection{
+		TCPServer:  link.TCPServer,
+		ConnID:     connID,
+		MsgHandler: link.MsgHandler,
+		property:   make(map[string]interface{}),
+		identity:   identity,
+		reliable:   newReliableBuffer(),
+	}
+	c.ctx, c.cancel = context.WithCancel(link.ctx)
+	return &gatewayConn{Connection: c, remoteID: remoteID, link: link, peer: peer}
+}
+
+// SendMsg 经由网关发送给客户端
+func (gc *gatewayConn) SendMsg(msgID uint32, data []byte) error {
+	if gc.ctx.Err() != nil {
+		return ErrConnClosed
+	}
+	// 网关收到超长的消息会断开链接，影响同一个网关链接上的其它客户端
+	if uint64(gatewayHeadLen+len(data)) > uint64(maxSendLen()) {
+		return ErrGatewayMsgTooLarge
+	}
+	msg := make([]byte, gatewayHeadLen+len(data))
+	binary.LittleEndian.PutUint32(msg, gc.remoteID)
+	binary.LittleEndian.PutUint32(msg[4:], msgID)
+	copy(msg[gatewayHeadLen:], data)
+	return gc.link.SendMsg(MsgIDGatewayForward, msg)
+}
+
+// SendObj 使用该 MsgID 对应的序列化器将对象编码后再经由网关发送
+func (gc *gatewayConn) SendObj(msgID uint32, v interface{}) error {
+	data, err := gc.TCPServer.GetMsgSerializer(msgID).Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode msg id=%d error %v", msgID, err)
+	}
+	return gc.SendMsg(msgID, data)
+}
+
+// SendMsgReliable 客户端的确认消息由网关处理，虚拟链接不支持可靠消息
+func (gc *gatewayConn) SendMsgReliable(msgID uint32, data []byte, callback ziface.DeliveryCallback) (uint64, error) {
+	return 0, ErrGatewayUnsupported
+}
+
+// SetProPerty 设置属性，观察者收到的是虚拟链接
+func (gc *gatewayConn) SetProPerty(key string, value interface{}) {
+	gc.setProPerty(gc, key, value)
+}
+
+// RemoveProPerty 移除属性，观察者收到的是虚拟链接
+func (gc *gatewayConn) RemoveProPerty(key string) {
+	gc.removeProPerty(gc, key)
+}
+
+// GetOrSetProPerty 属性不存在时设置为 value，观察者收到的是虚拟链接
+func (gc *gatewayConn) GetOrSetProPerty(key string, value interface{}) (interface{}, bool) {
+	return gc.getOrSetProPerty(gc, key, value)
+}
+
+// CompareAndSwapProPerty 属性的当前值等于 old 时替换为 value，观察者收到的是虚拟链接
+func (gc *gatewayConn) CompareAndSwapProPerty(key string, old, value interface{}) bool {
+	return gc.compareAndSwapProPerty(gc, key, old, value)
+}
+
+// RemoteAddr 获取网关的地址
+func (gc *gatewayConn) RemoteAddr() net.Addr {
+	return gc.link.RemoteAddr()
+}
+
+// Start 虚拟链接随网关链接的消息启动
+func (gc *gatewayConn) Start() {
+}
+
+// Stop 后端主动关闭客户端链接，通知网关关闭
+func (gc *gatewayConn) Stop() {
+	if gc.close() {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, gc.remoteID)
+		gc.link.SendMsg(MsgIDGatewayClose, data)
+	}
+}
+
+// close 移除虚拟链接并调用 OnConnStop，返回 false 表示已经关闭
+func (gc *gatewayConn) close() bool {
+	gc.peer.lock.Lock()
+	if gc.peer.conns[gc.remoteID] != gc {
+		gc.peer.lock.Unlock()
+		return false
+	}
+	delete(gc.peer.conns, gc.remoteID)
+	gc.peer.lock.Unlock()
+
+	gc.cancel()
+	gc.TCPServer.CallOnConnStop(gc)
+	return true
+}
+
+// gatewayAccept 校验网关的密钥，后端没有设置 GatewaySecret 时不接受网关的链接
+func gatewayAccept(secret []byte) bool {
+	expected := utils.GlobalObject.GatewaySecret
+	return expected != "" && subtle.ConstantTimeCompare(secret, []byte(expected)) == 1
+}
+
+// handleGateway 后端处理网关发送的消息，返回 false 表示该消息不是网关消息
+// 转发的消息交给虚拟链接处理，消息的缓冲随请求一起交出
+func (c *Connection) handleGateway(msg ziface.IMessage) bool {
+	msgID := msg.GetMsgID()
+	if !isGatewayMsg(msgID) {
+		return false
+	}
+
+	if msgID == MsgIDGatewayHello {
+		defer releaseMsg(msg)
+		if !gatewayAccept(msg.GetData()) {
+			fmt.Println("ConnID=", c.ConnID, " gateway hello rejected")
+			c.Conn.Close()
+			return true
+		}
+		c.setGatewayPeer(&gatewayPeer{conns: make(map[uint32]*gatewayConn)})
+		// 网关的链接不需要认证，客户端的身份由网关转发
+		if c.authTimer != nil {
+			c.authTimer.Stop()
+		}
+		return true
+	}
+
+	peer := c.getGatewayPeer()
+	data := msg.GetData()
+	if peer == nil || len(data) < 4 {
+		fmt.Println("ConnID=", c.ConnID, " gateway msg from non-gateway connection dropped")
+		releaseMsg(msg)
+		return true
+	}
+	remoteID := binary.LittleEndian.Uint32(data)
+
+	switch msgID {
+	case MsgIDGatewayOpen:
+		identity := decodeGatewayIdentity(data[4:])
+		releaseMsg(msg)
+		// 重复打开的虚拟链接先按正常的流程关闭，调用 OnConnStop
+		peer.lock.Lock()
+		old := peer.conns[remoteID]
+		peer.lock.Unlock()
+		if old != nil {
+			old.close()
+		}
+		gc := newGatewayConn(c, peer, remoteID, identity)
+		peer.lock.Lock()
+		peer.conns[remoteID] = gc
+		peer.lock.Unlock()
+		c.TCPServer.CallOnConnStart(gc)
+
+	case MsgIDGatewayIdentity:
+		identity := decodeGatewayIdentity(data[4:])
+		releaseMsg(msg)
+		peer.lock.Lock()
+		gc, ok := peer.conns[remoteID]
+		peer.lock.Unlock()
+		if ok {
+			// 虚拟链接不加入 ConnMgr，只更新身份，不按用户 ID 索引
+			gc.propertyLock.Lock()
+			gc.identity = identity
+			gc.propertyLock.Unlock()
+		}
+
+	case MsgIDGatewayForward:
+		peer.lock.Lock()
+		gc, ok := peer.conns[remoteID]
+		peer.lock.Unlock()
+		if !ok || len(data) < gatewayHeadLen {
+			releaseMsg(msg)
+			return true
+		}
+		// 在原缓冲中去掉转发的包头，得到客户端原来的消息
+		m := msg.(*Message)
+		m.ID = binary.LittleEndian.Uint32(data[4:])
+		m.Data = data[gatewayHeadLen:]
+		m.DataLen = uint32(len(m.Data))
+		if !c.dispatch(&Request{conn: gc, msg: m}) {
+			c.Conn.Close()
+		}
+
+	case MsgIDGatewayClose:
+		releaseMsg(msg)
+		peer.lock.Lock()
+		gc, ok := peer.conns[remoteID]
+		peer.lock.Unlock()
+		if ok {
+			gc.close()
+		}
+	}
+	return true
+}
+
+// decodeGatewayIdentity 解码网关转发的客户端身份，没有身份或解码失败时为 nil
+func decodeGatewayIdentity(data []byte) *ziface.Identity {
+	if len(data) == 0 {
+		return nil
+	}
+	identity := &ziface.Identity{}
+	if err := json.Unmarshal(data, identity); err != nil {
+		return nil
+	}
+	return identity
+}
+
+// closeGatewayConns 网关链接断开时关闭它转发的所有虚拟链接
+func (c *Connection) closeGatewayConns() {
+	peer := c.getGatewayPeer()
+	if peer == nil {
+		return
+	}
+	peer.lock.Lock()
+	conns := make([]*gatewayConn, 0, len(peer.conns))
+	for _, gc := range peer.conns {
+		conns = append(conns, gc)
+	}
+	peer.lock.Unlock()
+
+	for _, gc := range conns {
+		gc.close()
+	}
+}
+
+// getGatewayPeer 获取网关链接转发的客户端链接，不是网关链接时为 nil
+func (c *Connection) getGatewayPeer() *gatewayPeer {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	return c.gatewayPeer
+}
+
+// setGatewayPeer 将链接标记为网关链接
+func (c *Connection) setGatewayPeer(peer *gatewayPeer) {
+	c.propertyLock.Lock()
+	defer c.propertyLock.Unlock()
+
+	c.gatewayPeer = peer
+}
@@ -0,0 +1,269 @@
+package znet
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// startGatewayTest 启动后端和网关，网关认证后将 10-19 转发给后端，MsgID 1 在网关本地处理
+// whitelist 为认证之前也可以转发的 MsgID，返回之前等待网关链接后端，链接断开期间转发直接失败
+func startGatewayTest(t *testing.T, setup func(backend *Server), whitelist ...uint32) (backend, gw *Server) {
+	t.Helper()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.GatewaySecret = "gateway-secret"
+
+	utils.GlobalObject.TCPPort = freePort(t)
+	backend = NewServer("backend").(*Server)
+	setup(backend)
+	backend.Start()
+
+	utils.GlobalObject.TCPPort = freePort(t)
+	gw = NewServer("gateway").(*Server)
+	gw.SetAuthenticator(func(conn ziface.IConnection, token []byte) (*ziface.Identity, error) {
+		return &ziface.Identity{UserID: string(token)}, nil
+	}, whitelist...)
+	gw.AddHandlerFunc(1, func(request ziface.IRequest) {
+		request.GetConnection().SendMsg(1, []byte("local"))
+	})
+	gw.AddForward(10, 19, []string{fmt.Sprintf("127.0.0.1:%d", backend.Port)})
+	gw.Start()
+
+	for deadline := time.Now().Add(3 * time.Second); !gatewayLinksReady(gw, true); {
+		if time.Now().After(deadline) {
+			t.Fatal("gateway not linked to backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return backend, gw
+}
+
+// gatewayLinksReady 网关到后端的所有链接是否都处于 ready 状态
+func gatewayLinksReady(gw *Server, ready bool) bool {
+	for _, p := range gw.gateway.pools() {
+		for _, link := range p.links {
+			if link.ready() != ready {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestGatewayForward(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.GatewayPoolSize = 2
+
+	// 后端：回复 用户:内容，MsgID 11 关闭客户端链接
+	var stopped int32
+	backend, gw := startGatewayTest(t, func(backend *Server) {
+		backend.SetOnConnStop(func(conn ziface.IConnection) {
+			if _, ok := conn.(*gatewayConn); ok {
+				atomic.AddInt32(&stopped, 1)
+			}
+		})
+		backend.AddHandlerFunc(10, func(request ziface.IRequest) {
+			userID := request.GetConnection().GetIdentity().UserID
+			request.GetConnection().SendMsg(10, []byte(userID+":"+string(request.GetData())))
+		})
+		backend.AddHandlerFunc(11, func(request ziface.IRequest) {
+			request.GetConnection().Stop()
+		})
+	})
+	defer backend.Stop()
+	defer gw.Stop()
+
+	alice := loginTest(t, gw.Port, "alice")
+	defer alice.Close()
+	bob := loginTest(t, gw.Port, "bob")
+	defer bob.Close()
+
+	// 回复按链接 ID 回到原来的客户端，身份随转发传给后端
+	for i := 0; i < 3; i++ {
+		sendTestMsg(alice, 10, []byte(fmt.Sprint("a", i)))
+		sendTestMsg(bob, 10, []byte(fmt.Sprint("b", i)))
+	}
+	for i := 0; i < 3; i++ {
+		if msg := readTestMsg(t, alice); msg.ID != 10 || string(msg.Data) != fmt.Sprint("alice:a", i) {
+			t.Fatalf("alice got id=%d data=%s", msg.ID, msg.Data)
+		}
+		if msg := readTestMsg(t, bob); msg.ID != 10 || string(msg.Data) != fmt.Sprint("bob:b", i) {
+			t.Fatalf("bob got id=%d data=%s", msg.ID, msg.Data)
+		}
+	}
+	sendTestMsg(alice, 1, nil)
+	if msg := readTestMsg(t, alice); msg.ID != 1 || string(msg.Data) != "local" {
+		t.Fatalf("local msg id=%d data=%s", msg.ID, msg.Data)
+	}
+
+	// 后端关闭 bob 的虚拟链接，网关关闭 bob 的链接
+	sendTestMsg(bob, 11, nil)
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bob.Read(make([]byte, 1)); err == nil {
+		t.Fatal("bob not closed by backend")
+	}
+
+	// alice 断开后后端的虚拟链接随之关闭
+	alice.Close()
+	for deadline := time.Now().Add(3 * time.Second); atomic.LoadInt32(&stopped) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend virtual conns stopped=%d, want 2", atomic.LoadInt32(&stopped))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 后端停止后转发立即失败，不等待重新链接
+	backend.Stop()
+	for deadline := time.Now().Add(3 * time.Second); !gatewayLinksReady(gw, false); {
+		if time.Now().After(deadline) {
+			t.Fatal("gateway links not down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	link := gw.gateway.pools()[0].links[0]
+	if err := link.forward(&Connection{ConnID: 99}, 10, nil); err != ErrBackendUnavailable {
+		t.Fatalf("forward to stopped backend err=%v", err)
+	}
+}
+
+func TestGatewayFragments(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.MaxPackageSize = 64
+	utils.GlobalObject.MaxMessageSize = 4096
+
+	// 请求和回复都超过 MaxPackageSize，在客户端、网关、后端之间拆分为分片
+	backend, gw := startGatewayTest(t, func(backend *Server) {
+		backend.AddHandlerFunc(10, func(request ziface.IRequest) {
+			userID := request.GetConnection().GetIdentity().UserID
+			request.GetConnection().SendMsg(10, []byte(userID+":"+string(request.GetData())))
+		})
+	})
+	defer backend.Stop()
+	defer gw.Stop()
+
+	replies := make(chan ziface.IMessage, 2)
+	client := NewClient(fmt.Sprintf("127.0.0.1:%d", gw.Port))
+	client.AddHandler(MsgIDAuth, func(c ziface.IClient, msg ziface.IMessage) { replies <- msg })
+	client.AddHandler(10, func(c ziface.IClient, msg ziface.IMessage) { replies <- msg })
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	read := func() ziface.IMessage {
+		select {
+		case msg := <-replies:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("no reply")
+		}
+		return nil
+	}
+
+	client.SendMsg(MsgIDAuth, []byte("alice"))
+	if msg := read(); msg.GetData()[0] != AuthOK {
+		t.Fatalf("auth reply %v", msg.GetData())
+	}
+	data := strings.Repeat("0123456789", 100)
+	if err := client.SendMsg(10, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := read(); msg.GetMsgID() != 10 || string(msg.GetData()) != "alice:"+data {
+		t.Fatalf("reply id=%d len=%d", msg.GetMsgID(), len(msg.GetData()))
+	}
+
+	// 加上转发的包头之后超长的消息直接拒绝，不影响到后端的链接
+	link := gw.gateway.pools()[0].links[0]
+	if err := link.forward(&Connection{ConnID: 99}, 10, make([]byte, 4096)); err != ErrGatewayMsgTooLarge {
+		t.Fatalf("forward too large err=%v", err)
+	}
+	if !link.ready() {
+		t.Fatal("gateway link down after too large msg")
+	}
+}
+
+func TestGatewayIdentityUpdate(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.GatewayPoolSize = 1
+
+	// MsgID 12 认证之前也转发给后端，后端回复当前的用户
+	backend, gw := startGatewayTest(t, func(backend *Server) {
+		backend.AddHandlerFunc(12, func(request ziface.IRequest) {
+			userID := "anonymous"
+			if identity := request.GetConnection().GetIdentity(); identity != nil {
+				userID = identity.UserID
+			}
+			request.GetConnection().SendMsg(12, []byte(userID))
+		})
+	}, 12)
+	defer backend.Stop()
+	defer gw.Stop()
+
+	conn := dialTest(t, gw.Port)
+	defer conn.Close()
+	sendTestMsg(conn, 12, nil)
+	if msg := readTestMsg(t, conn); msg.ID != 12 || string(msg.Data) != "anonymous" {
+		t.Fatalf("before auth id=%d data=%s", msg.ID, msg.Data)
+	}
+
+	// 认证之后后端的虚拟链接得到新的身份
+	sendTestMsg(conn, MsgIDAuth, []byte("alice"))
+	if msg := readTestMsg(t, conn); msg.ID != MsgIDAuth || msg.Data[0] != AuthOK {
+		t.Fatalf("auth reply id=%x data=%v", msg.ID, msg.Data)
+	}
+	sendTestMsg(conn, 12, nil)
+	if msg := readTestMsg(t, conn); msg.ID != 12 || string(msg.Data) != "alice" {
+		t.Fatalf("after auth id=%d data=%s", msg.ID, msg.Data)
+	}
+}
+
+func TestGatewayReopen(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.GatewaySecret = "gateway-secret"
+
+	// 同一个客户端链接重复打开时，原来的虚拟链接按正常的流程关闭
+	events := make(chan string, 4)
+	backend := NewServer("backend").(*Server)
+	backend.SetOnConnStart(func(conn ziface.IConnection) {
+		if gc, ok := conn.(*gatewayConn); ok {
+			events <- fmt.Sprint("start ", gc.GetIdentity().UserID)
+		}
+	})
+	backend.SetOnConnStop(func(conn ziface.IConnection) {
+		if gc, ok := conn.(*gatewayConn); ok {
+			events <- fmt.Sprint("stop ", gc.GetIdentity().UserID, " ", gc.Context().Err())
+		}
+	})
+	backend.Start()
+	defer backend.Stop()
+
+	conn := dialTest(t, backend.Port)
+	defer conn.Close()
+	sendTestMsg(conn, MsgIDGatewayHello, []byte("gateway-secret"))
+	for _, userID := range []string{"alice", "bob"} {
+		open := []byte{5, 0, 0, 0}
+		open = append(open, fmt.Sprintf(`{"UserID":%q}`, userID)...)
+		sendTestMsg(conn, MsgIDGatewayOpen, open)
+	}
+
+	for _, want := range []string{"start alice", "stop alice context canceled", "start bob"} {
+		select {
+		case event := <-events:
+			if event != want {
+				t.Fatalf("event = %q, want %q", event, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%q not called", want)
+		}
+	}
+}
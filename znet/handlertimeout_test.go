@@ -0,0 +1,118 @@
+package znet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.HandlerTimeout = 30
+
+	mh := NewMsgHandler()
+	timeouts := make(chan time.Duration, 4)
+	mh.SetOnHandlerTimeout(func(request ziface.IRequest, timeout time.Duration) {
+		if request.GetMsgID() == 3 {
+			t.Errorf("msg 3 without timeout reported")
+		}
+		timeouts <- timeout
+	})
+
+	// MsgID 1 使用全局的超时时间，Context 到期后继续处理一段时间
+	var deadline time.Time
+	var hasDeadline bool
+	var ctxErr error
+	mh.AddRouter(1, FuncRouter(func(request ziface.IRequest) {
+		deadline, hasDeadline = request.Context().Deadline()
+		<-request.Context().Done()
+		ctxErr = request.Context().Err()
+		time.Sleep(50 * time.Millisecond)
+	}))
+	// MsgID 2 单独设置更短的超时时间，忽略 Context 的慢业务
+	mh.AddRouter(2, FuncRouter(func(request ziface.IRequest) {
+		time.Sleep(100 * time.Millisecond)
+	}), WithTimeout(10*time.Millisecond))
+	// MsgID 3 关闭超时，使用链接的 Context
+	var ctx context.Context
+	mh.AddRouter(3, FuncRouter(func(request ziface.IRequest) {
+		ctx = request.Context()
+		time.Sleep(50 * time.Millisecond)
+	}), WithTimeout(0))
+
+	conn := &Connection{ConnID: 1}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	defer conn.cancel()
+	newReq := func(msgID uint32) *Request {
+		return &Request{conn: conn, msg: NewMessage(msgID, nil)}
+	}
+
+	start := time.Now()
+	mh.DoMsgHandler(newReq(1))
+	if d := deadline.Sub(start); !hasDeadline || d < 30*time.Millisecond || d > 50*time.Millisecond {
+		t.Fatalf("deadline = %v after start (%v), want 30ms", d, hasDeadline)
+	}
+	if ctxErr != context.DeadlineExceeded {
+		t.Fatalf("ctx err = %v, want DeadlineExceeded", ctxErr)
+	}
+	if timeout := <-timeouts; timeout != 30*time.Millisecond {
+		t.Fatalf("timeout = %v, want 30ms", timeout)
+	}
+
+	mh.DoMsgHandler(newReq(2))
+	if timeout := <-timeouts; timeout != 10*time.Millisecond {
+		t.Fatalf("timeout = %v, want 10ms", timeout)
+	}
+
+	mh.DoMsgHandler(newReq(3))
+	if ctx != conn.Context() {
+		t.Fatal("request without timeout should use connection context")
+	}
+	if n := mh.HandlerTimeouts(); n != 2 {
+		t.Fatalf("handler timeouts = %d, want 2", n)
+	}
+}
+
+func TestHandlerContextCanceledOnClose(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+
+	// 业务一直等待 Context 结束，链接断开时取消，而不是等到超时
+	entered := make(chan struct{})
+	done := make(chan error, 1)
+	s := NewServer("timeout").(*Server)
+	s.AddHandlerFunc(1, func(request ziface.IRequest) {
+		close(entered)
+		<-request.Context().Done()
+		done <- request.Context().Err()
+	}, WithTimeout(time.Minute))
+	s.Start()
+	defer s.Stop()
+
+	conn := dialTest(t, s.Port)
+	sendTestMsg(conn, 1, nil)
+	select {
+	case <-entered:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler not called")
+	}
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("ctx err = %v, want Canceled", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("request context not canceled on connection close")
+	}
+	if n := s.MsgHandler.(*MsgHandler).HandlerTimeouts(); n != 0 {
+		t.Fatalf("handler timeouts = %d, want 0", n)
+	}
+}
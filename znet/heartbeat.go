@@ -0,0 +1,40 @@
+package znet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// maxHeartbeatNonce 心跳 Nonce 的最大长度，更长的心跳不回复
+const maxHeartbeatNonce = 8
+
+// newHeartbeatBucket 按照配置创建链接的心跳令牌桶，未设置速率时返回 nil，超出限制的心跳总是丢弃
+func newHeartbeatBucket() *tokenBucket {
+	limit := utils.GlobalObject.HeartbeatRateLimit
+	limit.Action = RateLimitDrop
+	return newTokenBucket(limit)
+}
+
+// handleHeartbeat 原样回复客户端的心跳，返回 false 表示该消息不是心跳消息
+// 心跳不计入消息的限流，使用单独的令牌桶，Nonce 过长或超出限制时不回复
+func (c *Connection) handleHeartbeat(msg ziface.IMessage) bool {
+	if msg.GetMsgID() != MsgIDHeartbeat {
+		return false
+	}
+	if len(msg.GetData()) > maxHeartbeatNonce {
+		fmt.Printf("ConnID=%d heartbeat nonce too long, len=%d\n", c.ConnID, len(msg.GetData()))
+		return true
+	}
+	if c.heartbeat != nil {
+		if _, ok := c.heartbeat.take(time.Now()); !ok {
+			fmt.Printf("ConnID=%d exceeds %s rate limit, action=%s\n", c.ConnID, RateLimitScopeHeartbeat, RateLimitDrop)
+			c.TCPServer.CallOnRateLimit(c, MsgIDHeartbeat, RateLimitScopeHeartbeat)
+			return true
+		}
+	}
+	c.SendMsg(MsgIDHeartbeat, msg.GetData())
+	return true
+}
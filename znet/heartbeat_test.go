@@ -0,0 +1,55 @@
+package znet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestHeartbeatLimit(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	// 每个链接只回复两个心跳
+	utils.GlobalObject.HeartbeatRateLimit = utils.RateLimit{Rate: 0.001, Burst: 2}
+
+	s := NewServer("heartbeat").(*Server)
+	limited := make(chan string, 1)
+	s.SetOnRateLimit(func(conn ziface.IConnection, msgID uint32, scope string) {
+		if msgID == MsgIDHeartbeat {
+			limited <- scope
+		}
+	})
+	s.Start()
+	defer s.Stop()
+
+	conn := dialTest(t, s.Port)
+	defer conn.Close()
+
+	// Nonce 超过 8 字节的心跳不回复，也不消耗令牌
+	sendTestMsg(conn, MsgIDHeartbeat, []byte("123456789"))
+	for _, nonce := range []string{"12345678", "ping"} {
+		sendTestMsg(conn, MsgIDHeartbeat, []byte(nonce))
+		if msg := readTestMsg(t, conn); msg.ID != MsgIDHeartbeat || string(msg.Data) != nonce {
+			t.Fatalf("heartbeat reply id=%x data=%q, want %q", msg.ID, msg.Data, nonce)
+		}
+	}
+
+	// 超出心跳限制时丢弃，不回复
+	sendTestMsg(conn, MsgIDHeartbeat, []byte("ping"))
+	select {
+	case scope := <-limited:
+		if scope != RateLimitScopeHeartbeat {
+			t.Fatalf("rate limit scope %q", scope)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("heartbeat not rate limited")
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("rate limited heartbeat replied")
+	}
+}
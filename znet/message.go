@@ -2,9 +2,14 @@ package znet
 
 // Message 消息的封装
 type Message struct {
-	ID      uint32 // 消息的 ID
-	DataLen uint32 // 消息的长度
-	Data    []byte // 消息的内容
+	ID       uint32 // 消息的 ID
+	DataLen  uint32 // 消息的长度
+	Data     []byte // 消息的内容
+	Flags    uint8  // 消息的标志位，封包时写在 DataLen 的高 4 位
+	Checksum uint32 // 消息内容的校验值，开启校验时才有
+
+	// 消息内容所在的池化缓冲，从链接读取的消息才有
+	buf *[]byte
 }
 
 // NewMessage 创建一个 Message 消息包
@@ -31,6 +36,16 @@ func (m *Message) GetData() []byte {
 	return m.Data
 }
 
+// GetFlags 获取消息的标志位
+func (m *Message) GetFlags() uint8 {
+	return m.Flags
+}
+
+// GetChecksum 获取包头中消息内容的校验值
+func (m *Message) GetChecksum() uint32 {
+	return m.Checksum
+}
+
 // SetMsgID 设置消息的 ID
 func (m *Message) SetMsgID(id uint32) {
 	m.ID = id
@@ -45,3 +60,31 @@ func (m *Message) SetDataLen(datalen uint32) {
 func (m *Message) SetData(data []byte) {
 	m.Data = data
 }
+
+// SetFlags 设置消息的标志位
+func (m *Message) SetFlags(flags uint8) {
+	m.Flags = flags
+}
+
+// SetChecksum 设置消息内容的校验值
+func (m *Message) SetChecksum(checksum uint32) {
+	m.Checksum = checksum
+}
+
+// freeBuffer 将池化缓冲放回缓冲池，调用方需保证消息内容已不再引用该缓冲（如已解压）
+func (m *Message) freeBuffer() {
+	if m.buf != nil {
+		putBuffer(m.buf)
+		m.buf = nil
+	}
+}
+
+// release 将池化缓冲放回缓冲池并清空消息内容
+func (m *Message) release() {
+	if m.buf == nil {
+		return
+	}
+	m.freeBuffer()
+	m.Data = nil
+	m.DataLen = 0
+}
@@ -1,93 +1,630 @@
 package znet
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/646222472/zinx/utils"
 	"github.com/646222472/zinx/ziface"
 )
 
+// 任务队列已满时的拒绝策略
+const (
+	RejectPolicyBlock = "block" // 阻塞 Reader 直到队列有空位
+	RejectPolicyDrop  = "drop"  // 丢弃当前请求
+	RejectPolicyClose = "close" // 丢弃当前请求并关闭链接
+)
+
+// ErrTaskQueueFull Worker 的任务队列已满，请求被拒绝
+var ErrTaskQueueFull = errors.New("worker task queue is full")
+
+// worker 工作池中的一个 Worker
+type worker struct {
+	// Worker 的编号
+	id int
+	// 当前 Worker 取任务的消息队列，每个优先级一条，下标即优先级
+	lanes [priorityLevels]chan ziface.IRequest
+	// 已分配给该 Worker 但还没有处理完的任务数（包括正在处理的）
+	pending uint32
+	// 积压超过高水位时创建，回落到低水位后关闭，用于通知 Reader 恢复读取
+	resume chan struct{}
+}
+
+// connBinding 链接与 Worker 的绑定关系
+// 一个链接还有未处理完的任务时固定交给同一个 Worker，从而保证同一链接内消息的处理顺序
+type connBinding struct {
+	worker  *worker
+	pending uint32
+}
+
 // MsgHandler 消息处理模块的实现
 type MsgHandler struct {
 	// 存放每个 MsgID 所对应的处理方法
 	Apis map[uint32]ziface.IRouter
-	// 负责 Worker 取任务的消息队列
-	TaskQueue []chan ziface.IRequest
-	// 业务工作 Worker 池的 worker 数量
+	// 存放流式处理分片消息的 MsgID 所对应的处理方法
+	Streams map[uint32]ziface.IStreamRouter
+	// 存放每个 MsgID 注册时的路由配置
+	routeConfigs map[uint32]*ziface.RouteConfig
+	// 路由分组，按创建的顺序存放
+	groups []ziface.IRouterGroup
+	// 业务工作 Worker 池的 worker 数量（弹性伸缩时的最小数量）
 	WorkerPoolSize uint32
+	// 弹性伸缩时 Worker 数量的上限
+	MaxWorkerPoolSize uint32
+	// 每个 Worker 任务队列的长度
+	maxWorkerTaskLen uint32
+	// 空闲 Worker 的回收时间
+	workerIdleTimeout time.Duration
+	// 暂停、恢复读取 socket 的积压任务数
+	highWater, lowWater uint32
+	// 任务队列已满时的拒绝策略
+	rejectPolicy string
+	// 当前存活的 Worker
+	workers []*worker
+	// 下一个 Worker 的编号
+	nextWorkerID int
+	// 链接ID 与 Worker 的绑定关系
+	bindings map[uint32]*connBinding
+	// 保护 workers、bindings 及任务计数的锁
+	poolLock sync.Mutex
+	// 请求被拒绝时的回调
+	onReject func(request ziface.IRequest, reason error)
+	// 业务处理超时的次数
+	handlerTimeouts uint64
+	// 业务处理超时时的回调
+	onHandlerTimeout func(request ziface.IRequest, timeout time.Duration)
 }
 
 // NewMsgHandler 初始化/创建 MsgHandler 方法
 func NewMsgHandler() *MsgHandler {
+	maxPoolSize := utils.GlobalObject.MaxWorkerPoolSize
+	if maxPoolSize < utils.GlobalObject.WorkerPoolSize {
+		maxPoolSize = utils.GlobalObject.WorkerPoolSize
+	}
+
+	highWater := utils.GlobalObject.TaskQueueHighWater
+	if highWater == 0 {
+		highWater = utils.GlobalObject.MaxWorkerTaskLen * 3 / 4
+	}
+	if highWater == 0 {
+		// 队列很短时 3/4 为 0，至少积压一个任务才暂停读取
+		highWater = 1
+	}
+	lowWater := utils.GlobalObject.TaskQueueLowWater
+	if lowWater == 0 {
+		lowWater = utils.GlobalObject.MaxWorkerTaskLen / 4
+	}
+
 	return &MsgHandler{
-		Apis:           make(map[uint32]ziface.IRouter),
-		TaskQueue:      make([]chan ziface.IRequest, utils.GlobalObject.WorkerPoolSize),
-		WorkerPoolSize: utils.GlobalObject.WorkerPoolSize,
+		Apis:              make(map[uint32]ziface.IRouter),
+		Streams:           make(map[uint32]ziface.IStreamRouter),
+		routeConfigs:      make(map[uint32]*ziface.RouteConfig),
+		WorkerPoolSize:    utils.GlobalObject.WorkerPoolSize,
+		MaxWorkerPoolSize: maxPoolSize,
+		maxWorkerTaskLen:  utils.GlobalObject.MaxWorkerTaskLen,
+		workerIdleTimeout: time.Duration(utils.GlobalObject.WorkerIdleTimeout) * time.Second,
+		highWater:         highWater,
+		lowWater:          lowWater,
+		rejectPolicy:      utils.GlobalObject.RejectPolicy,
+		bindings:          make(map[uint32]*connBinding),
 	}
 }
 
 // DoMsgHandler 调度/执行对应的 Router 消息处理方法
 func (mh *MsgHandler) DoMsgHandler(request ziface.IRequest) {
 	// 从 Request 中找到 MsgID
-	handler, ok := mh.Apis[request.GetMsgID()]
+	handle, ok := mh.handleFunc(request.GetMsgID())
 	if !ok {
 		fmt.Printf("Api msgID=%d is NOT FOUND! Need Register\n", request.GetMsgID())
+		return
+	}
+
+	// 检查链接的身份是否拥有该消息要求的角色
+	config := mh.routeConfig(request.GetMsgID())
+	if !mh.authorize(request, config) {
+		return
+	}
+
+	// 请求的 Context 派生自链接的 Context，并带上该 MsgID 的超时时间
+	if timeout := config.Timeout; timeout > 0 {
+		if req, ok := request.(*Request); ok {
+			parent := req.Context()
+			if parent == nil {
+				parent = context.Background()
+			}
+			ctx, cancel := context.WithTimeout(parent, timeout)
+			defer cancel()
+			req.ctx = ctx
+		}
+
+		// 超过时间仍未处理完时记录下来，业务本身需要通过 Context 感知超时并尽快返回
+		watchdog := time.AfterFunc(timeout, func() {
+			mh.handlerTimeout(request, timeout)
+		})
+		defer watchdog.Stop()
 	}
 
-	// 根据 MsgID 调度对应的 Router 业务
-	handler.PreHandle(request)
-	handler.Handle(request)
-	handler.PostHandle(request)
+	// 根据 MsgID 调度对应的 Router 业务，外面依次包上分组的中间件和该消息的中间件
+	var middlewares []ziface.Middleware
+	if config.Group != nil {
+		middlewares = append(middlewares, config.Group.Middlewares()...)
+	}
+	middlewares = append(middlewares, config.Middlewares...)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handle = middlewares[i](handle)
+	}
+	handle(request)
 }
 
-// AddRouter 为消息添加具体的处理逻辑
-func (mh *MsgHandler) AddRouter(msgID uint32, router ziface.IRouter) {
-	// 1.判断当前 MsgID 绑定的 API 处理方法是否已经存在
-	if _, ok := mh.Apis[msgID]; ok {
-		// id 已经注册了
-		panic("repeat api, MsgID=" + strconv.Itoa(int(msgID)))
+// authorize 检查链接的身份是否拥有该消息要求的角色，分组和消息各自要求的角色都需要满足其中之一
+// 未通过时回复 MsgIDForbidden 并记录审计日志
+func (mh *MsgHandler) authorize(request ziface.IRequest, config *ziface.RouteConfig) bool {
+	required := [][]string{config.Roles}
+	if config.Group != nil {
+		required = append(required, config.Group.Roles())
+	}
+
+	identity := request.GetConnection().GetIdentity()
+	for _, roles := range required {
+		if len(roles) == 0 || (identity != nil && hasAnyRole(identity, roles)) {
+			continue
+		}
+
+		userID := ""
+		if identity != nil {
+			userID = identity.UserID
+		}
+		fmt.Printf("[Audit] ConnID=%d UserID=%s MsgID=%d access denied, require roles %v\n",
+			request.GetConnection().GetConnID(), userID, request.GetMsgID(), roles)
+
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, request.GetMsgID())
+		request.GetConnection().SendMsg(MsgIDForbidden, data)
+		return false
+	}
+
+	return true
+}
+
+// hasAnyRole 身份是否拥有其中任意一个角色
+func hasAnyRole(identity *ziface.Identity, roles []string) bool {
+	for _, role := range roles {
+		for _, has := range identity.Roles {
+			if role == has {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleFunc 获取 MsgID 对应的业务处理方法
+func (mh *MsgHandler) handleFunc(msgID uint32) (ziface.HandlerFunc, bool) {
+	if router, ok := mh.Apis[msgID]; ok {
+		return func(request ziface.IRequest) {
+			router.PreHandle(request)
+			router.Handle(request)
+			router.PostHandle(request)
+		}, true
+	}
+
+	if stream, ok := mh.Streams[msgID]; ok {
+		return func(request ziface.IRequest) {
+			// 没有分片的消息作为只有一个分片的消息处理
+			chunk := &chunkInfo{total: uint32(len(request.GetData())), last: true}
+			if req, ok := request.(*Request); ok && req.chunk != nil {
+				chunk = req.chunk
+			}
+
+			if chunk.err != nil {
+				stream.HandleEnd(request, chunk.err)
+				return
+			}
+			stream.HandleChunk(request, chunk.offset, chunk.total)
+			if chunk.last {
+				stream.HandleEnd(request, nil)
+			}
+		}, true
 	}
 
+	return nil, false
+}
+
+// AddRouter 为消息添加具体的处理逻辑
+func (mh *MsgHandler) AddRouter(msgID uint32, router ziface.IRouter, opts ...ziface.RouteOption) {
+	// 1.判断当前 MsgID 是否可以注册
+	mh.checkMsgID(msgID)
+
 	// 2.添加 MsgID 和 API 的绑定关系
 	mh.Apis[msgID] = router
+	mh.routeConfigs[msgID] = newRouteConfig(opts...)
 	fmt.Println("Add api MsgID = ", msgID, " succ!")
 }
 
+// AddStreamRouter 为分片消息添加流式处理的逻辑
+func (mh *MsgHandler) AddStreamRouter(msgID uint32, stream ziface.IStreamRouter, opts ...ziface.RouteOption) {
+	mh.checkMsgID(msgID)
+
+	mh.Streams[msgID] = stream
+	mh.routeConfigs[msgID] = newRouteConfig(opts...)
+	fmt.Println("Add stream api MsgID = ", msgID, " succ!")
+}
+
+// IsStream 判断 MsgID 是否注册为流式处理
+func (mh *MsgHandler) IsStream(msgID uint32) bool {
+	_, ok := mh.Streams[msgID]
+	return ok
+}
+
+// checkMsgID 判断当前 MsgID 是否为框架保留的 MsgID，以及绑定的 API 处理方法是否已经存在
+func (mh *MsgHandler) checkMsgID(msgID uint32) {
+	if msgID >= MsgIDReservedStart {
+		panic("reserved api, MsgID=" + strconv.Itoa(int(msgID)))
+	}
+	if _, ok := mh.routeConfigs[msgID]; ok {
+		// id 已经注册了
+		panic("repeat api, MsgID=" + strconv.Itoa(int(msgID)))
+	}
+}
+
+// Group 创建（或获取同名的）路由分组，同名分组的 MsgID 范围必须一致
+func (mh *MsgHandler) Group(name string, start, end uint32, middlewares ...ziface.Middleware) ziface.IRouterGroup {
+	for _, group := range mh.groups {
+		if group.Name() != name {
+			continue
+		}
+		if groupStart, groupEnd := group.Range(); groupStart != start || groupEnd != end {
+			panic(fmt.Sprintf("router group %s already exists with range [%d, %d]", name, groupStart, groupEnd))
+		}
+		group.Use(middlewares...)
+		return group
+	}
+
+	group := NewRouterGroup(name, start, end, mh)
+	group.Use(middlewares...)
+	mh.groups = append(mh.groups, group)
+	fmt.Printf("Add router group %s [%d, %d] succ!\n", name, start, end)
+
+	return group
+}
+
+// Routes 获取所有已注册的路由，按 MsgID 排序
+func (mh *MsgHandler) Routes() []ziface.RouteInfo {
+	routes := make([]ziface.RouteInfo, 0, len(mh.routeConfigs))
+	for msgID, config := range mh.routeConfigs {
+		var router interface{} = mh.Apis[msgID]
+		if stream, ok := mh.Streams[msgID]; ok {
+			router = stream
+		}
+		info := ziface.RouteInfo{
+			MsgID:    msgID,
+			Router:   fmt.Sprintf("%T", router),
+			Priority: config.Priority,
+			Timeout:  config.Timeout,
+			Roles:    config.Roles,
+		}
+		if config.Group != nil {
+			info.Group = config.Group.Name()
+		}
+		routes = append(routes, info)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].MsgID < routes[j].MsgID
+	})
+
+	return routes
+}
+
+// Validate 校验路由配置：分组之间的 MsgID 范围不能重叠，分组范围内的 MsgID 必须通过该分组注册
+// 同时校验暂停、恢复读取的积压任务数，恢复的值必须小于暂停的值
+func (mh *MsgHandler) Validate() error {
+	if mh.lowWater >= mh.highWater {
+		return fmt.Errorf("TaskQueueLowWater %d must be less than TaskQueueHighWater %d", mh.lowWater, mh.highWater)
+	}
+	// 同一链接的分片只有在 Worker 中才能按顺序处理
+	if len(mh.Streams) > 0 && mh.WorkerPoolSize == 0 {
+		return fmt.Errorf("%s", "stream routers require WorkerPoolSize > 0")
+	}
+
+	groups := make([]ziface.IRouterGroup, len(mh.groups))
+	copy(groups, mh.groups)
+	sort.Slice(groups, func(i, j int) bool {
+		start1, _ := groups[i].Range()
+		start2, _ := groups[j].Range()
+		return start1 < start2
+	})
+	for i := 1; i < len(groups); i++ {
+		prevStart, prevEnd := groups[i-1].Range()
+		start, end := groups[i].Range()
+		if start <= prevEnd {
+			return fmt.Errorf(
+				"router group %s [%d, %d] overlaps with %s [%d, %d]",
+				groups[i].Name(), start, end, groups[i-1].Name(), prevStart, prevEnd,
+			)
+		}
+	}
+
+	for _, route := range mh.Routes() {
+		for _, group := range groups {
+			start, end := group.Range()
+			if route.MsgID >= start && route.MsgID <= end && route.Group != group.Name() {
+				return fmt.Errorf("MsgID=%d is in router group %s range but not registered through it", route.MsgID, group.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+// routeConfig 获取消息的路由配置，未注册的消息使用默认配置
+func (mh *MsgHandler) routeConfig(msgID uint32) *ziface.RouteConfig {
+	if config, ok := mh.routeConfigs[msgID]; ok {
+		return config
+	}
+	return newRouteConfig()
+}
+
+// handlerTimeout 记录一次业务处理超时
+func (mh *MsgHandler) handlerTimeout(request ziface.IRequest, timeout time.Duration) {
+	atomic.AddUint64(&mh.handlerTimeouts, 1)
+	fmt.Printf(
+		"[Timeout] ConnID=%d, request MsgID=%d handler exceeded %v\n",
+		request.GetConnection().GetConnID(), request.GetMsgID(), timeout,
+	)
+	if mh.onHandlerTimeout != nil {
+		mh.onHandlerTimeout(request, timeout)
+	}
+}
+
+// HandlerTimeouts 获取业务处理超时的总次数
+func (mh *MsgHandler) HandlerTimeouts() uint64 {
+	return atomic.LoadUint64(&mh.handlerTimeouts)
+}
+
 // StartWorkerPool 启动一个 Worker 工作池（开启工作池的方法只能发生一次，一个框架只能有一个 Worker 工作池）
 func (mh *MsgHandler) StartWorkerPool() {
+	mh.poolLock.Lock()
+	defer mh.poolLock.Unlock()
+
 	// 根据 WorkerPoolSize 分别开启 Worker，每个 Worker 用一个 Goroutine 来承载
 	for i := 0; i < int(mh.WorkerPoolSize); i++ {
-		// 一个 Worker 被启动
-		// 1、给当前Worker对应的channel消息队列开辟空间
-		mh.TaskQueue[i] = make(chan ziface.IRequest, utils.GlobalObject.MaxWorkerTaskLen)
-		// 2、启动当前的 Worker 工作流， 阻塞等待消息从 channel 中传递进来
-		go mh.startOneWorker(i, mh.TaskQueue[i])
+		mh.spawnWorker()
 	}
 }
 
+// spawnWorker 开启一个新的 Worker，调用方需持有 poolLock
+func (mh *MsgHandler) spawnWorker() *worker {
+	// 1、给当前Worker对应的每个优先级的channel消息队列开辟空间
+	w := &worker{id: mh.nextWorkerID}
+	for i := range w.lanes {
+		w.lanes[i] = make(chan ziface.IRequest, mh.maxWorkerTaskLen)
+	}
+	mh.nextWorkerID++
+	mh.workers = append(mh.workers, w)
+
+	// 2、启动当前的 Worker 工作流， 阻塞等待消息从 channel 中传递进来
+	go mh.startOneWorker(w)
+
+	return w
+}
+
 // StartOneWorker 启动一个 Worker 工作流
-func (mh *MsgHandler) startOneWorker(workerID int, taskQueue chan ziface.IRequest) {
-	fmt.Println("WorkID=", workerID, " is started ...")
+func (mh *MsgHandler) startOneWorker(w *worker) {
+	fmt.Println("WorkID=", w.id, " is started ...")
+
+	// 空闲超过 WorkerIdleTimeout 后尝试回收当前 Worker，为 0 时 idleC 为 nil，永远不会触发
+	idleTimeout := mh.workerIdleTimeout
+	var idleTimer *time.Timer
+	var idleC <-chan time.Time
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+
 	// 不断的阻塞等待对应消息队列的消息
 	for {
+		// 优先取出高优先级队列中的消息
+		if request := w.poll(); request != nil {
+			mh.DoMsgHandler(request)
+			mh.taskDone(w, request)
+			continue
+		}
+
+		if idleTimer != nil {
+			resetTimer(idleTimer, idleTimeout)
+		}
+
+		// 所有队列都为空时阻塞等待
+		var request ziface.IRequest
 		select {
+		case request = <-w.lanes[PriorityHigh]:
+		case request = <-w.lanes[PriorityNormal]:
+		case request = <-w.lanes[PriorityLow]:
+		case <-idleC:
+			if mh.retireWorker(w) {
+				fmt.Println("WorkID=", w.id, " is idle, exit")
+				return
+			}
+			continue
+		}
+
 		// 如果有消息到来，出列的就是客户端 Request，执行当前 Request 所绑定的业务
-		case request := <-taskQueue:
-			mh.DoMsgHandler(request)
+		mh.DoMsgHandler(request)
+		mh.taskDone(w, request)
+	}
+}
+
+// poll 按优先级从高到低非阻塞地取出一条消息，所有队列都为空时返回 nil
+func (w *worker) poll() ziface.IRequest {
+	for i := len(w.lanes) - 1; i >= 0; i-- {
+		select {
+		case request := <-w.lanes[i]:
+			return request
+		default:
+		}
+	}
+	return nil
+}
+
+// resetTimer 重置一个可能已经触发过的 Timer
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// retireWorker 回收空闲的 Worker，Worker 数量不能低于 WorkerPoolSize
+func (mh *MsgHandler) retireWorker(w *worker) bool {
+	mh.poolLock.Lock()
+	defer mh.poolLock.Unlock()
+
+	if len(mh.workers) <= int(mh.WorkerPoolSize) || w.pending > 0 {
+		return false
+	}
+
+	for i, one := range mh.workers {
+		if one == w {
+			mh.workers = append(mh.workers[:i], mh.workers[i+1:]...)
+			break
 		}
 	}
+	fmt.Printf("[WorkerPool] scale down, worker num=%d\n", len(mh.workers))
+
+	return true
+}
+
+// assignWorker 为请求选择一个 Worker 并增加任务计数
+func (mh *MsgHandler) assignWorker(request ziface.IRequest) *worker {
+	mh.poolLock.Lock()
+	defer mh.poolLock.Unlock()
+
+	connID := request.GetConnection().GetConnID()
+	binding, ok := mh.bindings[connID]
+	if !ok {
+		// 当前链接没有未处理完的任务，交给积压最少的 Worker
+		w := mh.leastLoadedWorker()
+		// 没有空闲的 Worker 且未达到上限时扩容
+		if w == nil || (w.pending > 0 && len(mh.workers) < int(mh.MaxWorkerPoolSize)) {
+			w = mh.spawnWorker()
+			fmt.Printf("[WorkerPool] scale up, worker num=%d\n", len(mh.workers))
+		}
+		binding = &connBinding{worker: w}
+		mh.bindings[connID] = binding
+	}
+
+	w := binding.worker
+	binding.pending++
+	w.pending++
+	if w.resume == nil && w.pending >= mh.highWater {
+		w.resume = make(chan struct{})
+	}
+
+	return w
+}
+
+// taskDone 任务处理完（或被拒绝）后减少任务计数，并在积压回落时通知 Reader
+func (mh *MsgHandler) taskDone(w *worker, request ziface.IRequest) {
+	mh.poolLock.Lock()
+	defer mh.poolLock.Unlock()
+
+	w.pending--
+	connID := request.GetConnection().GetConnID()
+	if binding, ok := mh.bindings[connID]; ok {
+		binding.pending--
+		if binding.pending == 0 {
+			delete(mh.bindings, connID)
+		}
+	}
+
+	if w.resume != nil && w.pending <= mh.lowWater {
+		close(w.resume)
+		w.resume = nil
+	}
+}
+
+// leastLoadedWorker 积压任务最少的 Worker，调用方需持有 poolLock
+func (mh *MsgHandler) leastLoadedWorker() *worker {
+	var least *worker
+	for _, w := range mh.workers {
+		if least == nil || w.pending < least.pending {
+			least = w
+		}
+	}
+	return least
 }
 
 // SendMsgToTaskQueue 发送消息到任务队列 TaskQueue 中，由 Worker 进行处理
-func (mh *MsgHandler) SendMsgToTaskQueue(request ziface.IRequest) {
-	// 1、将消息平均分配给不同的 Worker
-	// 根据客户端建立的 ConnID 来进行分配
-	workerID := request.GetConnection().GetConnID() % mh.WorkerPoolSize
-	fmt.Printf(
-		"Add ConnID=%d, request MsgID=%d to workerID=%d",
-		request.GetConnection().GetConnID(), request.GetMsgID(), workerID,
-	)
-	// 2、将消息发送给 Worker 内的 TaskQueue
-	mh.TaskQueue[workerID] <- request
+func (mh *MsgHandler) SendMsgToTaskQueue(request ziface.IRequest) error {
+	return mh.sendToTaskQueue(request, mh.rejectPolicy)
+}
+
+// sendToTaskQueue 按照指定的拒绝策略将消息交给 TaskQueue
+func (mh *MsgHandler) sendToTaskQueue(request ziface.IRequest, rejectPolicy string) error {
+	// 1、将消息分配给积压最少的 Worker，同一链接未处理完的消息始终在同一个 Worker 中
+	w := mh.assignWorker(request)
+	lane := w.lanes[mh.routeConfig(request.GetMsgID()).Priority]
+
+	// 2、将消息发送给 Worker 内该优先级的 TaskQueue
+	select {
+	case lane <- request:
+		return nil
+	default:
+	}
+
+	// 3、队列已满，按照拒绝策略处理
+	switch rejectPolicy {
+	case RejectPolicyDrop, RejectPolicyClose:
+		mh.taskDone(w, request)
+		fmt.Printf(
+			"[WorkerPool] reject ConnID=%d, request MsgID=%d, workerID=%d task queue is full\n",
+			request.GetConnection().GetConnID(), request.GetMsgID(), w.id,
+		)
+		if mh.onReject != nil {
+			mh.onReject(request, ErrTaskQueueFull)
+		}
+		return ErrTaskQueueFull
+	default:
+		lane <- request
+		return nil
+	}
+}
+
+// Throttle 背压控制：链接所在 Worker 积压的任务超过高水位时阻塞，直到回落到低水位
+func (mh *MsgHandler) Throttle(conn ziface.IConnection) {
+	mh.poolLock.Lock()
+	var resume chan struct{}
+	if binding, ok := mh.bindings[conn.GetConnID()]; ok {
+		resume = binding.worker.resume
+	}
+	mh.poolLock.Unlock()
+
+	if resume == nil {
+		return
+	}
+
+	fmt.Printf("[Backpressure] ConnID=%d pause reading\n", conn.GetConnID())
+	<-resume
+	fmt.Printf("[Backpressure] ConnID=%d resume reading\n", conn.GetConnID())
+}
+
+// SetOnReject 注册请求被拒绝（丢弃）时的回调
+func (mh *MsgHandler) SetOnReject(hookFunc func(request ziface.IRequest, reason error)) {
+	mh.onReject = hookFunc
+}
+
+// SetOnHandlerTimeout 注册业务处理超出超时时间时的回调
+func (mh *MsgHandler) SetOnHandlerTimeout(hookFunc func(request ziface.IRequest, timeout time.Duration)) {
+	mh.onHandlerTimeout = hookFunc
 }
@@ -0,0 +1,141 @@
+package znet
+
+import (
+	"testing"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// blockRouter 处理消息前阻塞，直到 release 被关闭
+type blockRouter struct {
+	BaseRouter
+	entered chan struct{}
+	release chan struct{}
+	handled chan uint32
+}
+
+func (r *blockRouter) Handle(request ziface.IRequest) {
+	r.entered <- struct{}{}
+	<-r.release
+	r.handled <- request.GetConnection().GetConnID()
+}
+
+func TestMsgHandlerElasticPool(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.WorkerPoolSize = 1
+	utils.GlobalObject.MaxWorkerPoolSize = 2
+	utils.GlobalObject.MaxWorkerTaskLen = 1
+	utils.GlobalObject.RejectPolicy = RejectPolicyDrop
+
+	router := &blockRouter{
+		entered: make(chan struct{}, 8),
+		release: make(chan struct{}),
+		handled: make(chan uint32, 8),
+	}
+	mh := NewMsgHandler()
+	mh.AddRouter(1, router)
+	mh.StartWorkerPool()
+
+	var rejected []uint32
+	mh.SetOnReject(func(request ziface.IRequest, reason error) {
+		rejected = append(rejected, request.GetConnection().GetConnID())
+	})
+
+	newReq := func(connID uint32) ziface.IRequest {
+		return &Request{conn: &Connection{ConnID: connID}, msg: NewMessage(1, nil)}
+	}
+
+	// 链接 1 占用第一个 Worker，链接 2 到来时没有空闲 Worker，扩容到上限 2
+	for _, connID := range []uint32{1, 2} {
+		if err := mh.SendMsgToTaskQueue(newReq(connID)); err != nil {
+			t.Fatalf("send conn %d: %v", connID, err)
+		}
+		<-router.entered
+	}
+	if len(mh.workers) != 2 {
+		t.Fatalf("worker num = %d, want 2", len(mh.workers))
+	}
+
+	// 两个 Worker 的队列都被占满后，再来的请求按 drop 策略被拒绝
+	mh.SendMsgToTaskQueue(newReq(1))
+	mh.SendMsgToTaskQueue(newReq(2))
+	if err := mh.SendMsgToTaskQueue(newReq(3)); err != ErrTaskQueueFull {
+		t.Fatalf("err = %v, want ErrTaskQueueFull", err)
+	}
+	if len(rejected) != 1 || rejected[0] != 3 {
+		t.Fatalf("rejected = %v, want [3]", rejected)
+	}
+
+	close(router.release)
+	for i := 0; i < 4; i++ {
+		<-router.handled
+	}
+}
+
+// recordRouter 记录处理消息的顺序
+type recordRouter struct {
+	BaseRouter
+	handled chan uint32
+}
+
+func (r *recordRouter) Handle(request ziface.IRequest) {
+	r.handled <- request.GetMsgID()
+}
+
+func TestMsgHandlerPriorityLanes(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.WorkerPoolSize = 1
+	utils.GlobalObject.MaxWorkerPoolSize = 1
+
+	blocker := &blockRouter{
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		handled: make(chan uint32, 1),
+	}
+	recorder := &recordRouter{handled: make(chan uint32, 4)}
+	mh := NewMsgHandler()
+	mh.AddRouter(1, blocker)
+	mh.AddRouter(2, recorder, WithPriority(PriorityLow))
+	mh.AddRouter(3, recorder)
+	mh.AddRouter(4, recorder, WithPriority(PriorityHigh))
+	mh.StartWorkerPool()
+
+	// 先占住唯一的 Worker，再按优先级从低到高投递消息
+	mh.SendMsgToTaskQueue(&Request{conn: &Connection{ConnID: 1}, msg: NewMessage(1, nil)})
+	<-blocker.entered
+	for msgID := uint32(2); msgID <= 4; msgID++ {
+		mh.SendMsgToTaskQueue(&Request{conn: &Connection{ConnID: msgID}, msg: NewMessage(msgID, nil)})
+	}
+	close(blocker.release)
+
+	for _, want := range []uint32{4, 3, 2} {
+		if got := <-recorder.handled; got != want {
+			t.Fatalf("handled msgID %d, want %d", got, want)
+		}
+	}
+}
+
+func TestMsgHandlerWaterMarks(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+
+	// 队列很短时暂停读取的值至少为 1
+	utils.GlobalObject.MaxWorkerTaskLen = 1
+	mh := NewMsgHandler()
+	if mh.highWater != 1 || mh.lowWater != 0 {
+		t.Fatalf("water marks = %d/%d, want 1/0", mh.highWater, mh.lowWater)
+	}
+	if err := mh.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	// 恢复读取的值不小于暂停读取的值时校验失败
+	utils.GlobalObject.TaskQueueHighWater = 8
+	utils.GlobalObject.TaskQueueLowWater = 8
+	if err := NewMsgHandler().Validate(); err == nil {
+		t.Fatal("low water equal to high water should fail")
+	}
+}
@@ -0,0 +1,74 @@
+package znet
+
+import (
+	"fmt"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+// Key 类型化的链接属性键，读写时由编译器检查值的类型
+//
+//	var PlayerID = znet.NewKey[int32]("playerID")
+//	znet.SetProperty(conn, PlayerID, 1001)
+//	pid, err := znet.GetProperty(conn, PlayerID)
+type Key[T any] struct {
+	name string
+}
+
+// NewKey 创建一个类型化的链接属性键
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name 获取属性键的名称，即底层使用的字符串键
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// GetProperty 获取类型化的链接属性，属性不存在时返回 ErrPropertyNotFound
+func GetProperty[T any](conn ziface.IConnection, key Key[T]) (T, error) {
+	var zero T
+	value, err := conn.GetProPerty(key.name)
+	if err != nil {
+		return zero, err
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return zero, fmt.Errorf("property %s is %T, not %T", key.name, value, zero)
+	}
+	return typed, nil
+}
+
+// SetProperty 设置类型化的链接属性
+func SetProperty[T any](conn ziface.IConnection, key Key[T], value T) {
+	conn.SetProPerty(key.name, value)
+}
+
+// RemoveProperty 移除类型化的链接属性
+func RemoveProperty[T any](conn ziface.IConnection, key Key[T]) {
+	conn.RemoveProPerty(key.name)
+}
+
+// GetOrSetProperty 属性存在时返回已有的值，否则设置为 value，loaded 表示属性是否已经存在
+func GetOrSetProperty[T any](conn ziface.IConnection, key Key[T], value T) (actual T, loaded bool, err error) {
+	v, loaded := conn.GetOrSetProPerty(key.name, value)
+	actual, ok := v.(T)
+	if !ok {
+		return actual, loaded, fmt.Errorf("property %s is %T, not %T", key.name, v, value)
+	}
+	return actual, loaded, nil
+}
+
+// CompareAndSwapProperty 属性的当前值等于 old 时替换为 value
+func CompareAndSwapProperty[T comparable](conn ziface.IConnection, key Key[T], old, value T) bool {
+	return conn.CompareAndSwapProPerty(key.name, old, value)
+}
+
+// ObserveProperty 注册类型化属性变化的观察者，exists 为 false 表示属性被移除
+func ObserveProperty[T any](conn ziface.IConnection, key Key[T], observer func(conn ziface.IConnection, oldValue, newValue T, exists bool)) {
+	conn.ObserveProPerty(key.name, func(conn ziface.IConnection, _ string, oldValue, newValue interface{}) {
+		oldTyped, _ := oldValue.(T)
+		newTyped, ok := newValue.(T)
+		observer(conn, oldTyped, newTyped, ok)
+	})
+}
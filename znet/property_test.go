@@ -0,0 +1,88 @@
+package znet
+
+import (
+	"testing"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestTypedProperty(t *testing.T) {
+	conn := &Connection{ConnID: 1, property: make(map[string]interface{})}
+	playerID := NewKey[int32]("playerID")
+	room := NewKey[string]("room")
+
+	if _, err := GetProperty(conn, playerID); err != ErrPropertyNotFound {
+		t.Fatalf("err = %v, want ErrPropertyNotFound", err)
+	}
+
+	var changes []string
+	ObserveProperty(conn, room, func(conn ziface.IConnection, oldValue, newValue string, exists bool) {
+		if !exists {
+			newValue = "<removed>"
+		}
+		changes = append(changes, oldValue+"->"+newValue)
+	})
+
+	// GetOrSet 只在属性不存在时设置
+	if actual, loaded, _ := GetOrSetProperty(conn, playerID, 1001); loaded || actual != 1001 {
+		t.Fatalf("actual=%d loaded=%v", actual, loaded)
+	}
+	if actual, loaded, _ := GetOrSetProperty(conn, playerID, 1002); !loaded || actual != 1001 {
+		t.Fatalf("actual=%d loaded=%v", actual, loaded)
+	}
+
+	// CAS 只在当前值匹配时替换，值没有变化时不通知观察者
+	SetProperty(conn, room, "lobby")
+	SetProperty(conn, room, "lobby")
+	if CompareAndSwapProperty(conn, room, "hall", "r1") {
+		t.Fatal("swap with stale value succeeded")
+	}
+	if !CompareAndSwapProperty(conn, room, "lobby", "r1") {
+		t.Fatal("swap failed")
+	}
+	RemoveProperty(conn, room)
+
+	want := []string{"->lobby", "lobby->r1", "r1-><removed>"}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("changes = %v, want %v", changes, want)
+		}
+	}
+
+	// 快照不受之后修改的影响，类型不匹配时返回错误
+	snapshot := conn.Properties()
+	conn.SetProPerty("playerID", "not a number")
+	if snapshot["playerID"] != int32(1001) {
+		t.Fatalf("snapshot = %v", snapshot)
+	}
+	if _, err := GetProperty(conn, playerID); err == nil {
+		t.Fatal("type mismatch not reported")
+	}
+}
+
+func TestGatewayConnPropertyObserver(t *testing.T) {
+	gc := &gatewayConn{Connection: &Connection{ConnID: 2, property: make(map[string]interface{})}}
+	room := NewKey[string]("room")
+
+	// 观察者收到的是虚拟链接，而不是它嵌入的 Connection
+	var got []ziface.IConnection
+	ObserveProperty(gc, room, func(conn ziface.IConnection, oldValue, newValue string, exists bool) {
+		got = append(got, conn)
+	})
+	SetProperty(gc, room, "lobby")
+	CompareAndSwapProperty(gc, room, "lobby", "r1")
+	RemoveProperty(gc, room)
+	GetOrSetProperty(gc, room, "r2")
+
+	if len(got) != 4 {
+		t.Fatalf("observer called %d times, want 4", len(got))
+	}
+	for _, conn := range got {
+		if conn != ziface.IConnection(gc) {
+			t.Fatalf("observer got %T, want *gatewayConn", conn)
+		}
+	}
+}
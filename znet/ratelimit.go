@@ -0,0 +1,260 @@
+package znet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+// 超出速率限制时的处理
+const (
+	RateLimitDrop  = "drop"  // 丢弃该消息
+	RateLimitDelay = "delay" // 暂停读取该链接，直到有可用的令牌
+	RateLimitError = "error" // 丢弃该消息，并回复 MsgIDRateLimited
+	RateLimitClose = "close" // 关闭链接
+)
+
+// 速率限制的范围，超出限制时传给 OnRateLimit 回调
+const (
+	RateLimitScopeIP   = "ip"   // 远程 IP 所有链接合计的限制
+	RateLimitScopeConn = "conn" // 单个链接的限制
+	RateLimitScopeMsg  = "msg"  // 单个链接上某个 MsgID 的限制
+
+	RateLimitScopeHeartbeat = "heartbeat" // 单个链接的心跳限制
+)
+
+// tokenBucket 令牌桶，每个消息消耗一个令牌
+type tokenBucket struct {
+	lock   sync.Mutex
+	limit  utils.RateLimit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket 创建一个装满令牌的令牌桶，未设置速率时返回 nil
+func newTokenBucket(limit utils.RateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = limit.Rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{limit: limit, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill 按照经过的时间补充令牌，调用方需持有锁
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take 取一个令牌，令牌不足时返回 false
+// delay 模式下总是预支一个令牌，返回需要等待的时间
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if b.limit.Action != RateLimitDelay {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second)), false
+}
+
+// refund 归还一个令牌，后面的限制拒绝该消息时调用
+func (b *tokenBucket) refund() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.tokens++; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// ipBucket 同一个远程 IP 的所有链接共享的令牌桶
+type ipBucket struct {
+	bucket *tokenBucket
+	refs   int
+}
+
+// ipBuckets 一个 Server 上远程 IP 对应的令牌桶，最后一个链接关闭时移除
+type ipBuckets struct {
+	lock    sync.Mutex
+	buckets map[string]*ipBucket
+}
+
+// newIPBuckets 创建远程 IP 的令牌桶集合
+func newIPBuckets() *ipBuckets {
+	return &ipBuckets{buckets: make(map[string]*ipBucket)}
+}
+
+// acquire 获取远程 IP 的令牌桶，并增加引用计数
+func (s *ipBuckets) acquire(ip string) *tokenBucket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, ok := s.buckets[ip]
+	if !ok {
+		bucket := newTokenBucket(utils.GlobalObject.IPRateLimit)
+		if bucket == nil {
+			return nil
+		}
+		b = &ipBucket{bucket: bucket}
+		s.buckets[ip] = b
+	}
+	b.refs++
+	return b.bucket
+}
+
+// release 减少远程 IP 令牌桶的引用计数
+func (s *ipBuckets) release(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if b, ok := s.buckets[ip]; ok {
+		if b.refs--; b.refs <= 0 {
+			delete(s.buckets, ip)
+		}
+	}
+}
+
+// rateLimitProvider 提供远程 IP 令牌桶的 Server
+type rateLimitProvider interface {
+	ipRateBuckets() *ipBuckets
+}
+
+// rateLimiter 一个链接的限流模块，只在该链接的 Reader 中使用
+type rateLimiter struct {
+	ip   string
+	ips  *ipBuckets
+	ipB  *tokenBucket
+	conn *tokenBucket
+	msgs map[uint32]*tokenBucket
+}
+
+// newRateLimiter 按照配置创建链接的限流模块，没有配置任何限制时返回 nil
+// ips 为 Server 上远程 IP 的令牌桶，为 nil 时不限制远程 IP
+func newRateLimiter(ips *ipBuckets, addr net.Addr) *rateLimiter {
+	cfg := utils.GlobalObject
+	if cfg.IPRateLimit.Rate <= 0 && cfg.ConnRateLimit.Rate <= 0 && len(cfg.MsgRateLimits) == 0 {
+		return nil
+	}
+
+	l := &rateLimiter{
+		conn: newTokenBucket(cfg.ConnRateLimit),
+		msgs: make(map[uint32]*tokenBucket),
+	}
+	if ips != nil && addr != nil {
+		l.ip, l.ips = remoteIP(addr), ips
+		l.ipB = ips.acquire(l.ip)
+	}
+	for msgID, limit := range cfg.MsgRateLimits {
+		if b := newTokenBucket(limit); b != nil {
+			l.msgs[msgID] = b
+		}
+	}
+
+	return l
+}
+
+// check 依次检查 IP、链接、MsgID 的限制
+// 返回需要等待的时间，以及超出的限制的范围和处理方式，没有超出限制时 scope 为空
+// 消息被某个限制拒绝时，前面的限制已经取走（或预支）的令牌全部归还，被丢弃的消息不消耗共享的 IP 令牌桶
+func (l *rateLimiter) check(msgID uint32) (wait time.Duration, scope, action string) {
+	now := time.Now()
+	taken := make([]*tokenBucket, 0, 3)
+	for _, s := range [...]struct {
+		scope  string
+		bucket *tokenBucket
+	}{
+		{RateLimitScopeIP, l.ipB},
+		{RateLimitScopeConn, l.conn},
+		{RateLimitScopeMsg, l.msgs[msgID]},
+	} {
+		if s.bucket == nil {
+			continue
+		}
+		w, ok := s.bucket.take(now)
+		if ok {
+			taken = append(taken, s.bucket)
+			continue
+		}
+		// 需要等待时继续检查其它限制，取最长的等待时间
+		if s.bucket.limit.Action != RateLimitDelay {
+			for _, b := range taken {
+				b.refund()
+			}
+			action = s.bucket.limit.Action
+			if action == "" {
+				action = RateLimitDrop
+			}
+			return 0, s.scope, action
+		}
+		taken = append(taken, s.bucket)
+		if w > wait {
+			wait, scope, action = w, s.scope, RateLimitDelay
+		}
+	}
+	return wait, scope, action
+}
+
+// close 链接关闭时释放远程 IP 的令牌桶
+func (l *rateLimiter) close() {
+	if l.ipB != nil {
+		l.ips.release(l.ip)
+	}
+}
+
+// rateLimit 检查消息是否超出速率限制并按配置处理，pass 为 false 时丢弃该消息，closeConn 为 true 时需要关闭链接
+func (c *Connection) rateLimit(msgID uint32) (pass, closeConn bool) {
+	if c.limiter == nil {
+		return true, false
+	}
+	wait, scope, action := c.limiter.check(msgID)
+	if scope == "" {
+		return true, false
+	}
+
+	fmt.Printf("ConnID=%d msgID=%d exceeds %s rate limit, action=%s\n", c.ConnID, msgID, scope, action)
+	c.TCPServer.CallOnRateLimit(c, msgID, scope)
+
+	switch action {
+	case RateLimitDelay:
+		// 暂停读取，由 TCP 流控向客户端施加背压，链接关闭时不再等待
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true, false
+		case <-c.ctx.Done():
+			return false, true
+		}
+	case RateLimitError:
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, msgID)
+		if err := c.SendMsg(MsgIDRateLimited, data); err != nil {
+			return false, true
+		}
+		return false, false
+	case RateLimitClose:
+		return false, true
+	}
+	return false, false
+}
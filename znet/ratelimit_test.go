@@ -0,0 +1,109 @@
+package znet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+)
+
+func TestRateLimiter(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.IPRateLimit = utils.RateLimit{Rate: 0.001, Burst: 3, Action: RateLimitClose}
+	utils.GlobalObject.ConnRateLimit = utils.RateLimit{}
+	utils.GlobalObject.MsgRateLimits = map[uint32]utils.RateLimit{
+		1: {Rate: 0.001, Burst: 1},
+		2: {Rate: 1000, Burst: 1, Action: RateLimitDelay},
+	}
+
+	addr := func(port int) net.Addr { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port} }
+	ips := newIPBuckets()
+	l1 := newRateLimiter(ips, addr(1))
+	l2 := newRateLimiter(ips, addr(2))
+
+	// MsgID 1 只允许一个消息，超出后按默认的 drop 处理
+	if _, scope, _ := l1.check(1); scope != "" {
+		t.Fatalf("first msg limited by %s", scope)
+	}
+	if _, scope, action := l1.check(1); scope != RateLimitScopeMsg || action != RateLimitDrop {
+		t.Fatalf("scope=%s action=%s, want msg drop", scope, action)
+	}
+
+	// 被丢弃的消息归还 IP 的令牌，同一个 IP 的两个链接共用 3 个令牌，先检查的 IP 限制超出后不再检查 MsgID 的限制
+	for i := 0; i < 2; i++ {
+		if _, scope, _ := l2.check(3); scope != "" {
+			t.Fatalf("msg %d limited by %s", i+2, scope)
+		}
+	}
+	if wait, scope, action := l2.check(2); scope != RateLimitScopeIP || action != RateLimitClose || wait != 0 {
+		t.Fatalf("scope=%s action=%s, want ip close", scope, action)
+	}
+
+	// 每个 Server 的 IP 令牌桶相互独立
+	other := newRateLimiter(newIPBuckets(), addr(5))
+	defer other.close()
+	if _, scope, _ := other.check(3); scope != "" {
+		t.Fatalf("other server limited by %s", scope)
+	}
+
+	// 最后一个链接关闭时移除 IP 的令牌桶
+	l1.close()
+	if _, ok := ips.buckets["10.0.0.1"]; !ok {
+		t.Fatal("ip bucket removed while in use")
+	}
+	l2.close()
+	if _, ok := ips.buckets["10.0.0.1"]; ok {
+		t.Fatal("ip bucket not removed")
+	}
+
+	// delay 模式下预支令牌，返回需要等待的时间
+	utils.GlobalObject.IPRateLimit = utils.RateLimit{}
+	l3 := newRateLimiter(ips, addr(3))
+	defer l3.close()
+	l3.check(2)
+	if wait, scope, action := l3.check(2); scope != RateLimitScopeMsg || action != RateLimitDelay || wait <= 0 {
+		t.Fatalf("scope=%s action=%s wait=%v, want msg delay", scope, action, wait)
+	}
+
+	// delay 模式预支的令牌在后面的限制丢弃该消息时同样归还
+	utils.GlobalObject.ConnRateLimit = utils.RateLimit{Rate: 0.001, Burst: 1, Action: RateLimitDelay}
+	l4 := newRateLimiter(ips, addr(4))
+	defer l4.close()
+	l4.check(1)
+	if _, scope, action := l4.check(1); scope != RateLimitScopeMsg || action != RateLimitDrop {
+		t.Fatalf("scope=%s action=%s, want msg drop", scope, action)
+	}
+	if l4.conn.tokens < -0.5 {
+		t.Fatalf("conn tokens=%v, borrowed token not refunded", l4.conn.tokens)
+	}
+}
+
+func TestRateLimitDelayStop(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.IPRateLimit = utils.RateLimit{}
+	utils.GlobalObject.ConnRateLimit = utils.RateLimit{Rate: 0.001, Burst: 1, Action: RateLimitDelay}
+	utils.GlobalObject.MsgRateLimits = nil
+
+	c := &Connection{
+		TCPServer: NewServer("ratelimit"),
+		limiter:   newRateLimiter(nil, nil),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if pass, _ := c.rateLimit(1); !pass {
+		t.Fatal("first msg limited")
+	}
+
+	// 链接关闭时不再等待令牌，Reader 可以立即退出
+	time.AfterFunc(50*time.Millisecond, c.cancel)
+	start := time.Now()
+	if pass, closeConn := c.rateLimit(1); pass || !closeConn {
+		t.Fatalf("pass=%v closeConn=%v after stop", pass, closeConn)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("delay not interrupted, waited %v", elapsed)
+	}
+}
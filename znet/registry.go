@@ -0,0 +1,406 @@
+package znet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+const (
+	// 文件服务发现默认检查文件变化的间隔
+	defaultRegistryWatchInterval = time.Second
+	// 等待其它进程释放文件锁的最长时间
+	registryLockTimeout = 5 * time.Second
+	// 超过这个时间的锁文件视为持有它的进程已经异常退出
+	registryLockStale = 30 * time.Second
+)
+
+// ErrAdvertiseAddrRequired 监听所有地址（如 0.0.0.0）时客户端无法使用监听的地址链接，注册时必须设置 AdvertiseAddr
+var ErrAdvertiseAddrRequired = errors.New("AdvertiseAddr is required when Host is unspecified")
+
+// registryWatcher 一个服务的监听者
+type registryWatcher struct {
+	name     string
+	callback func(instances []ziface.ServiceInstance)
+}
+
+// filterInstances 获取某个服务的所有实例，按地址排序
+func filterInstances(all []ziface.ServiceInstance, name string) []ziface.ServiceInstance {
+	instances := make([]ziface.ServiceInstance, 0)
+	for _, instance := range all {
+		if instance.Name == name {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Addr < instances[j].Addr
+	})
+	return instances
+}
+
+// upsertInstance 添加实例，同名同地址的实例被覆盖
+func upsertInstance(all []ziface.ServiceInstance, instance ziface.ServiceInstance) []ziface.ServiceInstance {
+	for i, old := range all {
+		if old.Name == instance.Name && old.Addr == instance.Addr {
+			all[i] = instance
+			return all
+		}
+	}
+	return append(all, instance)
+}
+
+// removeInstance 移除同名同地址的实例
+func removeInstance(all []ziface.ServiceInstance, instance ziface.ServiceInstance) []ziface.ServiceInstance {
+	kept := all[:0]
+	for _, old := range all {
+		if old.Name != instance.Name || old.Addr != instance.Addr {
+			kept = append(kept, old)
+		}
+	}
+	return kept
+}
+
+// StaticRegistry 静态列表的服务发现，实例由创建时的列表和本进程中注册的实例组成
+type StaticRegistry struct {
+	lock      sync.Mutex
+	instances []ziface.ServiceInstance
+	watchers  map[*registryWatcher]struct{}
+}
+
+// NewStaticRegistry 使用静态的实例列表创建服务发现
+func NewStaticRegistry(instances ...ziface.ServiceInstance) *StaticRegistry {
+	return &StaticRegistry{
+		instances: append([]ziface.ServiceInstance(nil), instances...),
+		watchers:  make(map[*registryWatcher]struct{}),
+	}
+}
+
+// Register 注册服务实例
+func (r *StaticRegistry) Register(instance ziface.ServiceInstance) error {
+	r.lock.Lock()
+	r.instances = upsertInstance(r.instances, instance)
+	r.lock.Unlock()
+
+	r.notify(instance.Name)
+	return nil
+}
+
+// Deregister 注销服务实例
+func (r *StaticRegistry) Deregister(instance ziface.ServiceInstance) error {
+	r.lock.Lock()
+	r.instances = removeInstance(r.instances, instance)
+	r.lock.Unlock()
+
+	r.notify(instance.Name)
+	return nil
+}
+
+// Lookup 获取服务的所有实例
+func (r *StaticRegistry) Lookup(name string) ([]ziface.ServiceInstance, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return filterInstances(r.instances, name), nil
+}
+
+// Watch 监听服务实例的变化
+func (r *StaticRegistry) Watch(name string, callback func(instances []ziface.ServiceInstance)) (func(), error) {
+	w := &registryWatcher{name: name, callback: callback}
+	r.lock.Lock()
+	r.watchers[w] = struct{}{}
+	instances := filterInstances(r.instances, name)
+	r.lock.Unlock()
+
+	callback(instances)
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.watchers, w)
+	}, nil
+}
+
+// notify 通知服务的监听者
+func (r *StaticRegistry) notify(name string) {
+	r.lock.Lock()
+	instances := filterInstances(r.instances, name)
+	var watchers []*registryWatcher
+	for w := range r.watchers {
+		if w.name == name {
+			watchers = append(watchers, w)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, w := range watchers {
+		w.callback(instances)
+	}
+}
+
+// FileRegistry 基于 JSON 文件的服务发现，文件内容为实例的数组，定时检查文件的变化
+// 注册和注销时持有文件锁（同目录下的 .lock 文件）读取并整体重写文件，多个进程可以共用同一个文件
+type FileRegistry struct {
+	path     string
+	interval time.Duration
+
+	lock      sync.Mutex
+	instances []ziface.ServiceInstance
+	modTime   time.Time
+	size      int64
+	watchers  map[*registryWatcher][]ziface.ServiceInstance
+
+	// 保证本进程中的注册和注销依次重写文件，进程之间通过文件锁互斥
+	updateLock sync.Mutex
+
+	exit chan struct{}
+	once sync.Once
+}
+
+// NewFileRegistry 创建基于文件的服务发现，文件不存在时视为没有任何实例，interval 为 0 时使用默认的间隔
+func NewFileRegistry(path string, interval time.Duration) (*FileRegistry, error) {
+	if interval <= 0 {
+		interval = defaultRegistryWatchInterval
+	}
+	r := &FileRegistry{
+		path:     path,
+		interval: interval,
+		watchers: make(map[*registryWatcher][]ziface.ServiceInstance),
+		exit:     make(chan struct{}),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// reload 文件发生变化时重新读取
+func (r *FileRegistry) reload() error {
+	info, err := os.Stat(r.path)
+	if os.IsNotExist(err) {
+		r.setInstances(nil, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	unchanged := info.ModTime().Equal(r.modTime) && info.Size() == r.size
+	r.lock.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	instances, info, err := r.read()
+	if err != nil {
+		return err
+	}
+	r.setInstances(instances, info)
+	return nil
+}
+
+// read 读取文件中的实例，文件不存在时视为没有任何实例
+func (r *FileRegistry) read() ([]ziface.ServiceInstance, os.FileInfo, error) {
+	f, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	var instances []ziface.ServiceInstance
+	if info.Size() > 0 {
+		if err := json.NewDecoder(f).Decode(&instances); err != nil {
+			return nil, nil, err
+		}
+	}
+	return instances, info, nil
+}
+
+// setInstances 更新缓存的实例以及文件的修改时间和大小，info 为 nil 表示文件不存在
+func (r *FileRegistry) setInstances(instances []ziface.ServiceInstance, info os.FileInfo) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.instances, r.modTime, r.size = instances, time.Time{}, 0
+	if info != nil {
+		r.modTime, r.size = info.ModTime(), info.Size()
+	}
+}
+
+// watch 定时检查文件的变化，通知实例发生变化的服务的监听者
+func (r *FileRegistry) watch() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// 文件正在被写入等原因读取失败时保留原来的实例
+			if err := r.reload(); err == nil {
+				r.notify()
+			}
+		case <-r.exit:
+			return
+		}
+	}
+}
+
+// notify 通知实例发生变化的服务的监听者
+func (r *FileRegistry) notify() {
+	type change struct {
+		w         *registryWatcher
+		instances []ziface.ServiceInstance
+	}
+	var changes []change
+
+	r.lock.Lock()
+	for w, last := range r.watchers {
+		instances := filterInstances(r.instances, w.name)
+		if !reflect.DeepEqual(instances, last) {
+			r.watchers[w] = instances
+			changes = append(changes, change{w, instances})
+		}
+	}
+	r.lock.Unlock()
+
+	for _, c := range changes {
+		c.w.callback(c.instances)
+	}
+}
+
+// lockFile 通过独占创建锁文件实现进程之间的互斥，返回释放锁的方法
+// 持有锁的进程异常退出时，超过 registryLockStale 的锁文件被视为失效
+func (r *FileRegistry) lockFile() (func(), error) {
+	lockPath := r.path + ".lock"
+	deadline := time.Now().Add(registryLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > registryLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock registry file %s timeout", r.path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// update 持有文件锁，读取最新的实例列表，修改后重写文件
+func (r *FileRegistry) update(modify func([]ziface.ServiceInstance) []ziface.ServiceInstance) error {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+
+	unlock, err := r.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// 不能根据修改时间和大小判断文件是否变化，其它进程可能在同一时刻写入了同样大小的内容
+	instances, _, err := r.read()
+	if err != nil {
+		return err
+	}
+	instances = modify(instances)
+
+	data, err := json.MarshalIndent(instances, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 写入同目录下的临时文件后替换，读取的一方不会读到写了一半的文件
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	r.setInstances(instances, info)
+	r.notify()
+	return nil
+}
+
+// Register 注册服务实例
+func (r *FileRegistry) Register(instance ziface.ServiceInstance) error {
+	return r.update(func(instances []ziface.ServiceInstance) []ziface.ServiceInstance {
+		return upsertInstance(instances, instance)
+	})
+}
+
+// Deregister 注销服务实例
+func (r *FileRegistry) Deregister(instance ziface.ServiceInstance) error {
+	return r.update(func(instances []ziface.ServiceInstance) []ziface.ServiceInstance {
+		return removeInstance(instances, instance)
+	})
+}
+
+// Lookup 获取服务的所有实例
+func (r *FileRegistry) Lookup(name string) ([]ziface.ServiceInstance, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return filterInstances(r.instances, name), nil
+}
+
+// Watch 监听服务实例的变化
+func (r *FileRegistry) Watch(name string, callback func(instances []ziface.ServiceInstance)) (func(), error) {
+	w := &registryWatcher{name: name, callback: callback}
+	r.lock.Lock()
+	instances := filterInstances(r.instances, name)
+	r.watchers[w] = instances
+	r.lock.Unlock()
+
+	callback(instances)
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.watchers, w)
+	}, nil
+}
+
+// Close 停止检查文件的变化
+func (r *FileRegistry) Close() error {
+	r.once.Do(func() {
+		close(r.exit)
+	})
+	return nil
+}
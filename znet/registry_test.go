@@ -0,0 +1,207 @@
+package znet
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// fakeRegistry 记录注册和注销的服务发现
+type fakeRegistry struct {
+	*StaticRegistry
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *fakeRegistry) Register(instance ziface.ServiceInstance) error {
+	r.lock.Lock()
+	r.events = append(r.events, "register "+instance.Name+" "+instance.Addr+" "+instance.Metadata["version"])
+	r.lock.Unlock()
+	return r.StaticRegistry.Register(instance)
+}
+
+func (r *fakeRegistry) Deregister(instance ziface.ServiceInstance) error {
+	r.lock.Lock()
+	r.events = append(r.events, "deregister "+instance.Name+" "+instance.Addr)
+	r.lock.Unlock()
+	return r.StaticRegistry.Deregister(instance)
+}
+
+func (r *fakeRegistry) Events() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestServerRegistry(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.AdvertiseAddr = "10.0.0.1:9000"
+	utils.GlobalObject.Name = "game"
+
+	registry := &fakeRegistry{StaticRegistry: NewStaticRegistry()}
+	s := NewServer("game").(*Server)
+	s.SetRegistry(registry, map[string]string{"version": "v2"})
+
+	var watched [][]ziface.ServiceInstance
+	var lock sync.Mutex
+	cancel, _ := registry.Watch("game", func(instances []ziface.ServiceInstance) {
+		lock.Lock()
+		defer lock.Unlock()
+		watched = append(watched, instances)
+	})
+	defer cancel()
+
+	s.Start()
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		if instances, _ := registry.Lookup("game"); len(instances) == 1 {
+			if instances[0].Addr != "10.0.0.1:9000" {
+				t.Fatalf("lookup = %v", instances)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Stop()
+	events := registry.Events()
+	if len(events) != 2 || events[0] != "register game 10.0.0.1:9000 v2" || events[1] != "deregister game 10.0.0.1:9000" {
+		t.Fatalf("events = %v", events)
+	}
+
+	// 开始监听时、注册后、注销后各通知一次
+	lock.Lock()
+	defer lock.Unlock()
+	if len(watched) != 3 || len(watched[0]) != 0 || len(watched[1]) != 1 || len(watched[2]) != 0 {
+		t.Fatalf("watched = %v", watched)
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+
+	// 两个 FileRegistry 使用同一个文件，模拟不同的进程
+	r1, err := NewFileRegistry(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, err := NewFileRegistry(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+
+	updates := make(chan []ziface.ServiceInstance, 8)
+	cancel, _ := r2.Watch("game", func(instances []ziface.ServiceInstance) {
+		updates <- instances
+	})
+	defer cancel()
+	wait := func(n int) {
+		select {
+		case instances := <-updates:
+			if len(instances) != n {
+				t.Fatalf("got %d instances %v, want %d", len(instances), instances, n)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %d instances", n)
+		}
+	}
+	wait(0)
+
+	a := ziface.ServiceInstance{Name: "game", Addr: "127.0.0.1:8001"}
+	b := ziface.ServiceInstance{Name: "game", Addr: "127.0.0.1:8002", Metadata: map[string]string{"zone": "b"}}
+	r1.Register(a)
+	wait(1)
+	r1.Register(b)
+	r1.Register(ziface.ServiceInstance{Name: "chat", Addr: "127.0.0.1:9001"})
+	wait(2)
+
+	instances, _ := r2.Lookup("game")
+	if len(instances) != 2 || instances[1].Metadata["zone"] != "b" {
+		t.Fatalf("lookup = %v", instances)
+	}
+
+	r1.Deregister(a)
+	wait(1)
+
+	// 两个进程同时注册，文件锁保证不会覆盖对方的注册
+	var wg sync.WaitGroup
+	for _, r := range []*FileRegistry{r1, r2} {
+		wg.Add(1)
+		go func(r *FileRegistry, zone string) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := r.Register(ziface.ServiceInstance{Name: "batch", Addr: fmt.Sprintf("%s:%d", zone, i)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(r, fmt.Sprintf("%p", r))
+	}
+	wg.Wait()
+	all, _, err := r1.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(filterInstances(all, "batch")); n != 20 {
+		t.Fatalf("%d instances registered concurrently, want 20", n)
+	}
+	if files, _ := filepath.Glob(path + ".*"); len(files) != 0 {
+		t.Fatalf("temp or lock files left: %v", files)
+	}
+}
+
+func TestServerRegistryUnspecifiedHost(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "0.0.0.0"
+	utils.GlobalObject.AdvertiseAddr = ""
+	utils.GlobalObject.Name = "game"
+
+	// 监听所有地址且没有设置 AdvertiseAddr 时不注册无法链接的 0.0.0.0
+	registry := NewStaticRegistry()
+	s := NewServer("game").(*Server)
+	s.SetRegistry(registry, nil)
+	s.register()
+	if instances, _ := registry.Lookup("game"); len(instances) != 0 {
+		t.Fatalf("registered %v", instances)
+	}
+
+	utils.GlobalObject.AdvertiseAddr = "10.0.0.1:9000"
+	s = NewServer("game").(*Server)
+	s.SetRegistry(registry, nil)
+	s.register()
+	defer s.deregister()
+	if instances, _ := registry.Lookup("game"); len(instances) != 1 || instances[0].Addr != "10.0.0.1:9000" {
+		t.Fatalf("registered %v", instances)
+	}
+}
+
+func TestServerOwnRegistryClosed(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "0.0.0.0"
+	utils.GlobalObject.AdvertiseAddr = ""
+	utils.GlobalObject.RegistryFile = filepath.Join(t.TempDir(), "registry.json")
+
+	// 没有可以注册的地址时注册失败，Stop 时仍然关闭 Server 创建的服务发现
+	s := NewServer("game").(*Server)
+	registry := s.GetRegistry().(*FileRegistry)
+	s.register()
+	s.deregister()
+	select {
+	case <-registry.exit:
+	default:
+		t.Fatal("own registry not closed")
+	}
+}
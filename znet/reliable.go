@@ -0,0 +1,204 @@
+package znet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 可靠消息的内容 |Seq(8)|MsgID(4)|Data|，确认消息的内容 |Seq(8)|
+const reliableHeadLen = 12
+
+var (
+	// ErrReliableBufferFull 未确认的可靠消息已达到 ReliableBufferSize
+	ErrReliableBufferFull = errors.New("reliable msg buffer is full")
+
+	// ErrSessionExpired 会话过期时仍未确认的可靠消息投递失败
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// reliableMsg 一个等待确认的可靠消息
+type reliableMsg struct {
+	seq      uint64
+	msgID    uint32
+	data     []byte
+	callback ziface.DeliveryCallback
+}
+
+// reliableBuffer 等待确认的可靠消息，开启会话时属于会话，断线重连后重新发送
+type reliableBuffer struct {
+	// 保证序列号的分配和发送顺序一致，发送时持有，确认消息不需要等待它
+	sendLock sync.Mutex
+	// 保护 nextSeq 和 pending，不在持有时发送
+	lock    sync.Mutex
+	nextSeq uint64
+	pending []*reliableMsg
+}
+
+// newReliableBuffer 创建可靠消息的缓冲
+func newReliableBuffer() *reliableBuffer {
+	return &reliableBuffer{nextSeq: 1}
+}
+
+// restoreReliableBuffer 根据会话存储中的数据恢复可靠消息的缓冲，投递结果的回调已经丢失
+func restoreReliableBuffer(nextSeq uint64, pending []ziface.PendingMsg) *reliableBuffer {
+	b := newReliableBuffer()
+	if nextSeq > b.nextSeq {
+		b.nextSeq = nextSeq
+	}
+	for _, msg := range pending {
+		b.pending = append(b.pending, &reliableMsg{seq: msg.Seq, msgID: msg.MsgID, data: msg.Data})
+	}
+	return b
+}
+
+// snapshot 获取下一个序列号和所有未确认的消息，用于保存到会话存储
+func (b *reliableBuffer) snapshot() (uint64, []ziface.PendingMsg) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	pending := make([]ziface.PendingMsg, 0, len(b.pending))
+	for _, msg := range b.pending {
+		pending = append(pending, ziface.PendingMsg{Seq: msg.seq, MsgID: msg.msgID, Data: msg.data})
+	}
+	return b.nextSeq, pending
+}
+
+// encode 生成可靠消息的内容
+func (m *reliableMsg) encode() []byte {
+	data := make([]byte, reliableHeadLen+len(m.data))
+	binary.LittleEndian.PutUint64(data, m.seq)
+	binary.LittleEndian.PutUint32(data[8:], m.msgID)
+	copy(data[reliableHeadLen:], m.data)
+	return data
+}
+
+// send 分配序列号并发送，消息在确认之前保留在缓冲中
+// keep 为 false 时（没有会话可以恢复）发送失败的消息直接移除
+func (b *reliableBuffer) send(conn ziface.IConnection, msgID uint32, data []byte, callback ziface.DeliveryCallback, keep bool) (uint64, error) {
+	b.sendLock.Lock()
+	defer b.sendLock.Unlock()
+
+	// 先放入缓冲再发送，发送期间收到的确认可以找到该消息
+	b.lock.Lock()
+	if len(b.pending) >= utils.GlobalObject.ReliableBufferSize {
+		b.lock.Unlock()
+		return 0, ErrReliableBufferFull
+	}
+	msg := &reliableMsg{
+		seq:      b.nextSeq,
+		msgID:    msgID,
+		data:     append([]byte(nil), data...),
+		callback: callback,
+	}
+	b.nextSeq++
+	b.pending = append(b.pending, msg)
+	b.lock.Unlock()
+
+	if err := conn.SendMsg(MsgIDReliable, msg.encode()); err != nil && !keep {
+		b.lock.Lock()
+		removed := b.remove(msg)
+		if removed && b.nextSeq == msg.seq+1 {
+			b.nextSeq--
+		}
+		b.lock.Unlock()
+		// 已经被确认或者通知失败的消息由 callback 报告结果
+		if removed {
+			return 0, err
+		}
+	}
+
+	return msg.seq, nil
+}
+
+// remove 从缓冲中移除消息，调用方需持有 lock
+func (b *reliableBuffer) remove(msg *reliableMsg) bool {
+	for i, pending := range b.pending {
+		if pending == msg {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ack 确认序列号不大于 seq 的所有消息，并通知投递成功
+func (b *reliableBuffer) ack(seq uint64) {
+	b.lock.Lock()
+	n := 0
+	for n < len(b.pending) && b.pending[n].seq <= seq {
+		n++
+	}
+	acked := b.pending[:n]
+	b.pending = b.pending[n:]
+	b.lock.Unlock()
+
+	for _, msg := range acked {
+		if msg.callback != nil {
+			msg.callback(msg.seq, nil)
+		}
+	}
+}
+
+// resend 会话恢复后按顺序重新发送所有未确认的消息，调用方需持有 sendLock
+func (b *reliableBuffer) resend(conn ziface.IConnection) {
+	b.lock.Lock()
+	frames := make([][]byte, 0, len(b.pending))
+	for _, msg := range b.pending {
+		frames = append(frames, msg.encode())
+	}
+	b.lock.Unlock()
+
+	for _, frame := range frames {
+		if err := conn.SendMsg(MsgIDReliable, frame); err != nil {
+			return
+		}
+	}
+}
+
+// fail 通知所有未确认的消息投递失败
+func (b *reliableBuffer) fail(err error) {
+	b.lock.Lock()
+	failed := b.pending
+	b.pending = nil
+	b.lock.Unlock()
+
+	for _, msg := range failed {
+		if msg.callback != nil {
+			msg.callback(msg.seq, err)
+		}
+	}
+}
+
+// SendMsgReliable 发送需要客户端确认的消息，客户端收到 MsgIDReliable 后回复 MsgIDAck
+// 开启会话时未确认的消息在会话恢复后重新发送，会话过期时投递失败；未开启会话时链接断开即投递失败
+// callback 在确认或失败时调用，可以为 nil
+func (c *Connection) SendMsgReliable(msgID uint32, data []byte, callback ziface.DeliveryCallback) (uint64, error) {
+	if session := c.currentSession(); session != nil {
+		return session.reliable.send(c, msgID, data, callback, true)
+	}
+	return c.reliable.send(c, msgID, data, callback, false)
+}
+
+// handleAck 处理客户端的确认消息，返回 false 表示该消息不是确认消息
+func (c *Connection) handleAck(msg ziface.IMessage) bool {
+	if msg.GetMsgID() != MsgIDAck {
+		return false
+	}
+	if msg.GetDataLen() != 8 {
+		fmt.Println("ConnID=", c.ConnID, " invalid ack msg")
+		return true
+	}
+
+	seq := binary.LittleEndian.Uint64(msg.GetData())
+	if session := c.currentSession(); session != nil {
+		session.reliable.ack(seq)
+	} else {
+		c.reliable.ack(seq)
+	}
+	return true
+}
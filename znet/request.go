@@ -1,6 +1,10 @@
 package znet
 
-import "github.com/646222472/zinx/ziface"
+import (
+	"context"
+
+	"github.com/646222472/zinx/ziface"
+)
 
 // Request 请求的封装
 type Request struct {
@@ -9,6 +13,12 @@ type Request struct {
 
 	// 客户端请求的数据
 	msg ziface.IMessage
+
+	// 请求的 Context，由 MsgHandler 在调度业务时设置
+	ctx context.Context
+
+	// 流式处理的分片消息中当前分片的位置
+	chunk *chunkInfo
 }
 
 // GetConnection 得到当前链接
@@ -25,3 +35,22 @@ func (r *Request) GetData() []byte {
 func (r *Request) GetMsgID() uint32 {
 	return r.msg.GetMsgID()
 }
+
+// Bind 使用该 MsgID 对应的序列化器将请求的消息数据解码到 v 中
+func (r *Request) Bind(v interface{}) error {
+	return r.conn.GetTCPServer().GetMsgSerializer(r.GetMsgID()).Unmarshal(r.GetData(), v)
+}
+
+// Context 得到请求的 Context，未设置时使用链接的 Context
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return r.conn.Context()
+}
+
+// Release 将消息数据所在的缓冲交还给缓冲池，之后不可再使用 GetData 得到的数据
+// SendMsg 返回时已经复制了要发送的数据，因此回显请求数据后即可调用
+func (r *Request) Release() {
+	releaseMsg(r.msg)
+}
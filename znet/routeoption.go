@@ -0,0 +1,68 @@
+package znet
+
+import (
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 消息的优先级，每个 Worker 为每个优先级维护一条任务队列（lane）
+const (
+	PriorityLow uint8 = iota
+	PriorityNormal
+	PriorityHigh
+
+	// 优先级的数量
+	priorityLevels = int(PriorityHigh) + 1
+)
+
+// newRouteConfig 根据可选配置项生成路由配置
+func newRouteConfig(opts ...ziface.RouteOption) *ziface.RouteConfig {
+	config := &ziface.RouteConfig{
+		Priority: PriorityNormal,
+		Timeout:  time.Duration(utils.GlobalObject.HandlerTimeout) * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// WithPriority 设置消息的优先级，如登录、心跳等消息可以设置为 PriorityHigh
+func WithPriority(priority uint8) ziface.RouteOption {
+	return func(config *ziface.RouteConfig) {
+		if priority > PriorityHigh {
+			priority = PriorityHigh
+		}
+		config.Priority = priority
+	}
+}
+
+// WithTimeout 设置处理该消息的超时时间，覆盖全局的 HandlerTimeout，0 表示不限制
+func WithTimeout(timeout time.Duration) ziface.RouteOption {
+	return func(config *ziface.RouteConfig) {
+		config.Timeout = timeout
+	}
+}
+
+// WithMiddleware 为该消息单独添加中间件，在分组的中间件之后执行
+func WithMiddleware(middlewares ...ziface.Middleware) ziface.RouteOption {
+	return func(config *ziface.RouteConfig) {
+		config.Middlewares = append(config.Middlewares, middlewares...)
+	}
+}
+
+// WithRoles 要求链接的身份拥有其中任意一个角色才能处理该消息，与分组要求的角色需要同时满足
+func WithRoles(roles ...string) ziface.RouteOption {
+	return func(config *ziface.RouteConfig) {
+		config.Roles = append(config.Roles, roles...)
+	}
+}
+
+// withGroup 设置消息所属的路由分组，由 RouterGroup 注册路由时使用
+func withGroup(group ziface.IRouterGroup) ziface.RouteOption {
+	return func(config *ziface.RouteConfig) {
+		config.Group = group
+	}
+}
@@ -16,3 +16,17 @@ func (br *BaseRouter) Handle(request ziface.IRequest) {}
 
 // PostHandle 在处理conn业务之后的钩子方法Hook
 func (br *BaseRouter) PostHandle(request ziface.IRequest) {}
+
+// FuncRouter 将函数形式的处理方法适配为 IRouter，函数作为 Handle 调用
+type FuncRouter ziface.HandlerFunc
+
+// PreHandle 在处理conn业务之前的钩子方法Hook
+func (f FuncRouter) PreHandle(request ziface.IRequest) {}
+
+// Handle 在处理conn业务的主方法Hook
+func (f FuncRouter) Handle(request ziface.IRequest) {
+	f(request)
+}
+
+// PostHandle 在处理conn业务之后的钩子方法Hook
+func (f FuncRouter) PostHandle(request ziface.IRequest) {}
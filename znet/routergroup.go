@@ -0,0 +1,89 @@
+package znet
+
+import (
+	"fmt"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+// RouterGroup 路由分组，占用一段连续的 MsgID，分组内的路由共享分组的中间件
+type RouterGroup struct {
+	// 分组的名称
+	name string
+	// 分组占用的 MsgID 范围 [start, end]
+	start, end uint32
+	// 分组的中间件
+	middlewares []ziface.Middleware
+	// 分组要求的角色
+	roles []string
+	// 分组所属的消息管理模块
+	msgHandler ziface.IMsgHandler
+}
+
+// NewRouterGroup 创建一个路由分组
+func NewRouterGroup(name string, start, end uint32, msgHandler ziface.IMsgHandler) *RouterGroup {
+	if start > end {
+		panic(fmt.Sprintf("router group %s invalid range [%d, %d]", name, start, end))
+	}
+
+	return &RouterGroup{
+		name:       name,
+		start:      start,
+		end:        end,
+		msgHandler: msgHandler,
+	}
+}
+
+// Name 获取分组的名称
+func (g *RouterGroup) Name() string {
+	return g.name
+}
+
+// Range 获取分组占用的 MsgID 范围 [start, end]
+func (g *RouterGroup) Range() (start, end uint32) {
+	return g.start, g.end
+}
+
+// Use 为分组添加中间件，对分组内已经注册和之后注册的路由都生效
+func (g *RouterGroup) Use(middlewares ...ziface.Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+// Middlewares 获取分组的中间件
+func (g *RouterGroup) Middlewares() []ziface.Middleware {
+	return g.middlewares
+}
+
+// RequireRoles 要求链接的身份拥有其中任意一个角色才能处理分组内的消息，对已经注册的路由同样生效
+func (g *RouterGroup) RequireRoles(roles ...string) {
+	g.roles = append(g.roles, roles...)
+}
+
+// Roles 获取分组要求的角色
+func (g *RouterGroup) Roles() []string {
+	return g.roles
+}
+
+// AddRouter 在分组内添加路由，MsgID 必须在分组的范围内
+func (g *RouterGroup) AddRouter(msgID uint32, router ziface.IRouter, opts ...ziface.RouteOption) {
+	g.checkRange(msgID)
+	g.msgHandler.AddRouter(msgID, router, append([]ziface.RouteOption{withGroup(g)}, opts...)...)
+}
+
+// AddStreamRouter 在分组内添加流式处理分片消息的路由
+func (g *RouterGroup) AddStreamRouter(msgID uint32, stream ziface.IStreamRouter, opts ...ziface.RouteOption) {
+	g.checkRange(msgID)
+	g.msgHandler.AddStreamRouter(msgID, stream, append([]ziface.RouteOption{withGroup(g)}, opts...)...)
+}
+
+// checkRange MsgID 必须在分组的范围内
+func (g *RouterGroup) checkRange(msgID uint32) {
+	if msgID < g.start || msgID > g.end {
+		panic(fmt.Sprintf("MsgID=%d out of router group %s range [%d, %d]", msgID, g.name, g.start, g.end))
+	}
+}
+
+// AddHandlerFunc 在分组内以函数的形式添加路由
+func (g *RouterGroup) AddHandlerFunc(msgID uint32, handle ziface.HandlerFunc, opts ...ziface.RouteOption) {
+	g.AddRouter(msgID, FuncRouter(handle), opts...)
+}
@@ -0,0 +1,66 @@
+package znet
+
+import (
+	"testing"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestRouterGroupMiddleware(t *testing.T) {
+	mh := NewMsgHandler()
+
+	var trace []string
+	mark := func(name string) ziface.Middleware {
+		return func(next ziface.HandlerFunc) ziface.HandlerFunc {
+			return func(request ziface.IRequest) {
+				trace = append(trace, name)
+				next(request)
+			}
+		}
+	}
+
+	chat := mh.Group("chat", 1000, 1999, mark("group"))
+	chat.AddHandlerFunc(1001, func(request ziface.IRequest) {
+		trace = append(trace, "handle")
+	}, WithMiddleware(mark("route")))
+	// 其它模块获取同名分组，追加的中间件同样生效
+	mh.Group("chat", 1000, 1999).Use(mark("module"))
+
+	mh.DoMsgHandler(&Request{conn: &Connection{ConnID: 1}, msg: NewMessage(1001, nil)})
+
+	want := []string{"group", "module", "route", "handle"}
+	if len(trace) != len(want) {
+		t.Fatalf("trace = %v, want %v", trace, want)
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Fatalf("trace = %v, want %v", trace, want)
+		}
+	}
+
+	routes := mh.Routes()
+	if len(routes) != 1 || routes[0].MsgID != 1001 || routes[0].Group != "chat" {
+		t.Fatalf("routes = %+v", routes)
+	}
+}
+
+func TestRouterGroupValidate(t *testing.T) {
+	mh := NewMsgHandler()
+	mh.Group("chat", 1000, 1999)
+	mh.Group("room", 2000, 2999)
+	if err := mh.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	mh.AddRouter(2500, &BaseRouter{})
+	if err := mh.Validate(); err == nil {
+		t.Fatal("route in group range registered outside the group should fail")
+	}
+
+	mh = NewMsgHandler()
+	mh.Group("chat", 1000, 1999)
+	mh.Group("bag", 1500, 2499)
+	if err := mh.Validate(); err == nil {
+		t.Fatal("overlapping groups should fail")
+	}
+}
@@ -0,0 +1,118 @@
+package znet
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/646222472/zinx/ziface"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// serializers 按名称注册的序列化器，用于从 zinx.json 中选择默认的序列化器
+	serializers = map[string]ziface.ISerializer{
+		"json":     NewJSONSerializer(),
+		"protobuf": NewProtobufSerializer(),
+		"msgpack":  NewMsgpackSerializer(),
+	}
+	// 保护 serializers 的读写锁
+	serializersLock sync.RWMutex
+)
+
+// RegisterSerializer 注册一个自定义的序列化器，之后可以在 zinx.json 中通过名称选择
+func RegisterSerializer(serializer ziface.ISerializer) {
+	serializersLock.Lock()
+	defer serializersLock.Unlock()
+
+	serializers[serializer.Name()] = serializer
+}
+
+// GetSerializerByName 根据名称获取已注册的序列化器
+func GetSerializerByName(name string) (ziface.ISerializer, error) {
+	serializersLock.RLock()
+	defer serializersLock.RUnlock()
+
+	if serializer, ok := serializers[name]; ok {
+		return serializer, nil
+	}
+	return nil, fmt.Errorf("serializer %s NOT FOUND", name)
+}
+
+// JSONSerializer 基于 encoding/json 的序列化器
+type JSONSerializer struct{}
+
+// NewJSONSerializer 创建一个 JSON 序列化器
+func NewJSONSerializer() *JSONSerializer {
+	return &JSONSerializer{}
+}
+
+// Name 序列化器的名称
+func (s *JSONSerializer) Name() string {
+	return "json"
+}
+
+// Marshal 将业务结构体编码为 JSON
+func (s *JSONSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal 将 JSON 解码到业务结构体中
+func (s *JSONSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufSerializer 基于 google.golang.org/protobuf 的序列化器，业务结构体必须是 protoc 生成的 proto.Message
+type ProtobufSerializer struct{}
+
+// NewProtobufSerializer 创建一个 Protobuf 序列化器
+func NewProtobufSerializer() *ProtobufSerializer {
+	return &ProtobufSerializer{}
+}
+
+// Name 序列化器的名称
+func (s *ProtobufSerializer) Name() string {
+	return "protobuf"
+}
+
+// Marshal 将 proto.Message 编码为 Protobuf 二进制
+func (s *ProtobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+// Unmarshal 将 Protobuf 二进制解码到 proto.Message 中
+func (s *ProtobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// MsgpackSerializer 基于 MessagePack 的序列化器
+type MsgpackSerializer struct{}
+
+// NewMsgpackSerializer 创建一个 MessagePack 序列化器
+func NewMsgpackSerializer() *MsgpackSerializer {
+	return &MsgpackSerializer{}
+}
+
+// Name 序列化器的名称
+func (s *MsgpackSerializer) Name() string {
+	return "msgpack"
+}
+
+// Marshal 将业务结构体编码为 MessagePack
+func (s *MsgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal 将 MessagePack 解码到业务结构体中
+func (s *MsgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
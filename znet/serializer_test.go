@@ -0,0 +1,121 @@
+package znet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testGreeting struct {
+	Name  string `json:"name" msgpack:"name"`
+	Count int    `json:"count" msgpack:"count"`
+}
+
+func TestSerializerRoundTrip(t *testing.T) {
+	for _, name := range []string{"json", "msgpack"} {
+		serializer, err := GetSerializerByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := serializer.Marshal(&testGreeting{Name: "zinx", Count: 3})
+		if err != nil {
+			t.Fatalf("%s marshal: %v", name, err)
+		}
+		var out testGreeting
+		if err := serializer.Unmarshal(data, &out); err != nil || out.Name != "zinx" || out.Count != 3 {
+			t.Fatalf("%s round trip = %+v, %v", name, out, err)
+		}
+	}
+
+	// Protobuf 只接受 proto.Message
+	serializer, err := GetSerializerByName("protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := serializer.Marshal(wrapperspb.String("zinx"))
+	if err != nil {
+		t.Fatalf("protobuf marshal: %v", err)
+	}
+	out := &wrapperspb.StringValue{}
+	if err := serializer.Unmarshal(data, out); err != nil || out.GetValue() != "zinx" {
+		t.Fatalf("protobuf round trip = %q, %v", out.GetValue(), err)
+	}
+	if _, err := serializer.Marshal(&testGreeting{}); err == nil {
+		t.Fatal("protobuf marshal of non proto.Message should fail")
+	}
+	if err := serializer.Unmarshal(data, &testGreeting{}); err == nil {
+		t.Fatal("protobuf unmarshal into non proto.Message should fail")
+	}
+
+	if _, err := GetSerializerByName("xml"); err == nil {
+		t.Fatal("unknown serializer should fail")
+	}
+}
+
+func TestServerBindAndSendObj(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.Serializer = "json"
+
+	// MsgID 1 使用默认的 JSON，MsgID 2 使用 MessagePack，MsgID 3 使用 Protobuf
+	s := NewServer("serializer").(*Server)
+	s.SetMsgSerializer(2, NewMsgpackSerializer())
+	s.SetMsgSerializer(3, NewProtobufSerializer())
+	greet := func(request ziface.IRequest) {
+		var in testGreeting
+		if err := request.Bind(&in); err != nil {
+			request.GetConnection().SendMsg(request.GetMsgID(), []byte(err.Error()))
+			return
+		}
+		request.GetConnection().SendObj(request.GetMsgID(), &testGreeting{Name: "hello " + in.Name, Count: in.Count + 1})
+	}
+	s.AddHandlerFunc(1, greet)
+	s.AddHandlerFunc(2, greet)
+	s.AddHandlerFunc(3, func(request ziface.IRequest) {
+		in := &wrapperspb.StringValue{}
+		if err := request.Bind(in); err != nil {
+			t.Errorf("bind protobuf: %v", err)
+			return
+		}
+		// 不是 proto.Message 时编码失败，不发送任何消息
+		if err := request.GetConnection().SendObj(3, &testGreeting{}); err == nil {
+			t.Errorf("send non proto.Message should fail")
+		}
+		request.GetConnection().SendObj(3, wrapperspb.String("hello "+in.GetValue()))
+	})
+	s.Start()
+	defer s.Stop()
+
+	conn := dialTest(t, s.Port)
+	defer conn.Close()
+
+	for msgID, serializer := range map[uint32]ziface.ISerializer{1: NewJSONSerializer(), 2: NewMsgpackSerializer()} {
+		data, _ := serializer.Marshal(&testGreeting{Name: "zinx", Count: 1})
+		sendTestMsg(conn, msgID, data)
+		msg := readTestMsg(t, conn)
+		var out testGreeting
+		if err := serializer.Unmarshal(msg.Data, &out); err != nil || msg.ID != msgID || out.Name != "hello zinx" || out.Count != 2 {
+			t.Fatalf("msg %d reply id=%d %+v, %v", msgID, msg.ID, out, err)
+		}
+	}
+
+	// 按 MsgID 选择序列化器，JSON 数据发给 MessagePack 的 MsgID 时解码失败
+	data, _ := NewJSONSerializer().Marshal(&testGreeting{Name: "zinx"})
+	sendTestMsg(conn, 2, data)
+	if msg := readTestMsg(t, conn); msg.ID != 2 || !strings.HasPrefix(string(msg.Data), "msgpack:") {
+		t.Fatalf("msgpack bind of json data should fail, got id=%d %q", msg.ID, msg.Data)
+	}
+
+	data, _ = NewProtobufSerializer().Marshal(wrapperspb.String("zinx"))
+	sendTestMsg(conn, 3, data)
+	msg := readTestMsg(t, conn)
+	out := &wrapperspb.StringValue{}
+	if err := NewProtobufSerializer().Unmarshal(msg.Data, out); err != nil || msg.ID != 3 || out.GetValue() != "hello zinx" {
+		t.Fatalf("protobuf reply id=%d %q, %v", msg.ID, out.GetValue(), err)
+	}
+}
@@ -1,8 +1,12 @@
 package znet
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/646222472/zinx/utils"
 	"github.com/646222472/zinx/ziface"
@@ -26,6 +30,45 @@ type Server struct {
 	OnConnStart func(conn ziface.IConnection)
 	// 该 Server 销毁链接之前自动调用 Hook 函数 -- OnConnStop
 	OnConnStop func(conn ziface.IConnection)
+	// 消息超出速率限制时调用的 Hook 函数 -- OnRateLimit
+	OnRateLimit func(conn ziface.IConnection, msgID uint32, scope string)
+	// 新的链接通过内置的接入控制之后调用的 Hook 函数，返回 false 时拒绝该链接 -- OnAccept
+	OnAccept func(conn *net.TCPConn) bool
+	// 消息内容默认的序列化器
+	Serializer ziface.ISerializer
+	// 单独设置了序列化器的 MsgID
+	msgSerializers map[uint32]ziface.ISerializer
+	// 接入控制模块
+	filter *acceptFilter
+	// 超出最大链接数时的等待队列
+	queue *connQueue
+	// 远程 IP 的消息令牌桶，同一个 IP 的所有链接共享
+	ipRates *ipBuckets
+	// 链接认证的配置，未开启认证时为 nil
+	auth *authConfig
+	// 会话管理模块
+	sessions *SessionManager
+	// 会话被新的链接恢复之后调用的 Hook 函数 -- OnSessionResume
+	OnSessionResume func(conn ziface.IConnection, session ziface.ISession)
+	// 下一个链接的ID
+	cid uint32
+	// 集群模块，未开启集群时为 nil
+	cluster *Cluster
+	// 网关模块，没有转发任何消息时为 nil
+	gateway *gateway
+	// 服务发现，未设置时为 nil
+	registry ziface.IRegistry
+	// 注册到服务发现中的实例
+	instance ziface.ServiceInstance
+	// 是否已经注册
+	registered bool
+	// 服务发现是否由配置创建，由配置创建的在 Stop 时关闭
+	ownRegistry bool
+	// 监听的 socket，Stop 时关闭
+	listener     *net.TCPListener
+	listenerLock sync.Mutex
+	// 是否已经停止
+	stopped bool
 }
 
 // Start 启动服务器
@@ -44,6 +87,11 @@ func (s *Server) Start() {
 	)
 	fmt.Printf("[Start] Server Listenner at IP :%s, Port%d, is starting\n", s.IP, s.Port)
 
+	// 校验路由配置，如分组的 MsgID 范围是否重叠
+	if err := s.MsgHandler.Validate(); err != nil {
+		panic(err)
+	}
+
 	go func() {
 		// 0 开启消息队列及 Worker 工作池
 		s.MsgHandler.StartWorkerPool()
@@ -62,44 +110,144 @@ func (s *Server) Start() {
 			return
 		}
 
+		s.listenerLock.Lock()
+		if s.stopped {
+			s.listenerLock.Unlock()
+			listenner.Close()
+			return
+		}
+		s.listener = listenner
+		s.listenerLock.Unlock()
+
 		fmt.Printf("start Zinx Server succ, %s succ, Listenning ...\n", s.Name)
-		var cid uint32
-		cid = 0
+
+		// 开启集群时链接其它节点
+		if s.cluster != nil {
+			s.cluster.start()
+		}
+
+		// 开启网关时链接所有的后端
+		if s.gateway != nil {
+			s.gateway.start()
+		}
+
+		// 开始接入链接之后注册到服务发现
+		s.register()
 
 		// 3 阻塞等待客户端连接，处理客户端连接业务（读写）
 		for {
 			// 如果客户端连接过来，阻塞会返回
 			conn, err := listenner.AcceptTCP()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				fmt.Println("Accpet err", err)
 				continue
 			}
 
-			// 判断当前系统中的链接数量是否大于最大链接数 MaxConn
-			if s.ConnMgr.Len() >= utils.GlobalObject.MaxConn {
-				// TODO 给客户端响应一个超出最大链接的错误包
-				fmt.Printf("Too many connections MaxConn=%d", utils.GlobalObject.MaxConn)
+			// 接入控制：黑白名单、单个 IP 的链接数、新建链接的速率
+			if err := s.checkAccept(conn); err != nil {
+				fmt.Println("Reject connection from", conn.RemoteAddr(), err)
 				conn.Close()
 				continue
 			}
 
-			// 将处理新连接的业务方法和conn进行绑定 得到我们的链接模块
-			dealConn := NewConnection(s, conn, cid, s.MsgHandler)
-			cid++
+			// 开启等待队列时，超出最大链接数 MaxConn 的链接在队列中等待空闲的位置
+			if utils.GlobalObject.ConnQueueSize > 0 {
+				s.queue.accept(conn)
+				continue
+			}
+
+			// 判断当前系统中的链接数量是否大于最大链接数 MaxConn，超出时回复 MsgIDServerFull 之后关闭
+			if s.ConnMgr.Len() >= utils.GlobalObject.MaxConn {
+				go rejectFull(conn)
+				continue
+			}
 
-			// 启动当前的链接业务模块
-			go dealConn.Start()
+			s.startConn(conn)
 		}
 
 	}()
 
 }
 
+// startConn 创建并启动链接模块
+func (s *Server) startConn(conn *net.TCPConn) {
+	// 将处理新连接的业务方法和conn进行绑定 得到我们的链接模块
+	dealConn := NewConnection(s, conn, s.nextConnID(), s.MsgHandler)
+
+	// 启动当前的链接业务模块
+	go dealConn.Start()
+}
+
+// nextConnID 分配链接 ID，网关转发的虚拟链接也使用它
+func (s *Server) nextConnID() uint32 {
+	return atomic.AddUint32(&s.cid, 1) - 1
+}
+
+// connRemoved 链接从 ConnMgr 中摘除之后调用，等待队列中的链接可以接入
+func (s *Server) connRemoved(conn *Connection) {
+	s.queue.admit()
+
+	// 通知后端客户端链接已经断开
+	if s.gateway != nil {
+		s.gateway.connClosed(conn.ConnID)
+	}
+}
+
+// checkAccept 在创建链接之前检查是否允许接入
+func (s *Server) checkAccept(conn *net.TCPConn) error {
+	ip := remoteIP(conn.RemoteAddr())
+	// 等待队列中的链接同样计入单个 IP 的链接数
+	// 先统计队列再统计 ConnMgr，正在接入的链接最多被计算两次而不会被漏掉
+	ipConns := s.queue.lenByIP(ip)
+	ipConns += s.ConnMgr.LenByIP(ip)
+	if err := s.filter.check(net.ParseIP(ip), ipConns); err != nil {
+		return err
+	}
+	if s.OnAccept != nil && !s.OnAccept(conn) {
+		return ErrAcceptRejected
+	}
+	return nil
+}
+
 // Stop 停止服务器
 func (s *Server) Stop() {
 	// 将一些服务器的资源、状态或者一些已经开辟的链接信息进行停止或者回收
 	fmt.Printf("[STOP] Zinx server name %s", s.Name)
+
+	// 不再接入新的链接
+	s.listenerLock.Lock()
+	s.stopped = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.listenerLock.Unlock()
+
+	// 从服务发现中注销，不再有新的链接分配过来
+	s.deregister()
+
+	// 断开与其它节点的链接
+	if s.cluster != nil {
+		s.cluster.stop()
+	}
+
+	// 断开与后端的链接
+	if s.gateway != nil {
+		s.gateway.stop()
+	}
+
+	// 先关闭等待队列，断开链接时不再从队列中接入新的链接
+	s.queue.close()
 	s.ConnMgr.ClearConn()
+
+	// 链接停止时会话已经保存到会话存储中，等待新的进程恢复
+	// 先停止过期定时器，关闭之后不再有删除写入存储
+	s.sessions.stop()
+	if err := s.sessions.GetStore().Close(); err != nil {
+		fmt.Println("close session store error ", err)
+	}
 }
 
 // Serve 运行服务器
@@ -114,11 +262,54 @@ func (s *Server) Serve() {
 }
 
 // AddRouter 添加路由功能
-func (s *Server) AddRouter(msgID uint32, router ziface.IRouter) {
-	s.MsgHandler.AddRouter(msgID, router)
+func (s *Server) AddRouter(msgID uint32, router ziface.IRouter, opts ...ziface.RouteOption) {
+	s.MsgHandler.AddRouter(msgID, router, opts...)
 	fmt.Println("Add Router Succ!!")
 }
 
+// AddHandlerFunc 以函数的形式添加路由
+func (s *Server) AddHandlerFunc(msgID uint32, handle ziface.HandlerFunc, opts ...ziface.RouteOption) {
+	s.AddRouter(msgID, FuncRouter(handle), opts...)
+}
+
+// Group 创建（或获取同名的）路由分组
+func (s *Server) Group(name string, start, end uint32, middlewares ...ziface.Middleware) ziface.IRouterGroup {
+	return s.MsgHandler.Group(name, start, end, middlewares...)
+}
+
+// Routes 获取所有已注册的路由
+func (s *Server) Routes() []ziface.RouteInfo {
+	return s.MsgHandler.Routes()
+}
+
+// AddStreamRouter 添加流式处理分片消息的路由
+func (s *Server) AddStreamRouter(msgID uint32, stream ziface.IStreamRouter, opts ...ziface.RouteOption) {
+	s.MsgHandler.AddStreamRouter(msgID, stream, opts...)
+}
+
+// SetSerializer 设置消息内容的序列化器
+func (s *Server) SetSerializer(serializer ziface.ISerializer) {
+	s.Serializer = serializer
+}
+
+// GetSerializer 获取消息内容的序列化器
+func (s *Server) GetSerializer() ziface.ISerializer {
+	return s.Serializer
+}
+
+// SetMsgSerializer 为某个 MsgID 单独设置序列化器
+func (s *Server) SetMsgSerializer(msgID uint32, serializer ziface.ISerializer) {
+	s.msgSerializers[msgID] = serializer
+}
+
+// GetMsgSerializer 获取某个 MsgID 使用的序列化器，没有单独设置时返回默认的序列化器
+func (s *Server) GetMsgSerializer(msgID uint32) ziface.ISerializer {
+	if serializer, ok := s.msgSerializers[msgID]; ok {
+		return serializer
+	}
+	return s.Serializer
+}
+
 // GetConnMgr 获取当前 Server 的链接管理器
 func (s *Server) GetConnMgr() ziface.IConnManager {
 	return s.ConnMgr
@@ -126,14 +317,64 @@ func (s *Server) GetConnMgr() ziface.IConnManager {
 
 // NewServer 初始化Server的方法
 func NewServer(name string) ziface.IServer {
-	return &Server{
-		Name:       utils.GlobalObject.Name,
-		IPVersion:  "tcp4",
-		IP:         utils.GlobalObject.Host,
-		Port:       utils.GlobalObject.TCPPort,
-		MsgHandler: NewMsgHandler(),
-		ConnMgr:    NewConnManager(),
+	serializer, err := GetSerializerByName(utils.GlobalObject.Serializer)
+	if err != nil {
+		panic(err)
+	}
+	filter, err := newAcceptFilter()
+	if err != nil {
+		panic(err)
+	}
+	if utils.GlobalObject.MaxMessageSize > 0 {
+		// 开启分片时 MaxPackageSize 至少要容纳分片头和加密开销
+		if _, err := maxChunkSize(utils.GlobalObject.Encryption != ""); err != nil {
+			panic(err)
+		}
+	}
+
+	s := &Server{
+		Name:           utils.GlobalObject.Name,
+		IPVersion:      "tcp4",
+		IP:             utils.GlobalObject.Host,
+		Port:           utils.GlobalObject.TCPPort,
+		MsgHandler:     NewMsgHandler(),
+		ConnMgr:        NewConnManager(),
+		Serializer:     serializer,
+		msgSerializers: make(map[uint32]ziface.ISerializer),
+		filter:         filter,
+		ipRates:        newIPBuckets(),
+	}
+	s.queue = newConnQueue(s)
+	s.sessions = NewSessionManager(nil)
+	s.instance = ziface.ServiceInstance{
+		Name: s.Name,
+		Addr: utils.GlobalObject.AdvertiseAddr,
+	}
+	if ip := net.ParseIP(s.IP); s.instance.Addr == "" && s.IP != "" && (ip == nil || !ip.IsUnspecified()) {
+		// 监听所有地址时没有可以注册的地址，注册时返回 ErrAdvertiseAddrRequired
+		s.instance.Addr = fmt.Sprintf("%s:%d", s.IP, s.Port)
+	}
+	if utils.GlobalObject.RegistryFile != "" {
+		registry, err := NewFileRegistry(utils.GlobalObject.RegistryFile, 0)
+		if err != nil {
+			panic(err)
+		}
+		s.registry, s.ownRegistry = registry, true
 	}
+	if utils.GlobalObject.ClusterNodeID != "" {
+		if s.cluster, err = newCluster(s); err != nil {
+			panic(err)
+		}
+	}
+	if utils.GlobalObject.SessionStoreFile != "" {
+		store, err := NewFileSessionStore(utils.GlobalObject.SessionStoreFile)
+		if err != nil {
+			panic(err)
+		}
+		s.sessions.setStore(store)
+	}
+
+	return s
 }
 
 // SetOnConnStart 注册 OnConnStart 钩子函数的方法
@@ -161,3 +402,167 @@ func (s *Server) CallOnConnStop(conn ziface.IConnection) {
 		s.OnConnStop(conn)
 	}
 }
+
+// SetOnRateLimit 注册 OnRateLimit 钩子函数的方法
+func (s *Server) SetOnRateLimit(hookFunc func(conn ziface.IConnection, msgID uint32, scope string)) {
+	s.OnRateLimit = hookFunc
+}
+
+// CallOnRateLimit 调用 OnRateLimit 钩子函数的方法
+func (s *Server) CallOnRateLimit(conn ziface.IConnection, msgID uint32, scope string) {
+	if s.OnRateLimit != nil {
+		s.OnRateLimit(conn, msgID, scope)
+	}
+}
+
+// SetAccessList 替换接入的黑白名单，可以在运行时调用，已经建立的链接不受影响
+func (s *Server) SetAccessList(allow, deny []string) error {
+	return s.filter.setLists(allow, deny)
+}
+
+// SetOnAccept 注册 OnAccept 钩子函数的方法
+func (s *Server) SetOnAccept(hookFunc func(conn *net.TCPConn) bool) {
+	s.OnAccept = hookFunc
+}
+
+// SetAuthenticator 开启链接认证，认证通过之前只处理 MsgIDAuth 和 whitelist 中的 MsgID
+func (s *Server) SetAuthenticator(authenticator ziface.Authenticator, whitelist ...uint32) {
+	auth := &authConfig{
+		authenticator: authenticator,
+		whitelist:     make(map[uint32]bool),
+	}
+	for _, msgID := range whitelist {
+		auth.whitelist[msgID] = true
+	}
+	s.auth = auth
+}
+
+// authConfig 获取链接认证的配置
+func (s *Server) authConfig() *authConfig {
+	return s.auth
+}
+
+// GetSessionMgr 获取会话管理模块
+func (s *Server) GetSessionMgr() *SessionManager {
+	return s.sessions
+}
+
+// SetSessionStore 替换会话存储，需要在 Serve 之前调用
+func (s *Server) SetSessionStore(store ziface.ISessionStore) {
+	s.sessions.setStore(store)
+}
+
+// SetRegistry 设置服务发现，Server 启动时以 Name 和地址注册，停止时注销，需要在 Start 之前调用
+func (s *Server) SetRegistry(registry ziface.IRegistry, metadata map[string]string) {
+	if s.ownRegistry {
+		s.registry.(*FileRegistry).Close()
+		s.ownRegistry = false
+	}
+	s.registry = registry
+	s.instance.Metadata = metadata
+}
+
+// GetRegistry 获取服务发现，未设置时为 nil
+func (s *Server) GetRegistry() ziface.IRegistry {
+	return s.registry
+}
+
+// register 注册到服务发现
+func (s *Server) register() {
+	if s.registry == nil {
+		return
+	}
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	if s.stopped {
+		return
+	}
+	if s.instance.Addr == "" {
+		fmt.Println("register ", s.instance.Name, " error ", ErrAdvertiseAddrRequired)
+		return
+	}
+	if err := s.registry.Register(s.instance); err != nil {
+		fmt.Println("register ", s.instance.Name, " ", s.instance.Addr, " error ", err)
+		return
+	}
+	s.registered = true
+	fmt.Println("register ", s.instance.Name, " ", s.instance.Addr, " succ")
+}
+
+// deregister 从服务发现中注销，并关闭 Server 自己创建的服务发现
+func (s *Server) deregister() {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	if s.registered {
+		s.registered = false
+		if err := s.registry.Deregister(s.instance); err != nil {
+			fmt.Println("deregister ", s.instance.Name, " ", s.instance.Addr, " error ", err)
+		}
+	}
+	// 没有注册成功时也需要停止检查文件的变化
+	if s.ownRegistry {
+		s.registry.(*FileRegistry).Close()
+		s.ownRegistry = false
+	}
+}
+
+// GetCluster 获取集群模块，未开启集群时为 nil
+func (s *Server) GetCluster() *Cluster {
+	return s.cluster
+}
+
+// ipRateBuckets 获取远程 IP 的消息令牌桶，供链接使用
+func (s *Server) ipRateBuckets() *ipBuckets {
+	return s.ipRates
+}
+
+// clusterMgr 获取集群模块，供链接使用
+func (s *Server) clusterMgr() *Cluster {
+	return s.cluster
+}
+
+// SendMsgToUser 向用户的所有链接发送消息，开启集群时用户在其它节点上的链接通过节点之间的链接转发
+func (s *Server) SendMsgToUser(userID string, msgID uint32, data []byte) error {
+	sent := false
+	for _, conn := range s.ConnMgr.GetByUser(userID) {
+		if err := conn.SendMsg(msgID, data); err == nil {
+			sent = true
+		}
+	}
+	if s.cluster != nil && s.cluster.forward(userID, msgID, data) {
+		sent = true
+	}
+	if !sent {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// sessionMgr 获取会话管理模块，供链接使用
+func (s *Server) sessionMgr() *SessionManager {
+	return s.sessions
+}
+
+// SetOnSessionResume 注册 OnSessionResume 钩子函数的方法
+func (s *Server) SetOnSessionResume(hookFunc func(conn ziface.IConnection, session ziface.ISession)) {
+	s.OnSessionResume = hookFunc
+}
+
+// CallOnSessionResume 调用 OnSessionResume 钩子函数的方法
+func (s *Server) CallOnSessionResume(conn ziface.IConnection, session ziface.ISession) {
+	if s.OnSessionResume != nil {
+		s.OnSessionResume(conn, session)
+	}
+}
+
+// SetOnReject 注册工作池任务队列已满、请求被拒绝时的回调
+func (s *Server) SetOnReject(hookFunc func(request ziface.IRequest, reason error)) {
+	s.MsgHandler.SetOnReject(hookFunc)
+}
+
+// SetOnHandlerTimeout 注册业务处理超出超时时间时的回调
+func (s *Server) SetOnHandlerTimeout(hookFunc func(request ziface.IRequest, timeout time.Duration)) {
+	s.MsgHandler.SetOnHandlerTimeout(hookFunc)
+}
@@ -0,0 +1,427 @@
+package znet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+// 恢复会话的结果，服务端回复 MsgIDResume 时的第一个字节
+const (
+	ResumeOK     uint8 = 0 // 恢复成功
+	ResumeFailed uint8 = 1 // 恢复失败，之后是失败的原因，链接继续使用新的会话
+)
+
+// ErrSessionNotFound 会话不存在或已经过期
+var ErrSessionNotFound = errors.New("session NOT FOUND")
+
+// Session 可恢复的会话
+type Session struct {
+	lock sync.RWMutex
+	// 会话的 ID
+	id string
+	// 当前绑定的链接，等待恢复时为 nil
+	conn *Connection
+	// 加入的分组
+	groups map[string]struct{}
+	// 链接断开时保存的链接属性和身份
+	properties map[string]interface{}
+	identity   *ziface.Identity
+	// 等待恢复的过期定时器
+	expire *time.Timer
+	// 等待客户端确认的可靠消息
+	reliable *reliableBuffer
+}
+
+// newSession 创建一个绑定到链接的会话，ID 为 128 位的随机数
+func newSession(conn *Connection) (*Session, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Session{
+		id:       hex.EncodeToString(id),
+		conn:     conn,
+		groups:   make(map[string]struct{}),
+		reliable: newReliableBuffer(),
+	}, nil
+}
+
+// restoreSession 根据会话存储中的数据创建一个等待恢复的会话
+func restoreSession(data *ziface.SessionData) *Session {
+	s := &Session{
+		id:         data.ID,
+		groups:     make(map[string]struct{}),
+		properties: data.Properties,
+		identity:   data.Identity,
+		reliable:   restoreReliableBuffer(data.NextSeq, data.Pending),
+	}
+	for _, name := range data.Groups {
+		s.groups[name] = struct{}{}
+	}
+	return s
+}
+
+// data 生成保存到会话存储中的数据，调用方需持有锁
+func (s *Session) data(expireAt time.Time) *ziface.SessionData {
+	data := &ziface.SessionData{
+		ID:         s.id,
+		Properties: s.properties,
+		Identity:   s.identity,
+		Groups:     make([]string, 0, len(s.groups)),
+		ExpireAt:   expireAt,
+	}
+	for name := range s.groups {
+		data.Groups = append(data.Groups, name)
+	}
+	sort.Strings(data.Groups)
+	data.NextSeq, data.Pending = s.reliable.snapshot()
+	return data
+}
+
+// GetID 获取会话的 ID
+func (s *Session) GetID() string {
+	return s.id
+}
+
+// GetConnection 获取会话当前绑定的链接
+func (s *Session) GetConnection() ziface.IConnection {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn
+}
+
+// JoinGroup 加入分组
+func (s *Session) JoinGroup(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.groups[name] = struct{}{}
+}
+
+// LeaveGroup 离开分组
+func (s *Session) LeaveGroup(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.groups, name)
+}
+
+// InGroup 是否在分组中
+func (s *Session) InGroup(name string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, ok := s.groups[name]
+	return ok
+}
+
+// Groups 获取加入的所有分组
+func (s *Session) Groups() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	groups := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// SessionManager 会话管理模块，保存所有绑定的和等待恢复的会话
+// 等待恢复的会话同时保存到会话存储中，进程重启后仍然可以从存储中恢复
+type SessionManager struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+	store    ziface.ISessionStore
+	// 是否已经停止，停止后不再移除过期的会话，会话留在存储中等待新的进程恢复
+	stopped bool
+}
+
+// NewSessionManager 创建会话管理模块，store 为 nil 时使用内存中的会话存储
+func NewSessionManager(store ziface.ISessionStore) *SessionManager {
+	if store == nil {
+		store = NewMemorySessionStore()
+	}
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+		store:    store,
+	}
+}
+
+// GetStore 获取会话存储
+func (m *SessionManager) GetStore() ziface.ISessionStore {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.store
+}
+
+// setStore 替换会话存储
+func (m *SessionManager) setStore(store ziface.ISessionStore) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.store = store
+}
+
+// Get 根据 ID 获取会话
+func (m *SessionManager) Get(id string) (ziface.ISession, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if s, ok := m.sessions[id]; ok {
+		return s, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+// Len 获取会话总数，包括等待恢复的会话
+func (m *SessionManager) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.sessions)
+}
+
+// stop 停止所有等待恢复的会话的过期定时器，在关闭会话存储之前调用
+// 存储中的会话由新的进程恢复，或者在重放日志时按过期时间丢弃
+func (m *SessionManager) stop() {
+	m.lock.Lock()
+	m.stopped = true
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.lock.Unlock()
+
+	for _, s := range sessions {
+		s.lock.Lock()
+		if s.expire != nil {
+			s.expire.Stop()
+			s.expire = nil
+		}
+		s.lock.Unlock()
+	}
+}
+
+// create 为新的链接创建会话
+func (m *SessionManager) create(conn *Connection) (*Session, error) {
+	s, err := newSession(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sessions[s.id] = s
+
+	return s, nil
+}
+
+// resume 将会话绑定到新的链接，会话仍绑定在旧的链接上时（如旧的链接还没有发现断线）先停止旧的链接
+// 新的链接原来的会话被丢弃
+func (m *SessionManager) resume(id string, conn *Connection) (*Session, error) {
+	m.lock.Lock()
+	s, ok := m.sessions[id]
+	if !ok {
+		// 不在内存中的会话（如进程重启之前断开的会话）从会话存储中读取
+		data, err := m.store.Load(id)
+		if err != nil {
+			m.lock.Unlock()
+			return nil, ErrSessionNotFound
+		}
+		s = restoreSession(data)
+		m.sessions[id] = s
+	}
+	if s == conn.session {
+		m.lock.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	discarded := conn.session
+	if discarded != nil {
+		delete(m.sessions, discarded.id)
+	}
+	store := m.store
+	m.lock.Unlock()
+
+	// 会话重新绑定到链接，不再需要等待恢复
+	if err := store.Delete(id); err != nil {
+		fmt.Printf("session %s delete from store error %v\n", id, err)
+	}
+
+	if discarded != nil {
+		discarded.reliable.fail(ErrSessionExpired)
+	}
+
+	s.lock.Lock()
+	old := s.conn
+	s.conn = conn
+	if s.expire != nil {
+		s.expire.Stop()
+		s.expire = nil
+	}
+	properties, identity := s.properties, s.identity
+	s.properties, s.identity = nil, nil
+	s.lock.Unlock()
+
+	if old != nil {
+		// 关闭旧的 socket，由旧的 Reader 停止旧的链接，会话已经不再绑定它，不会进入等待恢复的状态
+		properties, identity = old.Properties(), old.GetIdentity()
+		old.Conn.Close()
+	}
+
+	for key, value := range properties {
+		conn.SetProPerty(key, value)
+	}
+	if identity != nil {
+		conn.setIdentity(identity)
+	}
+
+	return s, nil
+}
+
+// detach 链接断开时保存链接的状态，会话在保留时间内等待恢复，过期后被移除
+func (m *SessionManager) detach(s *Session, conn *Connection) {
+	timeout := time.Duration(utils.GlobalObject.SessionTimeout) * time.Second
+
+	s.lock.Lock()
+	if s.conn != conn {
+		// 会话已经被其它链接恢复
+		s.lock.Unlock()
+		return
+	}
+	s.conn = nil
+	s.properties = conn.Properties()
+	s.identity = conn.GetIdentity()
+	m.lock.Lock()
+	if !m.stopped {
+		s.expire = time.AfterFunc(timeout, func() {
+			m.expire(s)
+		})
+	}
+	m.lock.Unlock()
+	data := s.data(time.Now().Add(timeout))
+	s.lock.Unlock()
+
+	if err := m.GetStore().Save(data); err != nil {
+		fmt.Printf("session %s save to store error %v\n", s.id, err)
+	}
+}
+
+// expire 移除过期的会话
+func (m *SessionManager) expire(s *Session) {
+	s.lock.RLock()
+	attached := s.conn != nil
+	s.lock.RUnlock()
+	if attached {
+		return
+	}
+
+	m.lock.Lock()
+	if m.stopped {
+		// 定时器在停止之前已经触发，会话留在存储中
+		m.lock.Unlock()
+		return
+	}
+	delete(m.sessions, s.id)
+	store := m.store
+	m.lock.Unlock()
+
+	fmt.Printf("session %s expired\n", s.id)
+	if err := store.Delete(s.id); err != nil {
+		fmt.Printf("session %s delete from store error %v\n", s.id, err)
+	}
+	s.reliable.fail(ErrSessionExpired)
+}
+
+// sessionProvider 提供会话管理模块的 Server
+type sessionProvider interface {
+	sessionMgr() *SessionManager
+}
+
+// startSession 开启会话时为链接创建会话，并将会话的 ID 告知客户端
+func (c *Connection) startSession() {
+	provider, ok := c.TCPServer.(sessionProvider)
+	if !ok || utils.GlobalObject.SessionTimeout <= 0 {
+		return
+	}
+	c.sessions = provider.sessionMgr()
+
+	s, err := c.sessions.create(c)
+	if err != nil {
+		fmt.Println("ConnID=", c.ConnID, " create session error ", err)
+		return
+	}
+	c.setSession(s)
+	c.SendMsg(MsgIDSession, []byte(s.id))
+}
+
+// handleResume 处理客户端恢复会话的请求，返回 false 表示该消息不是会话消息
+func (c *Connection) handleResume(msg ziface.IMessage) bool {
+	if msg.GetMsgID() != MsgIDResume || c.sessions == nil {
+		return false
+	}
+
+	s, err := c.sessions.resume(string(msg.GetData()), c)
+	if err != nil {
+		fmt.Println("ConnID=", c.ConnID, " resume session error ", err)
+		c.SendMsg(MsgIDResume, append([]byte{ResumeFailed}, err.Error()...))
+		return true
+	}
+	// 持有可靠消息的发送锁直到未确认的消息重新发送完毕，会话生效之后发送的新消息排在它们之后
+	s.reliable.sendLock.Lock()
+	c.setSession(s)
+
+	// 恢复的会话已经通过认证
+	if c.authTimer != nil && c.GetIdentity() != nil {
+		c.authTimer.Stop()
+	}
+	c.SendMsg(MsgIDResume, []byte{ResumeOK})
+
+	// 重新发送未确认的可靠消息
+	s.reliable.resend(c)
+	s.reliable.sendLock.Unlock()
+	c.TCPServer.CallOnSessionResume(c, s)
+
+	return true
+}
+
+// GetSession 获取链接的会话，未开启会话时为 nil
+func (c *Connection) GetSession() ziface.ISession {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	if c.session == nil {
+		return nil
+	}
+	return c.session
+}
+
+// currentSession 获取链接的会话
+func (c *Connection) currentSession() *Session {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	return c.session
+}
+
+// setSession 设置链接的会话
+func (c *Connection) setSession(s *Session) {
+	c.propertyLock.Lock()
+	defer c.propertyLock.Unlock()
+
+	c.session = s
+}
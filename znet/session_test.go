@@ -0,0 +1,268 @@
+package znet
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestSessionResume(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.SessionTimeout = 5
+
+	s := NewServer("session").(*Server)
+	s.AddHandlerFunc(1, func(request ziface.IRequest) {
+		request.GetConnection().SetProPerty("room", "r1")
+		request.GetConnection().GetSession().JoinGroup("g1")
+		request.GetConnection().SendMsg(1, nil)
+	})
+	s.AddHandlerFunc(2, func(request ziface.IRequest) {
+		room, _ := request.GetConnection().GetProPerty("room")
+		groups := request.GetConnection().GetSession().Groups()
+		request.GetConnection().SendMsg(2, []byte(fmt.Sprintf("%v %s", room, strings.Join(groups, ","))))
+	})
+	s.Start()
+
+	dial := func() (net.Conn, string) {
+		conn := dialTest(t, s.Port)
+		msg := readTestMsg(t, conn)
+		if msg.ID != MsgIDSession {
+			t.Fatalf("first msg id=%x, want MsgIDSession", msg.ID)
+		}
+		return conn, string(msg.Data)
+	}
+	waitConns := func() {
+		for deadline := time.Now().Add(3 * time.Second); s.ConnMgr.Len() != 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("connections not closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// 第一个链接设置属性、加入分组后断开
+	first, token := dial()
+	sendTestMsg(first, 1, nil)
+	readTestMsg(t, first)
+	first.Close()
+	waitConns()
+
+	// 新的链接恢复会话，得到原来的属性和分组
+	second, _ := dial()
+	defer second.Close()
+	sendTestMsg(second, MsgIDResume, []byte("unknown"))
+	if msg := readTestMsg(t, second); msg.ID != MsgIDResume || msg.Data[0] != ResumeFailed {
+		t.Fatalf("resume unknown token reply id=%x data=%v", msg.ID, msg.Data)
+	}
+	sendTestMsg(second, MsgIDResume, []byte(token))
+	if msg := readTestMsg(t, second); msg.ID != MsgIDResume || msg.Data[0] != ResumeOK {
+		t.Fatalf("resume reply id=%x data=%v", msg.ID, msg.Data)
+	}
+	sendTestMsg(second, 2, nil)
+	if msg := readTestMsg(t, second); string(msg.Data) != "r1 g1" {
+		t.Fatalf("resumed state = %s, want r1 g1", msg.Data)
+	}
+
+	// 新的链接原来的会话被丢弃
+	if n := s.GetSessionMgr().Len(); n != 1 {
+		t.Fatalf("sessions = %d, want 1", n)
+	}
+	if session, err := s.GetSessionMgr().Get(token); err != nil || session.GetConnection() == nil {
+		t.Fatalf("resumed session not attached: %v", err)
+	}
+
+	second.Close()
+	waitConns()
+}
+
+func TestReliableResend(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.SessionTimeout = 5
+
+	delivered := make(chan error, 1)
+	s := NewServer("reliable").(*Server)
+	s.AddHandlerFunc(1, func(request ziface.IRequest) {
+		request.GetConnection().SendMsgReliable(100, []byte("gift"), func(seq uint64, err error) {
+			delivered <- err
+		})
+	})
+	s.Start()
+
+	dial := func() (net.Conn, string) {
+		conn := dialTest(t, s.Port)
+		return conn, string(readTestMsg(t, conn).Data)
+	}
+	readReliable := func(conn net.Conn) uint64 {
+		msg := readTestMsg(t, conn)
+		if msg.ID != MsgIDReliable || binary.LittleEndian.Uint32(msg.Data[8:]) != 100 || string(msg.Data[reliableHeadLen:]) != "gift" {
+			t.Fatalf("reliable msg id=%x data=%v", msg.ID, msg.Data)
+		}
+		return binary.LittleEndian.Uint64(msg.Data)
+	}
+
+	// 收到可靠消息但没有确认就断开
+	first, token := dial()
+	sendTestMsg(first, 1, nil)
+	if seq := readReliable(first); seq != 1 {
+		t.Fatalf("seq = %d, want 1", seq)
+	}
+	first.Close()
+	for s.ConnMgr.Len() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 恢复会话后重新收到该消息，确认后投递成功
+	second, _ := dial()
+	defer second.Close()
+	sendTestMsg(second, MsgIDResume, []byte(token))
+	readTestMsg(t, second)
+	seq := readReliable(second)
+	ack := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ack, seq)
+	sendTestMsg(second, MsgIDAck, ack)
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Fatalf("delivery err = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("delivery callback timeout")
+	}
+
+	second.Close()
+	for s.ConnMgr.Len() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReliableResendOrder(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.SessionTimeout = 5
+
+	var token atomic.Value
+	token.Store("")
+	s := NewServer("reliable").(*Server)
+	s.AddHandlerFunc(1, func(request ziface.IRequest) {
+		request.GetConnection().SendMsgReliable(100, []byte("old"), nil)
+	})
+	// 会话恢复之后立即发送新的可靠消息
+	s.SetOnConnStart(func(conn ziface.IConnection) {
+		c := conn.(*Connection)
+		created := c.currentSession()
+		go func() {
+			for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+				if session := c.currentSession(); session != created && session.id == token.Load().(string) {
+					c.SendMsgReliable(100, []byte("new"), nil)
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	})
+	s.Start()
+	defer s.Stop()
+
+	first := dialTest(t, s.Port)
+	token.Store(string(readTestMsg(t, first).Data))
+	sendTestMsg(first, 1, nil)
+	readTestMsg(t, first)
+	first.Close()
+	for s.ConnMgr.Len() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 未确认的消息重新发送完毕之后才发送新的消息
+	second := dialTest(t, s.Port)
+	defer second.Close()
+	readTestMsg(t, second)
+	sendTestMsg(second, MsgIDResume, []byte(token.Load().(string)))
+	if msg := readTestMsg(t, second); msg.ID != MsgIDResume || msg.Data[0] != ResumeOK {
+		t.Fatalf("resume reply id=%x data=%v", msg.ID, msg.Data)
+	}
+	for i, want := range []string{"old", "new"} {
+		msg := readTestMsg(t, second)
+		if msg.ID != MsgIDReliable || string(msg.Data[reliableHeadLen:]) != want || binary.LittleEndian.Uint64(msg.Data) != uint64(i+1) {
+			t.Fatalf("reliable msg %d seq=%d data=%q, want %q", i, binary.LittleEndian.Uint64(msg.Data), msg.Data[reliableHeadLen:], want)
+		}
+	}
+}
+
+func TestReliableBuffer(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.ReliableBufferSize = 2
+
+	conn := &Connection{ConnID: 1, msgChan: make(chan *[]byte, 4), dp: NewDataPack()}
+	b := newReliableBuffer()
+	var results []string
+	callback := func(seq uint64, err error) {
+		results = append(results, fmt.Sprintf("%d:%v", seq, err))
+	}
+
+	b.send(conn, 1, nil, callback, false)
+	b.send(conn, 1, nil, callback, false)
+	if _, err := b.send(conn, 1, nil, callback, false); err != ErrReliableBufferFull {
+		t.Fatalf("err = %v, want ErrReliableBufferFull", err)
+	}
+
+	// 确认是累积的，剩余的消息在链接断开时投递失败
+	b.ack(1)
+	b.fail(ErrConnClosed)
+	if want := "1:<nil> 2:connection closed"; strings.Join(results, " ") != want {
+		t.Fatalf("results = %v, want %s", results, want)
+	}
+
+	// 发送队列已满时发送阻塞，Reader 处理确认消息不被阻塞
+	conn = &Connection{ConnID: 2, msgChan: make(chan *[]byte, 1), dp: NewDataPack()}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	b = newReliableBuffer()
+	results = nil
+	b.send(conn, 1, nil, callback, false)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := b.send(conn, 1, nil, callback, false)
+		sent <- err
+	}()
+	// 等待第二个消息阻塞在发送队列上
+	time.Sleep(50 * time.Millisecond)
+	acked := make(chan struct{})
+	go func() {
+		b.ack(1)
+		close(acked)
+	}()
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatal("ack blocked by a pending send")
+	}
+
+	// 链接关闭后发送失败，没有会话时移除该消息并回退序列号
+	conn.cancel()
+	if err := <-sent; err != ErrConnClosed {
+		t.Fatalf("blocked send err = %v, want ErrConnClosed", err)
+	}
+	if seq, pending := b.snapshot(); seq != 2 || len(pending) != 0 {
+		t.Fatalf("next seq = %d, pending = %d, want 2 and 0", seq, len(pending))
+	}
+	if want := "1:<nil>"; strings.Join(results, " ") != want {
+		t.Fatalf("results = %v, want %s", results, want)
+	}
+}
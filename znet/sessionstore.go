@@ -0,0 +1,333 @@
+package znet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+// ErrSessionStoreClosed 会话存储已经关闭
+var ErrSessionStoreClosed = errors.New("session store closed")
+
+// MemorySessionStore 内存中的会话存储，进程重启后会话丢失
+type MemorySessionStore struct {
+	lock     sync.RWMutex
+	sessions map[string]*ziface.SessionData
+}
+
+// NewMemorySessionStore 创建内存中的会话存储
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*ziface.SessionData),
+	}
+}
+
+// Save 保存会话
+func (s *MemorySessionStore) Save(data *ziface.SessionData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions[data.ID] = data
+	return nil
+}
+
+// Load 读取会话
+func (s *MemorySessionStore) Load(id string) (*ziface.SessionData, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.sessions[id]
+	if !ok || time.Now().After(data.ExpireAt) {
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+// Delete 删除会话
+func (s *MemorySessionStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+// Close 关闭存储
+func (s *MemorySessionStore) Close() error {
+	return nil
+}
+
+// 日志中记录的操作
+const (
+	sessionOpSave   uint8 = 1
+	sessionOpDelete uint8 = 2
+)
+
+// 日志中的记录数超过有效会话数的倍数时进行压缩
+const (
+	compactRatio   = 2
+	compactMinimum = 1024
+)
+
+// 一条记录的最大长度，超出时视为记录已经损坏
+const maxSessionRecordLen = 64 << 20
+
+// sessionRecord 日志中的一条记录，文件中的格式为 |Len(4)|CRC32(4)|gob(sessionRecord)|
+type sessionRecord struct {
+	Op   uint8
+	ID   string
+	Data *ziface.SessionData
+}
+
+// FileSessionStore 基于追加写日志的会话存储，不依赖外部服务
+// 打开时重放日志在内存中建立索引，日志中的过期会话和被覆盖的记录在压缩时清理
+type FileSessionStore struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	sessions map[string]*ziface.SessionData
+	// 日志中的记录数
+	records int
+	// 是否已经关闭，关闭后所有操作返回 ErrSessionStoreClosed
+	closed bool
+}
+
+// NewFileSessionStore 打开（或创建）会话日志文件
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	s := &FileSessionStore{
+		path:     path,
+		sessions: make(map[string]*ziface.SessionData),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+
+	return s, nil
+}
+
+// replay 重放日志，末尾不完整或损坏的记录（如写入时进程退出）被截断
+func (s *FileSessionStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		record, n, err := readSessionRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("session store %s truncated at %d: %v\n", s.path, valid, err)
+			if err := os.Truncate(s.path, valid); err != nil {
+				return err
+			}
+			break
+		}
+		valid += n
+		s.records++
+
+		switch record.Op {
+		case sessionOpSave:
+			s.sessions[record.ID] = record.Data
+		case sessionOpDelete:
+			delete(s.sessions, record.ID)
+		}
+	}
+
+	// 丢弃已经过期的会话
+	now := time.Now()
+	for id, data := range s.sessions {
+		if now.After(data.ExpireAt) {
+			delete(s.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+// readSessionRecord 读取一条记录，返回记录在文件中的长度
+func readSessionRecord(reader io.Reader) (*sessionRecord, int64, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(head)
+	if length > maxSessionRecordLen {
+		return nil, 0, errors.New("session record too large")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(head[4:]) {
+		return nil, 0, errors.New("session record checksum mismatch")
+	}
+
+	record := &sessionRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(record); err != nil {
+		return nil, 0, err
+	}
+	return record, int64(len(head) + len(body)), nil
+}
+
+// encodeSessionRecord 编码一条记录
+func encodeSessionRecord(record *sessionRecord) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 8))
+	if err := gob.NewEncoder(buf).Encode(record); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-8))
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(data[8:], crcTable))
+	return data, nil
+}
+
+// append 追加一条记录并落盘，调用方需持有锁
+func (s *FileSessionStore) append(record *sessionRecord) error {
+	data, err := encodeSessionRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.records++
+
+	if s.records > compactMinimum && s.records > compactRatio*len(s.sessions) {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact 只保留有效的会话重写日志，写入临时文件后替换，调用方需持有锁
+func (s *FileSessionStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	records := 0
+	for id, data := range s.sessions {
+		if now.After(data.ExpireAt) {
+			delete(s.sessions, id)
+			continue
+		}
+		record, err := encodeSessionRecord(&sessionRecord{Op: sessionOpSave, ID: id, Data: data})
+		if err == nil {
+			_, err = tmp.Write(record)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		records++
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.records = records
+
+	return nil
+}
+
+// Save 保存会话
+func (s *FileSessionStore) Save(data *ziface.SessionData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrSessionStoreClosed
+	}
+
+	if err := s.append(&sessionRecord{Op: sessionOpSave, ID: data.ID, Data: data}); err != nil {
+		return err
+	}
+	s.sessions[data.ID] = data
+	return nil
+}
+
+// Load 读取会话
+func (s *FileSessionStore) Load(id string) (*ziface.SessionData, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, ErrSessionStoreClosed
+	}
+
+	data, ok := s.sessions[id]
+	if !ok || time.Now().After(data.ExpireAt) {
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+// Delete 删除会话
+func (s *FileSessionStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrSessionStoreClosed
+	}
+
+	if _, ok := s.sessions[id]; !ok {
+		return nil
+	}
+	delete(s.sessions, id)
+	return s.append(&sessionRecord{Op: sessionOpDelete, ID: id})
+}
+
+// Close 关闭存储，重复关闭时直接返回
+func (s *FileSessionStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
@@ -0,0 +1,147 @@
+package znet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.SessionTimeout = 60
+
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 链接断开，会话连同属性、身份、分组和未确认的可靠消息一起保存
+	m := NewSessionManager(store)
+	conn := &Connection{ConnID: 1, msgChan: make(chan *[]byte, 4), dp: NewDataPack(), property: make(map[string]interface{})}
+	s, err := m.create(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetProPerty("room", "r1")
+	conn.SetProPerty("level", int32(7))
+	conn.setIdentity(&ziface.Identity{UserID: "u1", Roles: []string{"admin"}})
+	s.JoinGroup("g1")
+	s.reliable.send(conn, 100, []byte("hello"), nil, true)
+	m.detach(s, conn)
+	s.expire.Stop()
+
+	// 另一个会话保存后被删除
+	other := &Connection{ConnID: 2, msgChan: make(chan *[]byte, 4), dp: NewDataPack(), property: make(map[string]interface{})}
+	gone, _ := m.create(other)
+	m.detach(gone, other)
+	gone.expire.Stop()
+	m.expire(gone)
+	store.Close()
+
+	// 模拟写入时进程退出，日志末尾留下不完整的记录
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	f.Write([]byte{0xFF, 0x00, 0x00})
+	f.Close()
+
+	// 进程重启后从日志中恢复
+	store, err = NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := store.Load(gone.id); err != ErrSessionNotFound {
+		t.Fatalf("deleted session load err=%v", err)
+	}
+
+	m = NewSessionManager(store)
+	conn = &Connection{ConnID: 3, msgChan: make(chan *[]byte, 4), dp: NewDataPack(), property: make(map[string]interface{})}
+	restored, err := m.resume(s.id, conn)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if room, _ := conn.GetProPerty("room"); room != "r1" {
+		t.Fatalf("room = %v", room)
+	}
+	if level, _ := conn.GetProPerty("level"); level != int32(7) {
+		t.Fatalf("level = %#v", level)
+	}
+	if identity := conn.GetIdentity(); identity == nil || identity.UserID != "u1" {
+		t.Fatalf("identity = %v", identity)
+	}
+	if !restored.InGroup("g1") {
+		t.Fatal("group not restored")
+	}
+	if nextSeq, pending := restored.reliable.snapshot(); nextSeq != 2 || len(pending) != 1 || string(pending[0].Data) != "hello" {
+		t.Fatalf("reliable nextSeq=%d pending=%v", nextSeq, pending)
+	}
+
+	// 恢复之后会话从存储中删除
+	if _, err := store.Load(s.id); err != ErrSessionNotFound {
+		t.Fatalf("resumed session load err=%v", err)
+	}
+}
+
+func TestSessionStoreClosedOnStop(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.SessionTimeout = 60
+
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 停止后等待恢复的会话不再过期，包括停止之前已经触发的定时器
+	m := NewSessionManager(store)
+	conn := &Connection{ConnID: 1, property: make(map[string]interface{})}
+	s, _ := m.create(conn)
+	m.detach(s, conn)
+	m.stop()
+	if s.expire != nil {
+		t.Fatal("expire timer not stopped")
+	}
+	m.expire(s)
+
+	// 停止之后断开的链接只保存会话，不再开启定时器
+	late := &Connection{ConnID: 2, property: make(map[string]interface{})}
+	lateSession, _ := m.create(late)
+	m.detach(lateSession, late)
+	if lateSession.expire != nil {
+		t.Fatal("expire timer started after stop")
+	}
+
+	// 关闭之后的操作返回错误，不写入已经关闭的文件
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(s.id); err != ErrSessionStoreClosed {
+		t.Fatalf("delete after close err=%v", err)
+	}
+	if err := store.Save(&ziface.SessionData{ID: "x"}); err != ErrSessionStoreClosed {
+		t.Fatalf("save after close err=%v", err)
+	}
+	if _, err := store.Load(s.id); err != ErrSessionStoreClosed {
+		t.Fatalf("load after close err=%v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close twice err=%v", err)
+	}
+
+	// 两个会话都留在存储中等待新的进程恢复
+	store, err = NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, id := range []string{s.id, lateSession.id} {
+		if _, err := store.Load(id); err != nil {
+			t.Fatalf("session %s load err=%v", id, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package znet
+
+// MsgIDReservedStart 框架保留的系统消息 MsgID 的起始值，业务不能注册该值及以上的 MsgID
+const MsgIDReservedStart uint32 = 0xFFFFFF00
+
+// 框架内部使用的系统消息 MsgID
+const (
+	// MsgIDHandshake 加密握手，客户端发送 |ClientPub(32)|，服务端回复 |CipherID(1)|ServerPub(32)|
+	MsgIDHandshake = MsgIDReservedStart + iota
+	// MsgIDRateLimited 消息超出速率限制被丢弃，服务端发送 |MsgID(4)|
+	MsgIDRateLimited
+	// MsgIDServerFull 链接数已满，服务端发送 |Reason| 之后关闭链接
+	MsgIDServerFull
+	// MsgIDQueuePosition 链接在等待队列中的位置，服务端发送 |Position(4)|，0 表示已经接入
+	MsgIDQueuePosition
+	// MsgIDAuth 链接认证，客户端发送 |Token|，服务端回复 |Result(1)|Reason|
+	MsgIDAuth
+	// MsgIDForbidden 链接的身份没有处理该消息要求的角色，服务端发送 |MsgID(4)|
+	MsgIDForbidden
+	// MsgIDSession 开启会话时服务端在链接建立后发送 |Token|，断线重连后客户端用它恢复会话
+	MsgIDSession
+	// MsgIDResume 恢复会话，客户端发送 |Token|，服务端回复 |Result(1)|Reason|
+	MsgIDResume
+	// MsgIDReliable 需要确认的可靠消息，服务端发送 |Seq(8)|MsgID(4)|Data|，客户端需按 Seq 去重
+	MsgIDReliable
+	// MsgIDAck 确认可靠消息，客户端发送 |Seq(8)|，表示 Seq 及之前的消息都已收到
+	MsgIDAck
+	// MsgIDClusterHello 集群节点之间的链接建立后发送 |IDLen(2)|NodeID|Secret|
+	MsgIDClusterHello
+	// MsgIDClusterUser 集群节点上用户上线、下线，发送 |Online(1)|UserID|
+	MsgIDClusterUser
+	// MsgIDClusterForward 转发给用户的消息，发送 |MsgID(4)|IDLen(2)|UserID|Data|
+	MsgIDClusterForward
+	// MsgIDGatewayHello 网关链接后端时发送 |Secret|
+	MsgIDGatewayHello
+	// MsgIDGatewayOpen 网关第一次转发某个客户端链接的消息之前发送 |ConnID(4)|Identity(JSON)|
+	MsgIDGatewayOpen
+	// MsgIDGatewayForward 网关转发客户端的消息，后端回复客户端的消息，内容都为 |ConnID(4)|MsgID(4)|Data|
+	MsgIDGatewayForward
+	// MsgIDGatewayClose 客户端链接断开（网关发送）或后端关闭客户端链接（后端发送）|ConnID(4)|
+	MsgIDGatewayClose
+	// MsgIDHeartbeat 心跳，客户端发送 |Nonce(最多 8 字节)|，服务端原样回复
+	MsgIDHeartbeat
+	// MsgIDGatewayIdentity 网关上客户端链接的身份变化（认证、恢复会话）后，下一次转发之前发送 |ConnID(4)|Identity(JSON)|
+	MsgIDGatewayIdentity
+)
+
+// isInternalMsg 是否为集群节点之间、网关与后端之间的内部消息
+func isInternalMsg(msgID uint32) bool {
+	return (msgID >= MsgIDClusterHello && msgID <= MsgIDClusterForward) || isGatewayMsg(msgID)
+}
+
+// isGatewayMsg 是否为网关与后端之间的消息
+func isGatewayMsg(msgID uint32) bool {
+	return (msgID >= MsgIDGatewayHello && msgID <= MsgIDGatewayClose) || msgID == MsgIDGatewayIdentity
+}
@@ -0,0 +1,40 @@
+package znet
+
+import (
+	"fmt"
+
+	"github.com/646222472/zinx/ziface"
+)
+
+// AddTypedHandler 注册一个类型化的业务处理方法
+// 框架先用该 MsgID 对应的序列化器将请求数据解码为 T，再调用 handle，解码失败的请求会被丢弃
+func AddTypedHandler[T any](s ziface.IServer, msgID uint32, handle func(request ziface.IRequest, in *T), opts ...ziface.RouteOption) {
+	s.AddHandlerFunc(msgID, func(request ziface.IRequest) {
+		in := new(T)
+		if err := request.Bind(in); err != nil {
+			fmt.Printf("decode msgID=%d data error %v\n", request.GetMsgID(), err)
+			return
+		}
+		handle(request, in)
+	}, opts...)
+}
+
+// AddTypedReplyHandler 注册一个带回复的类型化业务处理方法
+// 请求数据解码为 T 后调用 handle，handle 返回的回复 R 编码后以 replyID 通过 SendMsg 发回客户端
+// handle 返回 error 或 nil 回复时不发送任何消息
+func AddTypedReplyHandler[T, R any](s ziface.IServer, msgID, replyID uint32, handle func(request ziface.IRequest, in *T) (*R, error), opts ...ziface.RouteOption) {
+	AddTypedHandler(s, msgID, func(request ziface.IRequest, in *T) {
+		reply, err := handle(request, in)
+		if err != nil {
+			fmt.Printf("handle msgID=%d error %v\n", request.GetMsgID(), err)
+			return
+		}
+		if reply == nil {
+			return
+		}
+
+		if err := request.GetConnection().SendObj(replyID, reply); err != nil {
+			fmt.Printf("send reply msgID=%d error %v\n", replyID, err)
+		}
+	}, opts...)
+}
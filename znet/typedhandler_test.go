@@ -0,0 +1,80 @@
+package znet
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/646222472/zinx/utils"
+	"github.com/646222472/zinx/ziface"
+)
+
+func TestTypedHandler(t *testing.T) {
+	old := *utils.GlobalObject
+	defer func() { *utils.GlobalObject = old }()
+	utils.GlobalObject.Host = "127.0.0.1"
+	utils.GlobalObject.TCPPort = freePort(t)
+	utils.GlobalObject.Serializer = "json"
+
+	s := NewServer("typed").(*Server)
+	// MsgID 1 解码后回显，解码失败的请求不会调用 handle
+	AddTypedHandler(s, 1, func(request ziface.IRequest, in *testGreeting) {
+		request.GetConnection().SendMsg(1, []byte(in.Name))
+	})
+	// MsgID 2 以 MsgID 3 回复，Count 为 0 时返回错误，为 1 时不回复
+	var called int32
+	AddTypedReplyHandler(s, 2, 3, func(request ziface.IRequest, in *testGreeting) (*testGreeting, error) {
+		atomic.AddInt32(&called, 1)
+		switch in.Count {
+		case 0:
+			return nil, errors.New("empty count")
+		case 1:
+			return nil, nil
+		}
+		return &testGreeting{Name: "hello " + in.Name, Count: in.Count * 2}, nil
+	})
+	// 解码失败之后用于确认链接仍然可用
+	s.AddHandlerFunc(4, func(request ziface.IRequest) {
+		request.GetConnection().SendMsg(4, []byte("pong"))
+	})
+	s.Start()
+	defer s.Stop()
+
+	conn := dialTest(t, s.Port)
+	defer conn.Close()
+	json := NewJSONSerializer()
+
+	data, _ := json.Marshal(&testGreeting{Name: "zinx"})
+	sendTestMsg(conn, 1, data)
+	if msg := readTestMsg(t, conn); msg.ID != 1 || string(msg.Data) != "zinx" {
+		t.Fatalf("typed handler reply id=%d data=%s", msg.ID, msg.Data)
+	}
+
+	// 解码失败、handle 返回错误和 nil 回复时都不发送消息，只有最后一个请求得到回复
+	sendTestMsg(conn, 1, []byte("{bad json"))
+	sendTestMsg(conn, 2, []byte("{bad json"))
+	for _, count := range []int{0, 1, 2} {
+		data, _ := json.Marshal(&testGreeting{Name: "zinx", Count: count})
+		sendTestMsg(conn, 2, data)
+	}
+	msg := readTestMsg(t, conn)
+	var out testGreeting
+	if err := json.Unmarshal(msg.Data, &out); err != nil || msg.ID != 3 || out.Name != "hello zinx" || out.Count != 4 {
+		t.Fatalf("typed reply id=%d %+v, %v", msg.ID, out, err)
+	}
+	if called := atomic.LoadInt32(&called); called != 3 {
+		t.Fatalf("reply handler called %d times, want 3", called)
+	}
+
+	sendTestMsg(conn, 4, nil)
+	if msg := readTestMsg(t, conn); msg.ID != 4 || string(msg.Data) != "pong" {
+		t.Fatalf("msg id=%d data=%s after decode errors", msg.ID, msg.Data)
+	}
+
+	// 没有其它多余的回复
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("unexpected %d bytes", n)
+	}
+}